@@ -47,24 +47,17 @@ func main() {
 		log.Fatalf("Failed to create streaming completion: %v", err)
 	}
 
-	// Process the stream
+	// Process the stream; it is closed and metered when the loop ends
 	fmt.Print("Assistant: ")
-	for stream.Next() {
-		chunk := stream.Current()
+	for chunk, err := range stream.Chunks() {
+		if err != nil {
+			log.Fatalf("\nStreaming error: %v", err)
+		}
 		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
 			fmt.Print(chunk.Choices[0].Delta.Content)
 		}
 	}
 
-	if err := stream.Err(); err != nil {
-		log.Fatalf("\nStreaming error: %v", err)
-	}
-
-	// Close the stream
-	if err := stream.Close(); err != nil {
-		log.Printf("\nWarning: Failed to close stream: %v", err)
-	}
-
 	fmt.Println()
 	fmt.Println("\nUsage data sent to Revenium! Check your dashboard")
 }
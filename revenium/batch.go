@@ -0,0 +1,142 @@
+package revenium
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// batchMeteringResponse is the optional per-item result body returned by the batch endpoint.
+// When it is absent every event in an accepted batch is considered delivered. Neither the
+// batch endpoint nor this body is part of the documented metering API, which is why
+// batching is opt-in (Config.MeteringBatchEnabled).
+type batchMeteringResponse struct {
+	Results []batchMeteringResult `json:"results"`
+}
+
+// batchMeteringResult reports the outcome of one event of a batch, by position
+type batchMeteringResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// meteringBatchSize is the batch size the metering queue is started with: 1,
+// which disables batching, unless batching is enabled
+func meteringBatchSize(cfg *Config) int {
+	if !cfg.MeteringBatchEnabled {
+		return 1
+	}
+	if cfg.MeteringBatchSize <= 1 {
+		return defaultMeteringBatchSize
+	}
+	return cfg.MeteringBatchSize
+}
+
+// deliverMeteringBatch is run by the metering workers for every batch of queued payloads.
+// Sinks implementing BatchMeteringSink receive the whole batch; other sinks get one
+// Send per payload.
+func (r *ReveniumOpenAI) deliverMeteringBatch(ctx context.Context, batch []*MeteringPayload) []error {
+	if bs, ok := r.sink.(BatchMeteringSink); ok && len(batch) > 1 {
+		errs := bs.SendBatch(ctx, batch)
+		for _, err := range errs {
+			if err != nil {
+				Error("Failed to send metering data: %v", err)
+			}
+		}
+		return errs
+	}
+
+	errs := make([]error, len(batch))
+	for i, payload := range batch {
+		errs[i] = r.deliverMetering(ctx, payload)
+	}
+	return errs
+}
+
+// SendBatch POSTs the payloads as a JSON array to the batch endpoint. Events the API
+// reports as failed, and every event of a batch the API rejects, are resent
+// individually. If the endpoint is unavailable the sink stops batching. The
+// metering queue only sends batches when Config.MeteringBatchEnabled is set.
+func (s *HTTPSink) SendBatch(ctx context.Context, payloads []*MeteringPayload) []error {
+	if len(payloads) == 1 || s.batchUnsupported.Load() {
+		return s.sendEach(ctx, payloads)
+	}
+
+	var body []byte
+	err := withMeteringRetry(ctx, func() error {
+		var sendErr error
+		body, sendErr = s.post(ctx, meteringBatchPath, payloads)
+		return sendErr
+	})
+	if err != nil {
+		var revErr *ReveniumError
+		if errors.As(err, &revErr) && isBatchUnsupportedStatus(revErr.StatusCode) {
+			Warn("Revenium batch endpoint unavailable (status %d), sending metering events individually", revErr.StatusCode)
+			s.batchUnsupported.Store(true)
+			return s.sendEach(ctx, payloads)
+		}
+		if IsValidationError(err) {
+			// Split a rejected batch so valid events are not lost along with invalid ones
+			Debug("Metering batch rejected, sending %d events individually: %v", len(payloads), err)
+			return s.sendEach(ctx, payloads)
+		}
+
+		errs := make([]error, len(payloads))
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	Debug("[METERING] Metering batch of %d events sent successfully", len(payloads))
+	return s.resendFailedItems(ctx, payloads, body)
+}
+
+// resendFailedItems parses per-item results and individually resends the events
+// the batch endpoint did not accept
+func (s *HTTPSink) resendFailedItems(ctx context.Context, payloads []*MeteringPayload, body []byte) []error {
+	errs := make([]error, len(payloads))
+
+	var result batchMeteringResponse
+	if len(body) == 0 || json.Unmarshal(body, &result) != nil {
+		return errs
+	}
+
+	for _, item := range result.Results {
+		if item.Index < 0 || item.Index >= len(payloads) {
+			continue
+		}
+		if item.Status >= 200 && item.Status < 300 {
+			continue
+		}
+		Debug("Metering batch item %d failed with status %d: %s, resending", item.Index, item.Status, item.Error)
+		payload := payloads[item.Index]
+		errs[item.Index] = withMeteringRetry(ctx, func() error {
+			return s.Send(ctx, payload)
+		})
+	}
+	return errs
+}
+
+// sendEach sends every payload on its own, with retries
+func (s *HTTPSink) sendEach(ctx context.Context, payloads []*MeteringPayload) []error {
+	errs := make([]error, len(payloads))
+	for i, payload := range payloads {
+		errs[i] = withMeteringRetry(ctx, func() error {
+			return s.Send(ctx, payload)
+		})
+	}
+	return errs
+}
+
+// isBatchUnsupportedStatus reports whether a status means the batch endpoint is not available
+func isBatchUnsupportedStatus(status int) bool {
+	switch status {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return true
+	default:
+		return false
+	}
+}
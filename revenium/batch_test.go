@@ -0,0 +1,126 @@
+package revenium
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// batchTestServer records requests received on the single and batch metering endpoints
+type batchTestServer struct {
+	mu           sync.Mutex
+	batches      [][]*MeteringPayload
+	singles      []*MeteringPayload
+	batchHandler func(w http.ResponseWriter, batch []*MeteringPayload)
+}
+
+func (s *batchTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.URL.Path {
+	case meteringBatchPath:
+		var batch []*MeteringPayload
+		_ = json.NewDecoder(r.Body).Decode(&batch)
+		s.batches = append(s.batches, batch)
+		s.batchHandler(w, batch)
+	case meteringCompletionsPath:
+		var payload *MeteringPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		s.singles = append(s.singles, payload)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestHTTPSinkSendBatchResendsFailedItems(t *testing.T) {
+	srv := &batchTestServer{batchHandler: func(w http.ResponseWriter, batch []*MeteringPayload) {
+		_ = json.NewEncoder(w).Encode(batchMeteringResponse{Results: []batchMeteringResult{
+			{Index: 0, Status: 201},
+			{Index: 1, Status: 503, Error: "busy"},
+		}})
+	}}
+	server := httptest.NewServer(srv)
+	defer server.Close()
+
+	sink := NewHTTPSink(server.URL, "hak_test")
+
+	errs := sink.SendBatch(context.Background(), []*MeteringPayload{testPayload("a"), testPayload("b")})
+
+	assert.Equal(t, []error{nil, nil}, errs)
+	require.Len(t, srv.batches, 1)
+	assert.Len(t, srv.batches[0], 2)
+	require.Len(t, srv.singles, 1)
+	assert.Equal(t, "b", srv.singles[0].TransactionID)
+}
+
+func TestHTTPSinkSendBatchFallsBackWhenUnsupported(t *testing.T) {
+	srv := &batchTestServer{batchHandler: func(w http.ResponseWriter, batch []*MeteringPayload) {
+		w.WriteHeader(http.StatusNotFound)
+	}}
+	server := httptest.NewServer(srv)
+	defer server.Close()
+
+	sink := NewHTTPSink(server.URL, "hak_test")
+
+	errs := sink.SendBatch(context.Background(), []*MeteringPayload{testPayload("a"), testPayload("b")})
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.True(t, sink.batchUnsupported.Load())
+
+	// Once unsupported, later batches skip the batch endpoint entirely
+	sink.SendBatch(context.Background(), []*MeteringPayload{testPayload("c"), testPayload("d")})
+	assert.Len(t, srv.batches, 1)
+	assert.Len(t, srv.singles, 4)
+}
+
+func TestHTTPSinkSendBatchRetriesRateLimits(t *testing.T) {
+	limited := true
+	srv := &batchTestServer{batchHandler: func(w http.ResponseWriter, batch []*MeteringPayload) {
+		if limited {
+			limited = false
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}}
+	server := httptest.NewServer(srv)
+	defer server.Close()
+
+	sink := NewHTTPSink(server.URL, "hak_test")
+
+	errs := sink.SendBatch(context.Background(), []*MeteringPayload{testPayload("a"), testPayload("b")})
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.Len(t, srv.batches, 2, "rate-limited batch is retried as a batch")
+	assert.Empty(t, srv.singles)
+}
+
+func TestMeteringBatchingIsOptIn(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want int
+	}{
+		{name: "default", want: 1},
+		{name: "size without opt-in", cfg: Config{MeteringBatchSize: 10}, want: 1},
+		{name: "opt-in with size", cfg: Config{MeteringBatchEnabled: true, MeteringBatchSize: 10}, want: 10},
+		{name: "opt-in without size", cfg: Config{MeteringBatchEnabled: true}, want: defaultMeteringBatchSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Sink = NewMemorySink()
+			r, err := NewReveniumOpenAI(&cfg)
+			require.NoError(t, err)
+			defer r.Close()
+			assert.Equal(t, tt.want, r.queue.batchSize)
+		})
+	}
+}
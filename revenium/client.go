@@ -1,6 +1,8 @@
 package revenium
 
 import (
+	"context"
+	"errors"
 	"sync"
 )
 
@@ -70,7 +72,8 @@ func (cm *ClientManager) RemoveAzureClient(key string) {
 	delete(cm.azureClients, key)
 }
 
-// CloseAll closes all clients and cleans up resources
+// CloseAll waits for the pending metering of all Revenium clients and clears
+// the caches. The wait is unbounded; use ShutdownAll to bound it.
 func (cm *ClientManager) CloseAll() error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
@@ -89,6 +92,27 @@ func (cm *ClientManager) CloseAll() error {
 	return nil
 }
 
+// ShutdownAll shuts down all Revenium clients until ctx is done and clears the
+// caches. Shut down clients stop metering for good, see Shutdown; the error
+// reports the clients that abandoned events.
+func (cm *ClientManager) ShutdownAll(ctx context.Context) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	var errs []error
+	for _, client := range cm.reveniumClients {
+		if err := client.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Clear caches
+	cm.reveniumClients = make(map[string]*ReveniumOpenAI)
+	cm.azureClients = make(map[string]interface{})
+
+	return errors.Join(errs...)
+}
+
 // GetClientCount returns the number of cached clients
 func (cm *ClientManager) GetClientCount() (int, int) {
 	cm.mu.RLock()
@@ -0,0 +1,842 @@
+package revenium_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/revenium/revenium-middleware-openai-go/revenium"
+	"github.com/revenium/revenium-middleware-openai-go/revenium/openaitest"
+	"github.com/revenium/revenium-middleware-openai-go/revenium/reveniumtest"
+)
+
+// newTestClient creates a client wired to fake OpenAI and Revenium servers
+func newTestClient(t *testing.T, opts ...revenium.Option) (*revenium.ReveniumOpenAI, *openaitest.Server, *reveniumtest.Server) {
+	t.Helper()
+	upstream := openaitest.NewServer()
+	t.Cleanup(upstream.Close)
+	meter := reveniumtest.NewServer()
+	t.Cleanup(meter.Close)
+
+	cfg := &revenium.Config{
+		OpenAIAPIKey:    "sk-test",
+		BaseURL:         upstream.URL,
+		ReveniumAPIKey:  "hak_test",
+		ReveniumBaseURL: meter.URL,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	client, err := revenium.NewReveniumOpenAI(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return client, upstream, meter
+}
+
+func userMessage(model string) openai.ChatCompletionNewParams {
+	return openai.ChatCompletionNewParams{
+		Model:    openai.ChatModel(model),
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("Hi")},
+	}
+}
+
+func TestCompletionsNewMetersUsage(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	upstream.Enqueue(openaitest.Response{Content: "Hello", FinishReason: "length", PromptTokens: 12, CompletionTokens: 5})
+
+	ctx := revenium.WithUsageMetadata(context.Background(), map[string]interface{}{"organizationId": "org-1"})
+	resp, err := client.Chat().Completions().New(ctx, userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", resp.Choices[0].Message.Content)
+
+	client.Flush()
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{
+		OperationType:  revenium.OperationTypeChat,
+		Model:          "gpt-4o-mini",
+		StopReason:     revenium.StopReasonTokenLimit,
+		Provider:       "OPENAI",
+		OrganizationID: "org-1",
+		IsStreamed:     reveniumtest.Streamed(false),
+	})
+	assert.Equal(t, int64(12), ev.InputTokenCount)
+	assert.Equal(t, int64(5), ev.OutputTokenCount)
+	assert.Equal(t, int64(17), ev.TotalTokenCount)
+	assert.Equal(t, int64(1), ev.ChoiceCount)
+	assert.Empty(t, ev.ChoiceStopReasons)
+}
+
+func TestCompletionsNewStreamingMetersUsage(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	upstream.Enqueue(openaitest.Response{Content: "one two three", PromptTokens: 8, CompletionTokens: 3})
+
+	params := userMessage("gpt-4o-mini")
+	params.StreamOptions = openai.ChatCompletionStreamOptionsParam{IncludeUsage: openai.Bool(true)}
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), params)
+	require.NoError(t, err)
+
+	var content string
+	var usageChunks int
+	for stream.Next() {
+		chunk := stream.Current()
+		if len(chunk.Choices) > 0 {
+			content += chunk.Choices[0].Delta.Content
+		} else {
+			usageChunks++
+		}
+	}
+	require.NoError(t, stream.Err())
+	require.NoError(t, stream.Close())
+	assert.Equal(t, "one two three", content)
+	assert.Equal(t, 1, usageChunks, "a usage chunk the caller requested is passed through")
+
+	client.Flush()
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{StopReason: revenium.StopReasonEnd, IsStreamed: reveniumtest.Streamed(true)})
+	assert.Equal(t, int64(8), ev.InputTokenCount)
+	assert.Equal(t, int64(3), ev.OutputTokenCount)
+	assert.Equal(t, int64(11), ev.TotalTokenCount)
+}
+
+func TestCompletionsNewMetersErrors(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	upstream.Enqueue(openaitest.Response{Status: http.StatusBadRequest, ErrorMessage: "bad request"})
+
+	_, err := client.Chat().Completions().New(context.Background(), userMessage("gpt-4o-mini"))
+	require.Error(t, err)
+
+	client.Flush()
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{StopReason: revenium.StopReasonError, Model: "gpt-4o-mini"})
+	assert.Contains(t, ev.ErrorReason, "bad request")
+}
+
+func TestCompletionsNewAzureDeployment(t *testing.T) {
+	upstream := openaitest.NewServer(openaitest.WithAPIKey("azure-key"), openaitest.WithAzureAPIVersions("2024-10-21"))
+	defer upstream.Close()
+	meter := reveniumtest.NewServer()
+	defer meter.Close()
+
+	client, err := revenium.NewReveniumOpenAI(&revenium.Config{
+		AzureAPIKey:     "azure-key",
+		AzureEndpoint:   upstream.URL,
+		AzureAPIVersion: "2024-10-21",
+		ReveniumAPIKey:  "hak_test",
+		ReveniumBaseURL: meter.URL,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+	require.Equal(t, revenium.ProviderAzure, client.GetProvider())
+
+	upstream.Enqueue(openaitest.Response{Content: "Hello", Model: "gpt-4o", PromptTokens: 5, CompletionTokens: 2})
+	_, err = client.Chat().Completions().New(context.Background(), userMessage("my-gpt4o-deployment"))
+	require.NoError(t, err)
+
+	reqs := upstream.Requests()
+	require.Len(t, reqs, 1)
+	assert.Equal(t, "my-gpt4o-deployment", reqs[0].Deployment)
+
+	client.Flush()
+	meter.ExpectOneEvent(t, reveniumtest.Match{Provider: "AZURE", Model: "gpt-4o"})
+}
+
+func TestCompletionsNewStreamingInjectsUsage(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	upstream.Enqueue(openaitest.Response{Content: "one two", PromptTokens: 6, CompletionTokens: 2})
+
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+
+	for stream.Next() {
+		chunk := stream.Current()
+		assert.NotEmpty(t, chunk.Choices, "the injected usage-only chunk is hidden from the caller")
+	}
+	assert.NotEmpty(t, stream.Current().Choices, "Current still returns the last visible chunk")
+	require.NoError(t, stream.Close())
+
+	assert.True(t, upstream.Requests()[0].IncludeUsage)
+
+	client.Flush()
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{IsStreamed: reveniumtest.Streamed(true)})
+	assert.Equal(t, int64(6), ev.InputTokenCount)
+	assert.Equal(t, int64(2), ev.OutputTokenCount)
+}
+
+func TestCompletionsNewStreamingAzureSkipsUsageInjection(t *testing.T) {
+	upstream := openaitest.NewServer(openaitest.WithAzureAPIVersions("2024-02-01"))
+	defer upstream.Close()
+	meter := reveniumtest.NewServer()
+	defer meter.Close()
+
+	client, err := revenium.NewReveniumOpenAI(&revenium.Config{
+		AzureAPIKey:     "azure-key",
+		AzureEndpoint:   upstream.URL,
+		AzureAPIVersion: "2024-02-01",
+		ReveniumAPIKey:  "hak_test",
+		ReveniumBaseURL: meter.URL,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	upstream.Enqueue(openaitest.Response{Content: "one two", PromptTokens: 6, CompletionTokens: 2})
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), userMessage("my-deployment"))
+	require.NoError(t, err)
+	for stream.Next() {
+	}
+	require.NoError(t, stream.Close())
+
+	assert.False(t, upstream.Requests()[0].IncludeUsage, "older Azure api-versions reject stream_options")
+
+	client.Flush()
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{Provider: "AZURE", IsStreamed: reveniumtest.Streamed(true)})
+	assert.True(t, ev.TokensEstimated)
+}
+
+func TestCompletionsNewStreamingUsageInjectionDisabled(t *testing.T) {
+	client, upstream, meter := newTestClient(t, revenium.WithStreamUsageInjectionDisabled(true))
+	upstream.Enqueue(openaitest.Response{Content: "one two", PromptTokens: 6, CompletionTokens: 2})
+
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	for stream.Next() {
+	}
+	require.NoError(t, stream.Close())
+
+	assert.False(t, upstream.Requests()[0].IncludeUsage)
+
+	client.Flush()
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{IsStreamed: reveniumtest.Streamed(true)})
+	assert.True(t, ev.TokensEstimated, "without usage in the stream tokens are estimated locally")
+	assert.Equal(t, int64(2), ev.OutputTokenCount)
+}
+
+func TestCompletionsNewEstimatesMissingUsage(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	upstream.Enqueue(
+		openaitest.Response{Content: "Hello world", OmitUsage: true},
+		openaitest.Response{Content: "Hello world", OmitUsage: true},
+	)
+
+	_, err := client.Chat().Completions().New(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	client.Flush()
+
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{Model: "gpt-4o-mini"})
+	assert.True(t, ev.TokensEstimated)
+	assert.Equal(t, int64(8), ev.InputTokenCount, "3 per message + role + content + 3 reply priming")
+	assert.Equal(t, int64(2), ev.OutputTokenCount)
+	assert.Equal(t, int64(10), ev.TotalTokenCount)
+
+	estimationOff, upstream2, meter2 := newTestClient(t, revenium.WithTokenEstimationDisabled(true))
+	upstream2.Enqueue(openaitest.Response{Content: "Hello world", OmitUsage: true})
+	_, err = estimationOff.Chat().Completions().New(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	estimationOff.Flush()
+
+	ev = meter2.ExpectOneEvent(t, reveniumtest.Match{Model: "gpt-4o-mini"})
+	assert.False(t, ev.TokensEstimated)
+	assert.Zero(t, ev.TotalTokenCount)
+}
+
+func TestCompletionsNewMetersTimeout(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	upstream.Enqueue(openaitest.Response{Content: "Hello", Delay: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.Chat().Completions().New(ctx, userMessage("gpt-4o-mini"))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	client.Flush()
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{StopReason: revenium.StopReasonTimeout, Model: "gpt-4o-mini"})
+	assert.Zero(t, ev.OutputTokenCount)
+}
+
+func TestCompletionsNewStreamingMetersCancellation(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	upstream.Enqueue(openaitest.Response{Content: "one two three four five six", Delay: 20 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Chat().Completions().NewStreaming(ctx, userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+
+	var received string
+	for stream.Next() {
+		if chunk := stream.Current(); len(chunk.Choices) > 0 {
+			received += chunk.Choices[0].Delta.Content
+		}
+		if received == "one two " {
+			cancel()
+			break
+		}
+	}
+	require.NoError(t, stream.Close())
+
+	client.Flush()
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{StopReason: revenium.StopReasonCancelled, IsStreamed: reveniumtest.Streamed(true)})
+	assert.True(t, ev.TokensEstimated)
+	assert.Equal(t, int64(3), ev.OutputTokenCount, `tokens received before the cut-off: "one", " two", " "`)
+}
+
+func TestCompletionsNewStreamingFinalizesWithoutClose(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	upstream.Enqueue(openaitest.Response{Content: "one two", PromptTokens: 6, CompletionTokens: 2})
+
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	for stream.Next() {
+	}
+
+	client.Flush()
+	meter.ExpectOneEvent(t, reveniumtest.Match{StopReason: revenium.StopReasonEnd, IsStreamed: reveniumtest.Streamed(true)})
+
+	// Closing afterwards, even twice, does not meter again
+	require.NoError(t, stream.Close())
+	require.NoError(t, stream.Close())
+	client.Flush()
+	meter.ExpectEventCount(t, 1)
+}
+
+func TestCompletionsNewStreamingIdleTimeout(t *testing.T) {
+	client, upstream, meter := newTestClient(t, revenium.WithStreamIdleTimeout(50*time.Millisecond))
+	upstream.Enqueue(openaitest.Response{Content: "one two three four", Delay: 10 * time.Millisecond})
+
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	require.True(t, stream.Next())
+	require.True(t, stream.Next())
+
+	// The caller stops reading and never closes the stream
+	events := meter.WaitForEvents(1, 2*time.Second)
+	require.Len(t, events, 1)
+	assert.Equal(t, revenium.StopReasonTimeout, events[0].StopReason)
+
+	assert.False(t, stream.Next(), "the stream is closed once finalized")
+	assert.ErrorIs(t, stream.Err(), context.DeadlineExceeded, "the caller learns the stream was cut short")
+	require.NoError(t, stream.Close())
+	client.Flush()
+	meter.ExpectEventCount(t, 1)
+}
+
+func TestCompletionsNewStreamingSlowUpstreamIsNotIdle(t *testing.T) {
+	client, upstream, meter := newTestClient(t, revenium.WithStreamIdleTimeout(50*time.Millisecond))
+	upstream.Enqueue(openaitest.Response{Content: "one two", Delay: 150 * time.Millisecond})
+
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	for stream.Next() {
+	}
+	require.NoError(t, stream.Err())
+	client.Flush()
+
+	meter.ExpectOneEvent(t, reveniumtest.Match{StopReason: revenium.StopReasonEnd})
+}
+
+// recordingLogger captures warnings and discards everything else
+type recordingLogger struct {
+	mu       sync.Mutex
+	warnings []string
+}
+
+func (l *recordingLogger) Debug(string, ...interface{}) {}
+func (l *recordingLogger) Info(string, ...interface{})  {}
+func (l *recordingLogger) Error(string, ...interface{}) {}
+func (l *recordingLogger) Warn(message string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(message, args...))
+}
+
+func (l *recordingLogger) Warnings() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.warnings...)
+}
+
+func TestCompletionsNewStreamingLeakWarning(t *testing.T) {
+	logger := &recordingLogger{}
+	previous := revenium.GetLogger()
+	revenium.SetLogger(logger)
+	defer revenium.SetLogger(previous)
+
+	client, upstream, meter := newTestClient(t, revenium.WithStreamIdleTimeout(-1))
+	upstream.Enqueue(openaitest.Response{Content: "one two three"})
+
+	func() {
+		stream, err := client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+		require.NoError(t, err)
+		require.True(t, stream.Next())
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(meter.Events()) == 0 && time.Now().Before(deadline) {
+		runtime.GC()
+		client.Flush()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	meter.ExpectOneEvent(t, reveniumtest.Match{StopReason: revenium.StopReasonCancelled, IsStreamed: reveniumtest.Streamed(true)})
+	require.NotEmpty(t, logger.Warnings())
+	assert.Contains(t, logger.Warnings()[0], "completions_test.go:", "the warning points at the NewStreaming call site")
+}
+
+func TestCompletionsNewStreamingLeakWarningWithIdleTimeout(t *testing.T) {
+	logger := &recordingLogger{}
+	previous := revenium.GetLogger()
+	revenium.SetLogger(logger)
+	defer revenium.SetLogger(previous)
+
+	// The default idle timeout is armed but far away; the finalizer fires first
+	client, upstream, meter := newTestClient(t)
+	upstream.Enqueue(openaitest.Response{Content: "one two three"})
+
+	func() {
+		stream, err := client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+		require.NoError(t, err)
+		require.True(t, stream.Next())
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(meter.Events()) == 0 && time.Now().Before(deadline) {
+		runtime.GC()
+		client.Flush()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	meter.ExpectOneEvent(t, reveniumtest.Match{StopReason: revenium.StopReasonCancelled, IsStreamed: reveniumtest.Streamed(true)})
+	require.NotEmpty(t, logger.Warnings())
+	assert.Contains(t, logger.Warnings()[0], "garbage collected")
+}
+
+func TestStreamingWrapperChunks(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	upstream.Enqueue(
+		openaitest.Response{Content: "one two three", PromptTokens: 6, CompletionTokens: 3},
+		openaitest.Response{Content: "one two three", PromptTokens: 6, CompletionTokens: 3},
+		openaitest.Response{Content: "one two three", StreamError: "overloaded", StreamErrorAfter: 1},
+	)
+
+	// Full iteration meters the stream without Close
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	var content string
+	for chunk, err := range stream.Chunks() {
+		require.NoError(t, err)
+		if len(chunk.Choices) > 0 {
+			content += chunk.Choices[0].Delta.Content
+		}
+	}
+	assert.Equal(t, "one two three", content)
+	client.Flush()
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{StopReason: revenium.StopReasonEnd})
+	assert.Equal(t, int64(3), ev.OutputTokenCount)
+
+	// Breaking out of the loop meters the stream once
+	meter.Reset()
+	stream, err = client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	for range stream.Chunks() {
+		break
+	}
+	require.NoError(t, stream.Close())
+	client.Flush()
+	meter.ExpectEventCount(t, 1)
+	meter.ExpectOneEvent(t, reveniumtest.Match{StopReason: revenium.StopReasonCancelled})
+
+	// A stream error is yielded last
+	meter.Reset()
+	stream, err = client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	var lastErr error
+	for _, err := range stream.Chunks() {
+		lastErr = err
+	}
+	require.Error(t, lastErr)
+	assert.Contains(t, lastErr.Error(), "overloaded")
+	client.Flush()
+	meter.ExpectOneEvent(t, reveniumtest.Match{StopReason: revenium.StopReasonError})
+}
+
+func TestStreamingWrapperChannel(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	upstream.Enqueue(
+		openaitest.Response{Content: "one two three", PromptTokens: 6, CompletionTokens: 3},
+		openaitest.Response{Content: "one two three four five six", Delay: 20 * time.Millisecond},
+	)
+
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	var content string
+	for c := range stream.Channel(context.Background()) {
+		require.NoError(t, c.Err)
+		if len(c.Chunk.Choices) > 0 {
+			content += c.Chunk.Choices[0].Delta.Content
+		}
+	}
+	assert.Equal(t, "one two three", content)
+	client.Flush()
+	meter.ExpectOneEvent(t, reveniumtest.Match{StopReason: revenium.StopReasonEnd})
+
+	// Cancelling the channel context stops the stream and meters it as cancelled
+	meter.Reset()
+	stream, err = client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := stream.Channel(ctx)
+	<-ch
+	cancel()
+	for range ch {
+	}
+	client.Flush()
+	meter.ExpectOneEvent(t, reveniumtest.Match{StopReason: revenium.StopReasonCancelled})
+}
+
+func TestStreamingWrapperChannelCancelledWhileUpstreamStalls(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	sink := revenium.NewMemorySink()
+	client, err := revenium.NewReveniumOpenAI(&revenium.Config{OpenAIAPIKey: "sk-test", BaseURL: upstream.URL, Sink: sink})
+	require.NoError(t, err)
+	defer client.Close()
+
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := stream.Channel(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan struct{})
+	go func() {
+		for range ch {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed after its context was cancelled")
+	}
+
+	client.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, revenium.StopReasonCancelled, payloads[0].StopReason)
+}
+
+func TestStreamingWrapperFinalCompletion(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	upstream.Enqueue(openaitest.Response{
+		Content:          "Checking the weather.",
+		Model:            "gpt-4o-mini-2024-07-18",
+		ToolCalls:        []openaitest.ToolCall{{Name: "get_weather", Arguments: `{"city":"Paris"}`}, {Name: "get_time", Arguments: `{"tz":"CET"}`}},
+		PromptTokens:     20,
+		CompletionTokens: 15,
+	})
+
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	for range stream.Chunks() {
+	}
+
+	final := stream.FinalCompletion()
+	assert.Equal(t, "gpt-4o-mini-2024-07-18", final.Model)
+	assert.Equal(t, int64(35), final.Usage.TotalTokens)
+	require.Len(t, final.Choices, 1)
+	choice := final.Choices[0]
+	assert.Equal(t, "tool_calls", choice.FinishReason)
+	assert.Equal(t, "Checking the weather.", choice.Message.Content)
+	require.Len(t, choice.Message.ToolCalls, 2)
+	assert.Equal(t, "call_0", choice.Message.ToolCalls[0].ID)
+	assert.Equal(t, "function", choice.Message.ToolCalls[0].Type)
+	assert.Equal(t, "get_weather", choice.Message.ToolCalls[0].Function.Name)
+	assert.Equal(t, `{"city":"Paris"}`, choice.Message.ToolCalls[0].Function.Arguments)
+	assert.Equal(t, "get_time", choice.Message.ToolCalls[1].Function.Name)
+	assert.Equal(t, `{"tz":"CET"}`, choice.Message.ToolCalls[1].Function.Arguments)
+
+	client.Flush()
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{Model: "gpt-4o-mini-2024-07-18", StopReason: revenium.StopReasonEnd})
+	assert.Equal(t, int64(15), ev.OutputTokenCount)
+}
+
+func TestStreamingWrapperFinalCompletionRefusal(t *testing.T) {
+	client, upstream, meter := newTestClient(t, revenium.WithStreamUsageInjectionDisabled(true))
+	upstream.Enqueue(openaitest.Response{Refusal: "I can't help with that."})
+
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	for range stream.Chunks() {
+	}
+
+	final := stream.FinalCompletion()
+	require.Len(t, final.Choices, 1)
+	assert.Equal(t, "I can't help with that.", final.Choices[0].Message.Refusal)
+	assert.Empty(t, final.Choices[0].Message.Content)
+
+	// Without usage the refusal is what the output tokens are estimated from
+	client.Flush()
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{IsStreamed: reveniumtest.Streamed(true)})
+	assert.True(t, ev.TokensEstimated)
+	assert.Positive(t, ev.OutputTokenCount)
+}
+
+func TestCompletionsNewMetersEveryChoice(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	scripted := openaitest.Response{
+		Choices: []openaitest.Choice{
+			{Content: "A short poem."},
+			{Content: "A poem that ran out of", FinishReason: "length"},
+			{Content: "Another short poem."},
+		},
+		PromptTokens:     10,
+		CompletionTokens: 30,
+	}
+	upstream.Enqueue(scripted, scripted)
+
+	params := userMessage("gpt-4o-mini")
+	params.N = openai.Int(3)
+	_, err := client.Chat().Completions().New(context.Background(), params)
+	require.NoError(t, err)
+
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), params)
+	require.NoError(t, err)
+	for range stream.Chunks() {
+	}
+	final := stream.FinalCompletion()
+	require.Len(t, final.Choices, 3)
+	assert.Equal(t, "A poem that ran out of", final.Choices[1].Message.Content)
+
+	client.Flush()
+	for _, streamed := range []bool{false, true} {
+		ev := meter.ExpectOneEvent(t, reveniumtest.Match{IsStreamed: reveniumtest.Streamed(streamed)})
+		assert.Equal(t, revenium.StopReasonTokenLimit, ev.StopReason, "a truncated choice is not hidden by the others")
+		assert.Equal(t, int64(3), ev.ChoiceCount)
+		assert.Equal(t, []revenium.ReveniumStopReason{revenium.StopReasonEnd, revenium.StopReasonTokenLimit, revenium.StopReasonEnd}, ev.ChoiceStopReasons)
+	}
+}
+
+func TestCompletionsNewMetersToolCalls(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	scripted := openaitest.Response{
+		ToolCalls:        []openaitest.ToolCall{{Name: "get_weather", Arguments: `{"city":"Paris"}`}, {Name: "get_weather", Arguments: `{"city":"Rome"}`}},
+		PromptTokens:     40,
+		CompletionTokens: 20,
+	}
+	upstream.Enqueue(scripted, scripted)
+
+	params := userMessage("gpt-4o-mini")
+	params.Tools = []openai.ChatCompletionToolUnionParam{
+		openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{Name: "get_weather"}),
+	}
+	params.ToolChoice = openai.ChatCompletionToolChoiceOptionUnionParam{OfAuto: openai.String("required")}
+	params.ParallelToolCalls = openai.Bool(true)
+
+	_, err := client.Chat().Completions().New(context.Background(), params)
+	require.NoError(t, err)
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), params)
+	require.NoError(t, err)
+	for range stream.Chunks() {
+	}
+
+	client.Flush()
+	for _, streamed := range []bool{false, true} {
+		ev := meter.ExpectOneEvent(t, reveniumtest.Match{IsStreamed: reveniumtest.Streamed(streamed)})
+		assert.Equal(t, revenium.StopReasonEnd, ev.StopReason)
+		assert.Equal(t, revenium.OperationSubtypeFunctionCall, ev.OperationSubtype)
+		assert.Equal(t, int64(2), ev.ToolCallCount)
+		assert.Equal(t, []string{"get_weather"}, ev.ToolNames)
+		assert.Equal(t, "required", ev.ToolChoice)
+		require.NotNil(t, ev.ParallelToolCalls)
+		assert.True(t, *ev.ParallelToolCalls)
+	}
+}
+
+func TestCompletionsNewCapturesRequestParams(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	scripted := openaitest.Response{Content: "Hello", ServiceTier: "default", PromptTokens: 5, CompletionTokens: 1}
+	upstream.Enqueue(scripted, scripted)
+
+	params := userMessage("gpt-4o-mini")
+	params.Temperature = openai.Float(0.7)
+	params.TopP = openai.Float(0.5)
+	params.MaxCompletionTokens = openai.Int(64)
+	params.Seed = openai.Int(7)
+	params.ServiceTier = openai.ChatCompletionNewParamsServiceTierAuto
+	params.ResponseFormat = openai.ChatCompletionNewParamsResponseFormatUnion{OfText: &openai.ResponseFormatTextParam{}}
+
+	_, err := client.Chat().Completions().New(context.Background(), params)
+	require.NoError(t, err)
+
+	// Context metadata overrides the captured value
+	ctx := revenium.WithUsageMetadata(context.Background(), map[string]interface{}{"temperature": 0.1})
+	stream, err := client.Chat().Completions().NewStreaming(ctx, params)
+	require.NoError(t, err)
+	for range stream.Chunks() {
+	}
+
+	client.Flush()
+	for _, streamed := range []bool{false, true} {
+		ev := meter.ExpectOneEvent(t, reveniumtest.Match{IsStreamed: reveniumtest.Streamed(streamed)})
+		require.NotNil(t, ev.Temperature)
+		if streamed {
+			assert.Equal(t, 0.1, *ev.Temperature)
+		} else {
+			assert.Equal(t, 0.7, *ev.Temperature)
+		}
+		require.NotNil(t, ev.TopP)
+		assert.Equal(t, 0.5, *ev.TopP)
+		require.NotNil(t, ev.MaxCompletionTokens)
+		assert.Equal(t, int64(64), *ev.MaxCompletionTokens)
+		require.NotNil(t, ev.Seed)
+		assert.Equal(t, int64(7), *ev.Seed)
+		assert.Equal(t, "text", ev.ResponseFormat)
+		assert.Equal(t, "auto", ev.ServiceTierRequested)
+		assert.Equal(t, "default", ev.ServiceTier)
+	}
+}
+
+func TestCompletionsNewEstimatesCost(t *testing.T) {
+	client, upstream, meter := newTestClient(t, revenium.WithModelPricing("my-model", "", revenium.ModelPricing{Input: 1, Output: 4}))
+	scripted := openaitest.Response{Content: "Hello", PromptTokens: 1000, CompletionTokens: 500}
+	upstream.Enqueue(scripted, scripted, scripted)
+
+	resp, err := client.Chat().Completions().New(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	cost, ok := client.EstimateCost(resp)
+	require.True(t, ok)
+	assert.InDelta(t, 0.00045, cost, 1e-12)
+
+	stream, err := client.Chat().Completions().NewStreaming(context.Background(), userMessage("my-model-2025-01-31"))
+	require.NoError(t, err)
+	_, ok = stream.EstimatedCost()
+	assert.False(t, ok, "no cost before the stream is finalized")
+	for range stream.Chunks() {
+	}
+	cost, ok = stream.EstimatedCost()
+	require.True(t, ok)
+	assert.InDelta(t, 0.003, cost, 1e-12)
+
+	_, err = client.Chat().Completions().New(context.Background(), userMessage("unpriced-model"))
+	require.NoError(t, err)
+
+	client.Flush()
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{Model: "gpt-4o-mini"})
+	require.NotNil(t, ev.EstimatedCost)
+	assert.InDelta(t, 0.00045, *ev.EstimatedCost, 1e-12)
+	ev = meter.ExpectOneEvent(t, reveniumtest.Match{Model: "my-model-2025-01-31"})
+	require.NotNil(t, ev.EstimatedCost)
+	assert.InDelta(t, 0.003, *ev.EstimatedCost, 1e-12)
+	ev = meter.ExpectOneEvent(t, reveniumtest.Match{Model: "unpriced-model"})
+	assert.Nil(t, ev.EstimatedCost)
+}
+
+func TestCompletionsNewWithResult(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	scripted := openaitest.Response{Content: "Hello", PromptTokens: 1000, CompletionTokens: 500}
+	upstream.Enqueue(scripted, scripted, scripted)
+
+	resp, result, err := client.Chat().Completions().NewWithResult(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+	require.NoError(t, result.Wait(context.Background()))
+	cost, ok := result.EstimatedCost()
+	require.True(t, ok)
+	assert.InDelta(t, 0.00045, cost, 1e-12)
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{TransactionID: result.TransactionID()})
+	assert.False(t, ev.IsStreamed)
+
+	// A context receiver knows the transaction ID before the call
+	ctx, streamResult := revenium.WithMeteredResult(context.Background())
+	stream, err := client.Chat().Completions().NewStreaming(ctx, userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	assert.Same(t, streamResult, stream.Result())
+	for range stream.Chunks() {
+	}
+	require.NoError(t, streamResult.Wait(context.Background()))
+	ev = meter.ExpectOneEvent(t, reveniumtest.Match{TransactionID: streamResult.TransactionID()})
+	assert.True(t, ev.IsStreamed)
+
+	// Rejections by Revenium are reported
+	meter.SetStatusCode(http.StatusBadRequest)
+	_, result, err = client.Chat().Completions().NewWithResult(context.Background(), userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	assert.Error(t, result.Wait(context.Background()))
+}
+
+func TestCompletionsMetadataTransactionIDIsKept(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	scripted := openaitest.Response{Content: "Hello", PromptTokens: 5, CompletionTokens: 1}
+	upstream.Enqueue(scripted, scripted)
+
+	ctx := revenium.WithUsageMetadata(context.Background(), map[string]interface{}{"transactionId": "my-tx"})
+	_, result, err := client.Chat().Completions().NewWithResult(ctx, userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	require.NoError(t, result.Wait(context.Background()))
+	assert.Equal(t, "my-tx", result.TransactionID())
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{TransactionID: "my-tx"})
+	assert.False(t, ev.IsStreamed)
+
+	ctx = revenium.WithUsageMetadata(context.Background(), map[string]interface{}{"transactionId": "my-stream-tx"})
+	stream, err := client.Chat().Completions().NewStreaming(ctx, userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+	for range stream.Chunks() {
+	}
+	require.NoError(t, stream.Result().Wait(context.Background()))
+	assert.Equal(t, "my-stream-tx", stream.Result().TransactionID())
+	ev = meter.ExpectOneEvent(t, reveniumtest.Match{TransactionID: "my-stream-tx"})
+	assert.True(t, ev.IsStreamed)
+}
+
+func TestCompletionsNewMetersTypedSubscriber(t *testing.T) {
+	client, upstream, meter := newTestClient(t)
+	upstream.Enqueue(openaitest.Response{Content: "Hello", PromptTokens: 5, CompletionTokens: 1})
+
+	ctx := revenium.WithTypedUsageMetadata(context.Background(), &revenium.UsageMetadata{OrganizationID: "org-1", TaskType: "support"})
+	ctx = revenium.WithSubscriber(ctx, &revenium.Subscriber{ID: "sub-1", Email: "a@example.com", APIKey: "sk-end-user-secret"})
+	_, err := client.Chat().Completions().New(ctx, userMessage("gpt-4o-mini"))
+	require.NoError(t, err)
+
+	client.Flush()
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{OrganizationID: "org-1"})
+	assert.Equal(t, "support", ev.TaskType)
+	require.NotNil(t, ev.Subscriber)
+	assert.Equal(t, "sub-1", ev.Subscriber.ID)
+	assert.Equal(t, "a@example.com", ev.Subscriber.Email)
+	require.NotNil(t, ev.Subscriber.Credential)
+	assert.Equal(t, "apiKey", ev.Subscriber.Credential.Name)
+	assert.NotContains(t, ev.Subscriber.Credential.Value, "sk-end-user-secret")
+}
+
+func TestCompletionsNewLayersMetadata(t *testing.T) {
+	client, upstream, meter := newTestClient(t, revenium.WithDefaultMetadata(map[string]interface{}{
+		"environment": "production",
+		"region":      "us-east-1",
+		"productId":   "default-product",
+	}))
+	upstream.Enqueue(openaitest.Response{Content: "Hello", PromptTokens: 5, CompletionTokens: 1})
+
+	tenant := client.WithMetadata(map[string]interface{}{"organizationId": "tenant-1"})
+	ctx := revenium.WithUsageMetadata(context.Background(), map[string]interface{}{"traceId": "trace-1"})
+	_, err := tenant.Chat().Completions().New(ctx, userMessage("gpt-4o-mini"),
+		revenium.WithCallMetadata(map[string]interface{}{"productId": "checkout"}))
+	require.NoError(t, err)
+
+	client.Flush()
+	ev := meter.ExpectOneEvent(t, reveniumtest.Match{OrganizationID: "tenant-1"})
+	assert.Equal(t, "production", ev.Environment)
+	assert.Equal(t, "us-east-1", ev.Region)
+	assert.Equal(t, "checkout", ev.ProductID)
+	assert.Equal(t, "trace-1", ev.TraceID)
+}
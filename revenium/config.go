@@ -3,12 +3,19 @@ package revenium
 import (
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 const (
 	defaultReveniumBaseURL = "https://api.revenium.ai"
+
+	// Revenium metering API paths, appended to ReveniumBaseURL
+	meteringCompletionsPath = "/meter/v2/ai/completions"
+	meteringBatchPath       = "/meter/v2/ai/completions/batch"
 )
 
 // Config holds all configuration for the Revenium middleware
@@ -28,6 +35,54 @@ type Config struct {
 	AzureAPIVersion string
 	AzureDisabled   bool
 
+	// StreamUsageInjectionDisabled stops NewStreaming from setting
+	// stream_options.include_usage, which streamed token counts rely on
+	StreamUsageInjectionDisabled bool
+
+	// StreamIdleTimeout finalizes and meters a stream that has not been read for
+	// this long, in case the caller never closes it. Zero uses the default of
+	// five minutes and a negative value disables the timeout.
+	StreamIdleTimeout time.Duration
+
+	// Local token estimation, used only when the provider returns no usage
+	TokenEstimationDisabled bool                     // Send zero token counts instead of estimates
+	TokenEncodings          map[string]TokenEncoding // Model name prefix to encoding, overriding the built-in model families
+
+	// Local cost estimation: the built-in prices, overridden by the entries of
+	// PricingFile, overridden in turn by ModelPricing
+	PricingFile  string         // JSON or YAML pricing file
+	ModelPricing []PricingEntry // Prices set in code
+
+	// Metering delivery configuration
+	MeteringWorkers   int            // Number of background workers sending metering data
+	MeteringQueueSize int            // Capacity of the metering queue
+	OverflowPolicy    OverflowPolicy // Behavior when the metering queue is full
+
+	// Metering batching configuration. Batching is opt-in: the HTTPSink then
+	// posts batches to /meter/v2/ai/completions/batch, an endpoint that is not
+	// part of the documented metering API, instead of one request per event.
+	MeteringBatchEnabled bool          // Send queued events in batches
+	MeteringBatchSize    int           // Maximum number of events sent in one request
+	MeteringBatchLinger  time.Duration // Maximum time an event waits for its batch to fill
+
+	// Durable spool configuration (spooling is disabled when SpoolDir is empty)
+	SpoolDir      string           // Directory holding metering events until they are acknowledged
+	SpoolMaxBytes int64            // Maximum total size of the spool; events beyond it are not spooled
+	SpoolFsync    SpoolFsyncPolicy // When spooled events are flushed to stable storage
+
+	// DefaultMetadata is added to every metered call, e.g. environment, region
+	// and productId. It takes precedence over REVENIUM_DEFAULT_* environment
+	// variables; client, context and per-call metadata take precedence over it.
+	DefaultMetadata map[string]interface{}
+
+	// Sink receives metering payloads; defaults to an HTTPSink for the Revenium API.
+	// When a custom sink is set the Revenium API key is optional.
+	Sink MeteringSink
+
+	// OnAbandonedMetering, if set, receives the payloads still undelivered when a
+	// Shutdown deadline expires, e.g. to persist them for later replay
+	OnAbandonedMetering func(payloads []*MeteringPayload)
+
 	// Debug configuration
 	Debug bool
 }
@@ -91,6 +146,52 @@ func WithAzureAPIVersion(version string) Option {
 	}
 }
 
+// WithStreamUsageInjectionDisabled stops NewStreaming from requesting usage in streamed responses
+func WithStreamUsageInjectionDisabled(disabled bool) Option {
+	return func(c *Config) {
+		c.StreamUsageInjectionDisabled = disabled
+	}
+}
+
+// WithStreamIdleTimeout sets how long an unread stream stays open before it is finalized and metered
+func WithStreamIdleTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.StreamIdleTimeout = timeout
+	}
+}
+
+// WithTokenEstimationDisabled disables local token estimation when the provider returns no usage
+func WithTokenEstimationDisabled(disabled bool) Option {
+	return func(c *Config) {
+		c.TokenEstimationDisabled = disabled
+	}
+}
+
+// WithTokenEncoding sets the encoding used to estimate tokens for models starting with modelPrefix
+func WithTokenEncoding(modelPrefix string, encoding TokenEncoding) Option {
+	return func(c *Config) {
+		if c.TokenEncodings == nil {
+			c.TokenEncodings = make(map[string]TokenEncoding)
+		}
+		c.TokenEncodings[modelPrefix] = encoding
+	}
+}
+
+// WithPricingFile loads model prices from a JSON or YAML file on top of the built-in prices
+func WithPricingFile(path string) Option {
+	return func(c *Config) {
+		c.PricingFile = path
+	}
+}
+
+// WithModelPricing sets the prices of a model and its dated snapshots in a service tier
+// (empty for the default tier), overriding the built-in prices and the pricing file
+func WithModelPricing(model, serviceTier string, pricing ModelPricing) Option {
+	return func(c *Config) {
+		c.ModelPricing = append(c.ModelPricing, PricingEntry{Model: model, ServiceTier: serviceTier, ModelPricing: pricing})
+	}
+}
+
 // WithAzureDisabled disables Azure OpenAI support
 func WithAzureDisabled(disabled bool) Option {
 	return func(c *Config) {
@@ -98,6 +199,91 @@ func WithAzureDisabled(disabled bool) Option {
 	}
 }
 
+// WithMeteringWorkers sets the number of background metering workers
+func WithMeteringWorkers(workers int) Option {
+	return func(c *Config) {
+		c.MeteringWorkers = workers
+	}
+}
+
+// WithMeteringQueueSize sets the capacity of the metering queue
+func WithMeteringQueueSize(size int) Option {
+	return func(c *Config) {
+		c.MeteringQueueSize = size
+	}
+}
+
+// WithOverflowPolicy sets the behavior when the metering queue is full
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(c *Config) {
+		c.OverflowPolicy = policy
+	}
+}
+
+// WithMeteringBatchEnabled enables or disables sending metering events in batches
+func WithMeteringBatchEnabled(enabled bool) Option {
+	return func(c *Config) {
+		c.MeteringBatchEnabled = enabled
+	}
+}
+
+// WithMeteringBatchSize sets the maximum number of events sent in one metering
+// request once batching is enabled
+func WithMeteringBatchSize(size int) Option {
+	return func(c *Config) {
+		c.MeteringBatchSize = size
+	}
+}
+
+// WithMeteringBatchLinger sets the maximum time an event waits for its batch to fill
+func WithMeteringBatchLinger(linger time.Duration) Option {
+	return func(c *Config) {
+		c.MeteringBatchLinger = linger
+	}
+}
+
+// WithSpoolDir enables the durable metering spool in the given directory
+func WithSpoolDir(dir string) Option {
+	return func(c *Config) {
+		c.SpoolDir = dir
+	}
+}
+
+// WithSpoolMaxBytes sets the maximum total size of the metering spool
+func WithSpoolMaxBytes(maxBytes int64) Option {
+	return func(c *Config) {
+		c.SpoolMaxBytes = maxBytes
+	}
+}
+
+// WithSpoolFsync sets when spooled metering events are flushed to stable storage
+func WithSpoolFsync(policy SpoolFsyncPolicy) Option {
+	return func(c *Config) {
+		c.SpoolFsync = policy
+	}
+}
+
+// WithMeteringSink sets the destination for metering payloads
+func WithMeteringSink(sink MeteringSink) Option {
+	return func(c *Config) {
+		c.Sink = sink
+	}
+}
+
+// WithAbandonedMeteringHandler sets the hook receiving payloads abandoned by Shutdown
+func WithAbandonedMeteringHandler(handler func(payloads []*MeteringPayload)) Option {
+	return func(c *Config) {
+		c.OnAbandonedMetering = handler
+	}
+}
+
+// WithDefaultMetadata adds metadata fields sent with every metered call
+func WithDefaultMetadata(metadata map[string]interface{}) Option {
+	return func(c *Config) {
+		c.DefaultMetadata = MergeMetadata(c.DefaultMetadata, metadata)
+	}
+}
+
 // WithDebug enables or disables debug logging programmatically
 func WithDebug(debug bool) Option {
 	return func(c *Config) {
@@ -105,34 +291,136 @@ func WithDebug(debug bool) Option {
 	}
 }
 
-// loadFromEnv loads configuration from environment variables and .env files
+// loadFromEnv loads configuration from environment variables and .env files.
+// Fields already set, e.g. by options passed to Initialize, are kept.
 func (c *Config) loadFromEnv() error {
 	// First, try to load .env files automatically
 	c.loadEnvFiles()
 
 	// Then load from environment variables (which may have been set by .env files)
-	c.OpenAIAPIKey = os.Getenv("OPENAI_API_KEY")
-	c.OpenAIOrgID = os.Getenv("OPENAI_ORG_ID")
-	c.ReveniumAPIKey = os.Getenv("REVENIUM_METERING_API_KEY")
-	baseURL := getEnvOrDefault("REVENIUM_METERING_BASE_URL", defaultReveniumBaseURL)
-	c.ReveniumBaseURL = NormalizeReveniumBaseURL(baseURL)
+	setFromEnv(&c.OpenAIAPIKey, "OPENAI_API_KEY")
+	setFromEnv(&c.OpenAIOrgID, "OPENAI_ORG_ID")
+	setFromEnv(&c.ReveniumAPIKey, "REVENIUM_METERING_API_KEY")
+	if c.ReveniumBaseURL == "" {
+		c.ReveniumBaseURL = getEnvOrDefault("REVENIUM_METERING_BASE_URL", defaultReveniumBaseURL)
+	}
+	c.ReveniumBaseURL = NormalizeReveniumBaseURL(c.ReveniumBaseURL)
 
-	c.AzureAPIKey = os.Getenv("AZURE_OPENAI_API_KEY")
-	c.AzureEndpoint = os.Getenv("AZURE_OPENAI_ENDPOINT")
-	c.AzureAPIVersion = os.Getenv("AZURE_OPENAI_API_VERSION")
+	setFromEnv(&c.AzureAPIKey, "AZURE_OPENAI_API_KEY")
+	setFromEnv(&c.AzureEndpoint, "AZURE_OPENAI_ENDPOINT")
+	setFromEnv(&c.AzureAPIVersion, "AZURE_OPENAI_API_VERSION")
 
-	c.Debug = os.Getenv("REVENIUM_DEBUG") == "true"
+	if os.Getenv("REVENIUM_DEBUG") == "true" {
+		c.Debug = true
+	}
 
 	if os.Getenv("REVENIUM_AZURE_DISABLE") == "1" || os.Getenv("REVENIUM_AZURE_DISABLE") == "true" {
 		c.AzureDisabled = true
 	}
 
+	if v := os.Getenv("REVENIUM_DISABLE_STREAM_USAGE_INJECTION"); v == "1" || v == "true" {
+		c.StreamUsageInjectionDisabled = true
+	}
+
+	if timeoutMs, err := strconv.Atoi(os.Getenv("REVENIUM_STREAM_IDLE_TIMEOUT_MS")); err == nil && c.StreamIdleTimeout == 0 {
+		c.StreamIdleTimeout = time.Duration(timeoutMs) * time.Millisecond
+	}
+
+	if v := os.Getenv("REVENIUM_DISABLE_TOKEN_ESTIMATION"); v == "1" || v == "true" {
+		c.TokenEstimationDisabled = true
+	}
+
+	setFromEnv(&c.PricingFile, "REVENIUM_PRICING_FILE")
+
+	if workers, err := strconv.Atoi(os.Getenv("REVENIUM_METERING_WORKERS")); err == nil && c.MeteringWorkers == 0 {
+		c.MeteringWorkers = workers
+	}
+	if size, err := strconv.Atoi(os.Getenv("REVENIUM_METERING_QUEUE_SIZE")); err == nil && c.MeteringQueueSize == 0 {
+		c.MeteringQueueSize = size
+	}
+	if policy := os.Getenv("REVENIUM_METERING_OVERFLOW_POLICY"); policy != "" && c.OverflowPolicy == "" {
+		c.OverflowPolicy = OverflowPolicy(policy)
+	}
+	if v := os.Getenv("REVENIUM_METERING_BATCH_ENABLED"); v == "1" || v == "true" {
+		c.MeteringBatchEnabled = true
+	}
+	if size, err := strconv.Atoi(os.Getenv("REVENIUM_METERING_BATCH_SIZE")); err == nil && c.MeteringBatchSize == 0 {
+		c.MeteringBatchSize = size
+	}
+	if lingerMs, err := strconv.Atoi(os.Getenv("REVENIUM_METERING_BATCH_LINGER_MS")); err == nil && c.MeteringBatchLinger == 0 {
+		c.MeteringBatchLinger = time.Duration(lingerMs) * time.Millisecond
+	}
+	setFromEnv(&c.SpoolDir, "REVENIUM_SPOOL_DIR")
+	if maxBytes, err := strconv.ParseInt(os.Getenv("REVENIUM_SPOOL_MAX_BYTES"), 10, 64); err == nil && c.SpoolMaxBytes == 0 {
+		c.SpoolMaxBytes = maxBytes
+	}
+	if fsync := os.Getenv("REVENIUM_SPOOL_FSYNC"); fsync != "" && c.SpoolFsync == "" {
+		c.SpoolFsync = SpoolFsyncPolicy(fsync)
+	}
 	SetGlobalDebug(c.Debug)
 	Debug("Loading configuration from environment variables")
 
 	return nil
 }
 
+// setFromEnv sets dst from the environment variable name, unless dst is already set
+func setFromEnv(dst *string, name string) {
+	if *dst == "" {
+		*dst = os.Getenv(name)
+	}
+}
+
+// applyDefaultMetadataEnv merges the REVENIUM_DEFAULT_* variables under
+// DefaultMetadata. They are the lowest metadata layer: fields set in the config,
+// e.g. with WithDefaultMetadata, take precedence over them.
+func (c *Config) applyDefaultMetadataEnv() {
+	if defaults := defaultMetadataFromEnv(os.Environ()); len(defaults) > 0 {
+		c.DefaultMetadata = MergeMetadata(defaults, c.DefaultMetadata)
+	}
+}
+
+// defaultMetadataPrefix introduces default metadata fields in the environment,
+// e.g. REVENIUM_DEFAULT_PRODUCT_ID sets productId
+const defaultMetadataPrefix = "REVENIUM_DEFAULT_"
+
+// defaultMetadataFromEnv collects the REVENIUM_DEFAULT_* variables as metadata.
+// Names are converted to camel case; SUBSCRIBER_ID and SUBSCRIBER_EMAIL set the
+// fields of the subscriber object.
+func defaultMetadataFromEnv(environ []string) map[string]interface{} {
+	metadata := make(map[string]interface{})
+	subscriber := make(map[string]interface{})
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || value == "" || !strings.HasPrefix(name, defaultMetadataPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(name, defaultMetadataPrefix)
+		switch key {
+		case "SUBSCRIBER_ID":
+			subscriber["id"] = value
+		case "SUBSCRIBER_EMAIL":
+			subscriber["email"] = value
+		default:
+			metadata[envNameToMetadataKey(key)] = value
+		}
+	}
+	if len(subscriber) > 0 {
+		metadata["subscriber"] = subscriber
+	}
+	return metadata
+}
+
+// envNameToMetadataKey converts PRODUCT_ID to productId
+func envNameToMetadataKey(name string) string {
+	parts := strings.Split(strings.ToLower(name), "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
 // loadEnvFiles loads environment variables from .env files
 func (c *Config) loadEnvFiles() {
 	// Try to load .env files in order of preference
@@ -179,6 +467,11 @@ func (c *Config) loadEnvFiles() {
 
 // Validate validates the configuration
 func (c *Config) Validate() error {
+	if c.Sink != nil && c.ReveniumAPIKey == "" {
+		Debug("Configuration validation passed (custom metering sink, no Revenium API key)")
+		return nil
+	}
+
 	if c.ReveniumAPIKey == "" {
 		return NewConfigError("REVENIUM_METERING_API_KEY is required", nil)
 	}
@@ -210,7 +503,7 @@ func getEnvOrDefault(key, defaultValue string) string {
 
 // NormalizeReveniumBaseURL normalizes the base URL to a consistent format
 // It handles various input formats and returns a normalized base URL without trailing slash
-// The endpoint path (/meter/v2/ai/completions) is appended by sendMeteringRequest
+// The endpoint path (meteringCompletionsPath, /meter/v2/ai/completions) is appended by HTTPSink
 func NormalizeReveniumBaseURL(baseURL string) string {
 	if baseURL == "" {
 		return defaultReveniumBaseURL
@@ -1,8 +1,10 @@
 package revenium
 
 import (
+	"context"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -29,6 +31,21 @@ func TestConfigLoadFromEnv(t *testing.T) {
 	assert.Equal(t, "sk-test-openai-key", cfg.OpenAIAPIKey)
 }
 
+func TestConfigLoadFromEnvKeepsOptions(t *testing.T) {
+	t.Setenv("REVENIUM_METERING_BASE_URL", "https://env.example.com")
+	t.Setenv("REVENIUM_METERING_API_KEY", "hak_env")
+	t.Setenv("REVENIUM_METERING_WORKERS", "8")
+
+	cfg := &Config{}
+	WithReveniumBaseURL("http://127.0.0.1:8080")(cfg)
+	WithMeteringWorkers(2)(cfg)
+	require.NoError(t, cfg.loadFromEnv())
+
+	assert.Equal(t, "http://127.0.0.1:8080", cfg.ReveniumBaseURL)
+	assert.Equal(t, 2, cfg.MeteringWorkers)
+	assert.Equal(t, "hak_env", cfg.ReveniumAPIKey, "unset fields are loaded from the environment")
+}
+
 func TestConfigValidate(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -56,6 +73,13 @@ func TestConfigValidate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "custom sink without API key",
+			config: &Config{
+				Sink: NewMemorySink(),
+			},
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -179,7 +203,112 @@ func TestWithOptions(t *testing.T) {
 	WithAzureDisabled(true)(cfg)
 	assert.True(t, cfg.AzureDisabled)
 
+	// Test WithStreamUsageInjectionDisabled
+	WithStreamUsageInjectionDisabled(true)(cfg)
+	assert.True(t, cfg.StreamUsageInjectionDisabled)
+
+	// Test WithStreamIdleTimeout
+	WithStreamIdleTimeout(time.Minute)(cfg)
+	assert.Equal(t, time.Minute, cfg.StreamIdleTimeout)
+
+	// Test token estimation options
+	WithTokenEstimationDisabled(true)(cfg)
+	WithTokenEncoding("my-deployment", TokenEncodingO200k)(cfg)
+	assert.True(t, cfg.TokenEstimationDisabled)
+	assert.Equal(t, TokenEncodingO200k, cfg.TokenEncodings["my-deployment"])
+
+	// Test pricing options
+	WithPricingFile("pricing.yaml")(cfg)
+	WithModelPricing("my-deployment", "flex", ModelPricing{Input: 1, Output: 2})(cfg)
+	assert.Equal(t, "pricing.yaml", cfg.PricingFile)
+	assert.Equal(t, []PricingEntry{{Model: "my-deployment", ServiceTier: "flex", ModelPricing: ModelPricing{Input: 1, Output: 2}}}, cfg.ModelPricing)
+
+	// Test WithDefaultMetadata
+	WithDefaultMetadata(map[string]interface{}{"environment": "prod"})(cfg)
+	WithDefaultMetadata(map[string]interface{}{"region": "eu-west-1"})(cfg)
+	assert.Equal(t, map[string]interface{}{"environment": "prod", "region": "eu-west-1"}, cfg.DefaultMetadata)
+
 	// Test WithDebug
 	WithDebug(true)(cfg)
 	assert.True(t, cfg.Debug)
+
+	// Test metering queue options
+	WithMeteringWorkers(8)(cfg)
+	WithMeteringQueueSize(500)(cfg)
+	WithOverflowPolicy(OverflowDropOldest)(cfg)
+	assert.Equal(t, 8, cfg.MeteringWorkers)
+	assert.Equal(t, 500, cfg.MeteringQueueSize)
+	assert.Equal(t, OverflowDropOldest, cfg.OverflowPolicy)
+}
+
+func TestDefaultMetadataFromEnv(t *testing.T) {
+	metadata := defaultMetadataFromEnv([]string{
+		"REVENIUM_DEFAULT_ENVIRONMENT=production",
+		"REVENIUM_DEFAULT_PRODUCT_ID=prod-1",
+		"REVENIUM_DEFAULT_ORGANIZATION_ID=org-1",
+		"REVENIUM_DEFAULT_SUBSCRIBER_ID=sub-1",
+		"REVENIUM_DEFAULT_SUBSCRIBER_EMAIL=ops@example.com",
+		"REVENIUM_DEFAULT_REGION=",
+		"REVENIUM_DEBUG=true",
+		"PATH=/usr/bin",
+	})
+
+	assert.Equal(t, map[string]interface{}{
+		"environment":    "production",
+		"productId":      "prod-1",
+		"organizationId": "org-1",
+		"subscriber":     map[string]interface{}{"id": "sub-1", "email": "ops@example.com"},
+	}, metadata)
+}
+
+func TestNewReveniumOpenAIDefaultMetadataFromEnv(t *testing.T) {
+	t.Setenv("REVENIUM_DEFAULT_REGION", "us-east-1")
+	t.Setenv("REVENIUM_DEFAULT_TRACE_TYPE", "env")
+	t.Setenv("REVENIUM_DEFAULT_SUBSCRIBER_EMAIL", "env@example.com")
+
+	cfg := &Config{Sink: NewMemorySink(), DefaultMetadata: map[string]interface{}{
+		"environment": "staging",
+		"region":      "eu-west-1",
+		"subscriber":  map[string]interface{}{"id": "sub-1"},
+	}}
+	r, err := NewReveniumOpenAI(cfg)
+	require.NoError(t, err)
+	defer r.Close()
+
+	assert.Equal(t, "staging", cfg.DefaultMetadata["environment"])
+	assert.Equal(t, "eu-west-1", cfg.DefaultMetadata["region"], "the config overrides environment variables")
+	assert.Equal(t, "env", cfg.DefaultMetadata["traceType"])
+	assert.Equal(t, map[string]interface{}{"id": "sub-1", "email": "env@example.com"}, cfg.DefaultMetadata["subscriber"])
+}
+
+func TestDefaultMetadataPrecedenceWithEnv(t *testing.T) {
+	for _, name := range []string{"ENVIRONMENT", "REGION", "PRODUCT_ID", "AGENT", "TRACE_TYPE"} {
+		t.Setenv("REVENIUM_DEFAULT_"+name, "env")
+	}
+
+	// Options are applied before the environment is loaded, as in Initialize
+	cfg := &Config{Sink: NewMemorySink()}
+	WithDefaultMetadata(map[string]interface{}{
+		"environment": "config",
+		"region":      "config",
+		"productId":   "config",
+		"agent":       "config",
+	})(cfg)
+	require.NoError(t, cfg.loadFromEnv())
+
+	r, err := NewReveniumOpenAI(cfg)
+	require.NoError(t, err)
+	defer r.Close()
+
+	client := r.WithMetadata(map[string]interface{}{"region": "client", "productId": "client", "agent": "client"})
+	ctx := WithUsageMetadata(context.Background(), map[string]interface{}{"productId": "context", "agent": "context"})
+	metadata := client.callMetadata(ctx, []CallOption{WithCallMetadata(map[string]interface{}{"agent": "call"})})
+
+	assert.Equal(t, map[string]interface{}{
+		"traceType":   "env",
+		"environment": "config",
+		"region":      "client",
+		"productId":   "context",
+		"agent":       "call",
+	}, metadata)
 }
@@ -2,17 +2,22 @@ package revenium
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 )
 
 // contextKey is a type for context keys to avoid collisions
 type contextKey string
 
 const (
-	usageMetadataKey contextKey = "revenium_usage_metadata"
-	subscriberKey    contextKey = "revenium_subscriber"
+	usageMetadataKey      contextKey = "revenium_usage_metadata"
+	typedUsageMetadataKey contextKey = "revenium_typed_usage_metadata"
+	subscriberKey         contextKey = "revenium_subscriber"
 )
 
-// UsageMetadata represents metadata about API usage
+// UsageMetadata represents metadata about API usage. OrganizationID and
+// TaskType are sent as organizationId and taskType, UserID as the subscriber
+// id, SessionID as traceId, and Custom may hold any other metadata field.
 type UsageMetadata struct {
 	OrganizationID string                 `json:"organization_id,omitempty"`
 	UserID         string                 `json:"user_id,omitempty"`
@@ -21,7 +26,9 @@ type UsageMetadata struct {
 	Custom         map[string]interface{} `json:"custom,omitempty"`
 }
 
-// Subscriber represents a subscriber with credentials
+// Subscriber represents a subscriber with credentials. ID and Email are sent in
+// the subscriber object; APIKey is only sent as a SHA-256 fingerprint in the
+// subscriber credential, never in clear text. Metadata is not sent.
 type Subscriber struct {
 	ID       string                 `json:"id,omitempty"`
 	APIKey   string                 `json:"api_key,omitempty"`
@@ -42,6 +49,19 @@ func GetUsageMetadata(ctx context.Context) map[string]interface{} {
 	return make(map[string]interface{})
 }
 
+// WithTypedUsageMetadata returns a new context with typed usage metadata
+func WithTypedUsageMetadata(ctx context.Context, metadata *UsageMetadata) context.Context {
+	return context.WithValue(ctx, typedUsageMetadataKey, metadata)
+}
+
+// GetTypedUsageMetadata retrieves typed usage metadata from context
+func GetTypedUsageMetadata(ctx context.Context) *UsageMetadata {
+	if metadata, ok := ctx.Value(typedUsageMetadataKey).(*UsageMetadata); ok {
+		return metadata
+	}
+	return nil
+}
+
 // WithSubscriber returns a new context with subscriber information
 func WithSubscriber(ctx context.Context, subscriber *Subscriber) context.Context {
 	return context.WithValue(ctx, subscriberKey, subscriber)
@@ -55,7 +75,8 @@ func GetSubscriber(ctx context.Context) *Subscriber {
 	return nil
 }
 
-// MergeMetadata merges two metadata maps, with the second taking precedence
+// MergeMetadata merges two metadata maps, with the second taking precedence.
+// The subscriber objects of both maps are merged field by field.
 func MergeMetadata(base, override map[string]interface{}) map[string]interface{} {
 	if base == nil {
 		base = make(map[string]interface{})
@@ -73,14 +94,153 @@ func MergeMetadata(base, override map[string]interface{}) map[string]interface{}
 
 	// Override with values from override
 	for k, v := range override {
+		if k == "subscriber" {
+			if existing, ok := merged[k]; ok {
+				merged[k] = mergeSubscriberValues(existing, v)
+				continue
+			}
+		}
 		merged[k] = v
 	}
 
 	return merged
 }
 
+// mergeSubscriberValues deep-merges two subscriber metadata values. Maps stay
+// maps; other representations are merged as MeteringSubscriber.
+func mergeSubscriberValues(base, override interface{}) interface{} {
+	baseMap, baseIsMap := base.(map[string]interface{})
+	overrideMap, overrideIsMap := override.(map[string]interface{})
+	if baseIsMap && overrideIsMap {
+		return deepMergeMaps(baseMap, overrideMap)
+	}
+	baseSubscriber, ok := toSubscriber(base)
+	if !ok {
+		return override
+	}
+	overrideSubscriber, ok := toSubscriber(override)
+	if !ok {
+		return override
+	}
+	return mergeSubscribers(baseSubscriber, overrideSubscriber)
+}
+
+// deepMergeMaps merges nested maps recursively, with override taking precedence
+func deepMergeMaps(base, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		baseMap, baseIsMap := merged[k].(map[string]interface{})
+		overrideMap, overrideIsMap := v.(map[string]interface{})
+		if baseIsMap && overrideIsMap {
+			merged[k] = deepMergeMaps(baseMap, overrideMap)
+			continue
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
 // ExtractMetadata extracts metadata from context and parameters
 func ExtractMetadata(ctx context.Context, paramMetadata map[string]interface{}) map[string]interface{} {
-	contextMetadata := GetUsageMetadata(ctx)
+	contextMetadata := requestMetadata(ctx)
 	return MergeMetadata(contextMetadata, paramMetadata)
 }
+
+// requestMetadata assembles the metadata of a call from its context. From
+// lowest to highest precedence: UsageMetadata.Custom, the UsageMetadata fields,
+// the Subscriber, then the map set with WithUsageMetadata. Subscriber objects
+// are merged field by field, so the map can set a subscriber email without
+// dropping the id of a typed Subscriber.
+func requestMetadata(ctx context.Context) map[string]interface{} {
+	metadata := make(map[string]interface{})
+	subscriber := &MeteringSubscriber{}
+
+	if usage := GetTypedUsageMetadata(ctx); usage != nil {
+		for k, v := range usage.Custom {
+			metadata[k] = v
+		}
+		if s, ok := toSubscriber(metadata["subscriber"]); ok {
+			subscriber = s
+		}
+		setMetadataString(metadata, "organizationId", usage.OrganizationID)
+		setMetadataString(metadata, "taskType", usage.TaskType)
+		setMetadataString(metadata, "traceId", usage.SessionID)
+		subscriber = mergeSubscribers(subscriber, &MeteringSubscriber{ID: usage.UserID})
+	}
+
+	if s := GetSubscriber(ctx); s != nil {
+		typed := &MeteringSubscriber{ID: s.ID, Email: s.Email}
+		if s.APIKey != "" {
+			typed.Credential = &MeteringCredential{Name: "apiKey", Value: credentialFingerprint(s.APIKey)}
+		}
+		subscriber = mergeSubscribers(subscriber, typed)
+	}
+
+	if *subscriber != (MeteringSubscriber{}) {
+		metadata["subscriber"] = subscriber
+	}
+
+	return MergeMetadata(metadata, GetUsageMetadata(ctx))
+}
+
+func setMetadataString(metadata map[string]interface{}, key, value string) {
+	if value != "" {
+		metadata[key] = value
+	}
+}
+
+// mergeSubscribers returns a copy of base with the non-empty fields of override
+func mergeSubscribers(base, override *MeteringSubscriber) *MeteringSubscriber {
+	merged := *base
+	if override.ID != "" {
+		merged.ID = override.ID
+	}
+	if override.Email != "" {
+		merged.Email = override.Email
+	}
+	if override.Credential != nil {
+		merged.Credential = override.Credential
+	}
+	return &merged
+}
+
+// credentialFingerprint identifies an API key without revealing it
+func credentialFingerprint(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// CallOption configures a single metered call
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	metadata map[string]interface{}
+}
+
+// WithCallMetadata adds metadata to a single call, taking precedence over the
+// config, client and context metadata
+func WithCallMetadata(metadata map[string]interface{}) CallOption {
+	return func(o *callOptions) {
+		o.metadata = MergeMetadata(o.metadata, metadata)
+	}
+}
+
+// callMetadata resolves the metadata of a call. From lowest to highest
+// precedence: Config.DefaultMetadata, the client's WithMetadata, the context
+// (see requestMetadata) and WithCallMetadata.
+func (r *ReveniumOpenAI) callMetadata(ctx context.Context, opts []CallOption) map[string]interface{} {
+	var call callOptions
+	for _, opt := range opts {
+		opt(&call)
+	}
+
+	var defaults map[string]interface{}
+	if r.config != nil {
+		defaults = r.config.DefaultMetadata
+	}
+	defaults = MergeMetadata(defaults, r.metadata)
+	return MergeMetadata(defaults, ExtractMetadata(ctx, call.metadata))
+}
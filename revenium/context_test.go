@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestWithUsageMetadata(t *testing.T) {
@@ -104,6 +105,34 @@ func TestMergeMetadata(t *testing.T) {
 			override: nil,
 			expected: map[string]interface{}{"key1": "value1"},
 		},
+		{
+			name: "deep-merge subscriber maps",
+			base: map[string]interface{}{
+				"subscriber": map[string]interface{}{
+					"id":         "sub-1",
+					"credential": map[string]interface{}{"name": "key-1", "value": "v-1"},
+				},
+			},
+			override: map[string]interface{}{
+				"subscriber": map[string]interface{}{
+					"email":      "a@example.com",
+					"credential": map[string]interface{}{"value": "v-2"},
+				},
+			},
+			expected: map[string]interface{}{
+				"subscriber": map[string]interface{}{
+					"id":         "sub-1",
+					"email":      "a@example.com",
+					"credential": map[string]interface{}{"name": "key-1", "value": "v-2"},
+				},
+			},
+		},
+		{
+			name:     "merge subscriber struct and map",
+			base:     map[string]interface{}{"subscriber": &MeteringSubscriber{ID: "sub-1", Email: "a@example.com"}},
+			override: map[string]interface{}{"subscriber": map[string]interface{}{"email": "b@example.com"}},
+			expected: map[string]interface{}{"subscriber": &MeteringSubscriber{ID: "sub-1", Email: "b@example.com"}},
+		},
 	}
 
 	for _, tt := range tests {
@@ -137,3 +166,113 @@ func TestExtractMetadata(t *testing.T) {
 
 	assert.Equal(t, expected, result)
 }
+
+func TestRequestMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		ctx      func(ctx context.Context) context.Context
+		expected map[string]interface{}
+	}{
+		{
+			name:     "empty context",
+			ctx:      func(ctx context.Context) context.Context { return ctx },
+			expected: map[string]interface{}{},
+		},
+		{
+			name: "typed usage metadata",
+			ctx: func(ctx context.Context) context.Context {
+				return WithTypedUsageMetadata(ctx, &UsageMetadata{
+					OrganizationID: "org-1",
+					UserID:         "user-1",
+					SessionID:      "session-1",
+					TaskType:       "chat",
+					Custom:         map[string]interface{}{"productId": "prod-1", "taskType": "overridden"},
+				})
+			},
+			expected: map[string]interface{}{
+				"organizationId": "org-1",
+				"taskType":       "chat",
+				"traceId":        "session-1",
+				"productId":      "prod-1",
+				"subscriber":     &MeteringSubscriber{ID: "user-1"},
+			},
+		},
+		{
+			name: "subscriber API key is fingerprinted",
+			ctx: func(ctx context.Context) context.Context {
+				ctx = WithTypedUsageMetadata(ctx, &UsageMetadata{UserID: "user-1"})
+				return WithSubscriber(ctx, &Subscriber{ID: "sub-1", Email: "a@example.com", APIKey: "sk-secret"})
+			},
+			expected: map[string]interface{}{
+				"subscriber": &MeteringSubscriber{
+					ID:         "sub-1",
+					Email:      "a@example.com",
+					Credential: &MeteringCredential{Name: "apiKey", Value: credentialFingerprint("sk-secret")},
+				},
+			},
+		},
+		{
+			name: "map overrides typed values field by field",
+			ctx: func(ctx context.Context) context.Context {
+				ctx = WithTypedUsageMetadata(ctx, &UsageMetadata{OrganizationID: "org-typed"})
+				ctx = WithSubscriber(ctx, &Subscriber{ID: "sub-1", Email: "typed@example.com"})
+				return WithUsageMetadata(ctx, map[string]interface{}{
+					"organizationId": "org-map",
+					"subscriber":     map[string]interface{}{"email": "map@example.com"},
+				})
+			},
+			expected: map[string]interface{}{
+				"organizationId": "org-map",
+				"subscriber":     &MeteringSubscriber{ID: "sub-1", Email: "map@example.com"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, requestMetadata(tt.ctx(context.Background())))
+		})
+	}
+}
+
+func TestCredentialFingerprint(t *testing.T) {
+	fingerprint := credentialFingerprint("sk-secret")
+	assert.Regexp(t, `^sha256:[0-9a-f]{16}$`, fingerprint)
+	assert.NotContains(t, fingerprint, "sk-secret")
+	assert.Equal(t, fingerprint, credentialFingerprint("sk-secret"))
+	assert.NotEqual(t, fingerprint, credentialFingerprint("sk-other"))
+}
+
+func TestCallMetadataPrecedence(t *testing.T) {
+	r, err := NewReveniumOpenAI(&Config{
+		Sink: NewMemorySink(),
+		DefaultMetadata: map[string]interface{}{
+			"environment": "config",
+			"region":      "config",
+			"productId":   "config",
+			"agent":       "config",
+			"subscriber":  map[string]interface{}{"id": "sub-config"},
+		},
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	client := r.WithMetadata(map[string]interface{}{"region": "client", "productId": "client", "agent": "client"})
+	ctx := WithUsageMetadata(context.Background(), map[string]interface{}{
+		"productId":  "context",
+		"agent":      "context",
+		"subscriber": map[string]interface{}{"email": "ctx@example.com"},
+	})
+
+	metadata := client.callMetadata(ctx, []CallOption{WithCallMetadata(map[string]interface{}{"agent": "call"})})
+	assert.Equal(t, map[string]interface{}{
+		"environment": "config",
+		"region":      "client",
+		"productId":   "context",
+		"agent":       "call",
+		"subscriber":  map[string]interface{}{"id": "sub-config", "email": "ctx@example.com"},
+	}, metadata)
+
+	// The original client is unaffected by WithMetadata
+	assert.Equal(t, "config", r.callMetadata(context.Background(), nil)["region"])
+}
@@ -0,0 +1,119 @@
+package revenium
+
+import (
+	"github.com/openai/openai-go/v3"
+)
+
+// OperationSubtypeFunctionCall marks chat completions in which the model called tools
+const OperationSubtypeFunctionCall = "function_call"
+
+// OperationSubtypeFeedback marks the events sent by SubmitFeedback
+const OperationSubtypeFeedback = "feedback"
+
+// addToolCallDetails records the tool calls (and legacy function calls) made
+// in every choice of the completion
+func addToolCallDetails(payload *MeteringPayload, resp *openai.ChatCompletion) {
+	seen := make(map[string]bool)
+	for _, choice := range resp.Choices {
+		for _, call := range choice.Message.ToolCalls {
+			name := call.Function.Name
+			if call.Type == "custom" {
+				name = call.Custom.Name
+			}
+			payload.recordToolCall(name, seen)
+		}
+		if choice.Message.FunctionCall.Name != "" {
+			payload.recordToolCall(choice.Message.FunctionCall.Name, seen)
+		}
+	}
+	if payload.ToolCallCount > 0 {
+		payload.OperationSubtype = OperationSubtypeFunctionCall
+	}
+}
+
+// recordToolCall counts a tool call and adds its name to the distinct tool names
+func (p *MeteringPayload) recordToolCall(name string, seen map[string]bool) {
+	p.ToolCallCount++
+	if name != "" && !seen[name] {
+		seen[name] = true
+		p.ToolNames = append(p.ToolNames, name)
+	}
+}
+
+// addRequestDetails records the sampling and output parameters of the request
+// and how it let the model call tools. Fields already set from usage metadata
+// are kept, so metadata overrides the request.
+func addRequestDetails(payload *MeteringPayload, params *openai.ChatCompletionNewParams) {
+	if params == nil {
+		return
+	}
+	if payload.Temperature == nil && params.Temperature.Valid() {
+		temperature := params.Temperature.Value
+		payload.Temperature = &temperature
+	}
+	if payload.TopP == nil && params.TopP.Valid() {
+		topP := params.TopP.Value
+		payload.TopP = &topP
+	}
+	if payload.MaxCompletionTokens == nil {
+		// max_tokens is the deprecated name of max_completion_tokens
+		if params.MaxCompletionTokens.Valid() {
+			maxTokens := params.MaxCompletionTokens.Value
+			payload.MaxCompletionTokens = &maxTokens
+		} else if params.MaxTokens.Valid() {
+			maxTokens := params.MaxTokens.Value
+			payload.MaxCompletionTokens = &maxTokens
+		}
+	}
+	if payload.ReasoningEffort == "" {
+		payload.ReasoningEffort = string(params.ReasoningEffort)
+	}
+	if payload.Seed == nil && params.Seed.Valid() {
+		seed := params.Seed.Value
+		payload.Seed = &seed
+	}
+	if payload.ResponseFormat == "" {
+		payload.ResponseFormat = responseFormatType(params.ResponseFormat)
+	}
+	if payload.ServiceTierRequested == "" {
+		payload.ServiceTierRequested = string(params.ServiceTier)
+	}
+
+	if payload.ToolChoice == "" {
+		payload.ToolChoice = toolChoiceMode(params.ToolChoice)
+	}
+	if payload.ParallelToolCalls == nil && params.ParallelToolCalls.Valid() {
+		parallel := params.ParallelToolCalls.Value
+		payload.ParallelToolCalls = &parallel
+	}
+}
+
+// toolChoiceMode describes the tool_choice of a request: "none", "auto" or
+// "required", "allowed_tools", or "function"/"custom" when a specific tool is forced
+func toolChoiceMode(choice openai.ChatCompletionToolChoiceOptionUnionParam) string {
+	switch {
+	case choice.OfAuto.Valid():
+		return choice.OfAuto.Value
+	case choice.OfAllowedTools != nil:
+		return "allowed_tools"
+	case choice.OfFunctionToolChoice != nil:
+		return "function"
+	case choice.OfCustomToolChoice != nil:
+		return "custom"
+	}
+	return ""
+}
+
+// responseFormatType returns the type of the requested response_format:
+// "text", "json_object" or "json_schema"
+func responseFormatType(format openai.ChatCompletionNewParamsResponseFormatUnion) string {
+	switch {
+	case format.OfText != nil:
+		return "text"
+	case format.OfJSONObject != nil:
+		return "json_object"
+	case format.OfJSONSchema != nil:
+		return "json_schema"
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package revenium
+
+import (
+	"testing"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddToolCallDetails(t *testing.T) {
+	resp := &openai.ChatCompletion{
+		Choices: []openai.ChatCompletionChoice{
+			{Message: openai.ChatCompletionMessage{ToolCalls: []openai.ChatCompletionMessageToolCallUnion{
+				{Type: "function", Function: openai.ChatCompletionMessageFunctionToolCallFunction{Name: "get_weather"}},
+				{Type: "function", Function: openai.ChatCompletionMessageFunctionToolCallFunction{Name: "get_time"}},
+			}}},
+			{Message: openai.ChatCompletionMessage{ToolCalls: []openai.ChatCompletionMessageToolCallUnion{
+				{Type: "function", Function: openai.ChatCompletionMessageFunctionToolCallFunction{Name: "get_weather"}},
+				{Type: "custom", Custom: openai.ChatCompletionMessageCustomToolCallCustom{Name: "run_sql"}},
+			}}},
+			{Message: openai.ChatCompletionMessage{FunctionCall: openai.ChatCompletionMessageFunctionCall{Name: "legacy_lookup"}}},
+		},
+	}
+
+	payload := testPayload("tx-1")
+	addToolCallDetails(payload, resp)
+	assert.Equal(t, OperationSubtypeFunctionCall, payload.OperationSubtype)
+	assert.Equal(t, int64(5), payload.ToolCallCount)
+	assert.Equal(t, []string{"get_weather", "get_time", "run_sql", "legacy_lookup"}, payload.ToolNames)
+
+	plain := testPayload("tx-2")
+	addToolCallDetails(plain, &openai.ChatCompletion{Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: "Hi"}}}})
+	assert.Empty(t, plain.OperationSubtype)
+	assert.Zero(t, plain.ToolCallCount)
+	assert.Nil(t, plain.ToolNames)
+}
+
+func TestAddRequestDetailsToolChoice(t *testing.T) {
+	tests := []struct {
+		name     string
+		choice   openai.ChatCompletionToolChoiceOptionUnionParam
+		expected string
+	}{
+		{name: "unset", expected: ""},
+		{name: "auto", choice: openai.ChatCompletionToolChoiceOptionUnionParam{OfAuto: openai.String("auto")}, expected: "auto"},
+		{name: "required", choice: openai.ChatCompletionToolChoiceOptionUnionParam{OfAuto: openai.String("required")}, expected: "required"},
+		{name: "forced function", choice: openai.ToolChoiceOptionFunctionToolChoice(openai.ChatCompletionNamedToolChoiceFunctionParam{Name: "get_weather"}), expected: "function"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := testPayload("tx-1")
+			addRequestDetails(payload, &openai.ChatCompletionNewParams{ToolChoice: tt.choice})
+			assert.Equal(t, tt.expected, payload.ToolChoice)
+			assert.Nil(t, payload.ParallelToolCalls)
+		})
+	}
+
+	payload := testPayload("tx-2")
+	addRequestDetails(payload, &openai.ChatCompletionNewParams{ParallelToolCalls: openai.Bool(false)})
+	require.NotNil(t, payload.ParallelToolCalls)
+	assert.False(t, *payload.ParallelToolCalls)
+
+	addRequestDetails(payload, nil) // no request, e.g. transport metering
+}
+
+func TestAddRequestDetailsParams(t *testing.T) {
+	params := &openai.ChatCompletionNewParams{
+		Temperature:         openai.Float(0.2),
+		TopP:                openai.Float(0.9),
+		MaxCompletionTokens: openai.Int(256),
+		ReasoningEffort:     openai.ReasoningEffortLow,
+		Seed:                openai.Int(42),
+		ServiceTier:         openai.ChatCompletionNewParamsServiceTierFlex,
+		ResponseFormat: openai.ChatCompletionNewParamsResponseFormatUnion{
+			OfJSONObject: &openai.ResponseFormatJSONObjectParam{},
+		},
+	}
+
+	payload := testPayload("tx-1")
+	addRequestDetails(payload, params)
+	require.NotNil(t, payload.Temperature)
+	assert.Equal(t, 0.2, *payload.Temperature)
+	require.NotNil(t, payload.TopP)
+	assert.Equal(t, 0.9, *payload.TopP)
+	require.NotNil(t, payload.MaxCompletionTokens)
+	assert.Equal(t, int64(256), *payload.MaxCompletionTokens)
+	assert.Equal(t, "low", payload.ReasoningEffort)
+	require.NotNil(t, payload.Seed)
+	assert.Equal(t, int64(42), *payload.Seed)
+	assert.Equal(t, "flex", payload.ServiceTierRequested)
+	assert.Equal(t, "json_object", payload.ResponseFormat)
+
+	// Metadata set on the payload beforehand wins over the request
+	overridden := testPayload("tx-2")
+	addMetadataToPayload(overridden, map[string]interface{}{"temperature": 1.0, "responseFormat": "custom"})
+	addRequestDetails(overridden, params)
+	assert.Equal(t, 1.0, *overridden.Temperature)
+	assert.Equal(t, "custom", overridden.ResponseFormat)
+	assert.Equal(t, 0.9, *overridden.TopP)
+
+	// max_tokens is used when max_completion_tokens is not set
+	legacy := testPayload("tx-3")
+	addRequestDetails(legacy, &openai.ChatCompletionNewParams{MaxTokens: openai.Int(100)})
+	require.NotNil(t, legacy.MaxCompletionTokens)
+	assert.Equal(t, int64(100), *legacy.MaxCompletionTokens)
+	assert.Nil(t, legacy.Temperature)
+	assert.Empty(t, legacy.ResponseFormat)
+}
@@ -0,0 +1,127 @@
+package revenium
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/openai/openai-go/v3"
+)
+
+// EmbeddingsInterface provides methods for creating embeddings with metering
+type EmbeddingsInterface struct {
+	client   openai.Client
+	config   *Config
+	provider Provider
+	parent   *ReveniumOpenAI // Reference to parent for metering queue access
+}
+
+// New creates an embedding with automatic metering
+func (e *EmbeddingsInterface) New(ctx context.Context, params openai.EmbeddingNewParams, opts ...CallOption) (*openai.CreateEmbeddingResponse, error) {
+	// Resolve metadata from config, client, context and call options
+	metadata := e.parent.callMetadata(ctx, opts)
+
+	// Call the appropriate provider
+	switch e.provider {
+	case ProviderOpenAI:
+		return e.createEmbeddingOpenAI(ctx, params, metadata)
+	case ProviderAzure:
+		return e.createEmbeddingAzure(ctx, params, metadata)
+	default:
+		return nil, NewProviderError("unknown provider", fmt.Errorf("provider: %v", e.provider))
+	}
+}
+
+// createEmbeddingOpenAI creates an embedding using OpenAI native API
+func (e *EmbeddingsInterface) createEmbeddingOpenAI(ctx context.Context, params openai.EmbeddingNewParams, metadata map[string]interface{}) (*openai.CreateEmbeddingResponse, error) {
+	requestTime := time.Now()
+
+	resp, err := e.client.Embeddings.New(ctx, params)
+	if err != nil {
+		duration := time.Since(requestTime)
+		err = requestError(ctx, err)
+		e.sendMeteringDataForError(ctx, string(params.Model), metadata, duration, "OPENAI", requestTime, err)
+		return nil, err
+	}
+
+	duration := time.Since(requestTime)
+	e.sendMeteringData(ctx, resp, metadata, duration, "OPENAI", requestTime)
+
+	return resp, nil
+}
+
+func (e *EmbeddingsInterface) createEmbeddingAzure(ctx context.Context, params openai.EmbeddingNewParams, metadata map[string]interface{}) (*openai.CreateEmbeddingResponse, error) {
+	requestTime := time.Now()
+	originalModel := string(params.Model)
+	Debug("Using Azure deployment name '%s' from user", originalModel)
+
+	resp, err := e.client.Embeddings.New(ctx, params)
+	if err != nil {
+		duration := time.Since(requestTime)
+		err = requestError(ctx, err)
+		if ctx.Err() != nil {
+			// A cancelled or expired context would fail the fallback as well
+			e.sendMeteringDataForError(ctx, originalModel, metadata, duration, "AZURE", requestTime, err)
+			return nil, err
+		}
+		// The caller's MeteredResult reports the fallback call instead
+		e.sendMeteringDataForError(withoutMeteredResult(ctx), originalModel, metadata, duration, "AZURE", requestTime, err)
+		Warn("Azure embedding request failed: %v, falling back to OpenAI", err)
+		return e.createEmbeddingOpenAI(ctx, params, metadata)
+	}
+
+	duration := time.Since(requestTime)
+	e.sendMeteringData(ctx, resp, metadata, duration, "AZURE", requestTime)
+
+	return resp, nil
+}
+
+func (e *EmbeddingsInterface) sendMeteringData(ctx context.Context, resp *openai.CreateEmbeddingResponse, metadata map[string]interface{}, duration time.Duration, provider string, requestTime time.Time) {
+	payload := buildEmbeddingMeteringPayload(resp, metadata, duration, provider, requestTime)
+	Debug("[METERING] Queueing embedding metering data...")
+	e.parent.enqueueMetering(ctx, payload)
+}
+
+// sendMeteringDataForError queues the payload for a failed or interrupted
+// embedding request; the stop reason is derived from err with MapRequestError
+func (e *EmbeddingsInterface) sendMeteringDataForError(ctx context.Context, model string, metadata map[string]interface{}, duration time.Duration, provider string, requestTime time.Time, err error) {
+	payload := buildErrorMeteringPayload(model, metadata, false, duration, provider, requestTime, err.Error())
+	payload.OperationType = OperationTypeEmbed
+	payload.StopReason = MapRequestError(err)
+	Debug("[METERING] Queueing embedding error metering data...")
+	e.parent.enqueueMetering(ctx, payload)
+}
+
+// buildEmbeddingMeteringPayload builds the metering payload for an embedding response.
+// Embeddings only consume input tokens, so output and reasoning counts are always zero.
+func buildEmbeddingMeteringPayload(resp *openai.CreateEmbeddingResponse, metadata map[string]interface{}, duration time.Duration, provider string, requestTime time.Time) *MeteringPayload {
+	responseTimeISO := time.Now().UTC().Format(time.RFC3339)
+	requestTimeISO := requestTime.UTC().Format(time.RFC3339)
+
+	if provider == "" {
+		provider = "OPENAI"
+	}
+
+	totalTokens := resp.Usage.TotalTokens
+	if totalTokens == 0 {
+		totalTokens = resp.Usage.PromptTokens
+	}
+
+	payload := &MeteringPayload{
+		StopReason:          StopReasonEnd,
+		CostType:            CostTypeAI,
+		OperationType:       OperationTypeEmbed,
+		InputTokenCount:     resp.Usage.PromptTokens,
+		TotalTokenCount:     totalTokens,
+		Model:               resp.Model,
+		ResponseTime:        responseTimeISO,
+		RequestDuration:     duration.Milliseconds(),
+		Provider:            provider,
+		RequestTime:         requestTimeISO,
+		CompletionStartTime: requestTimeISO,
+		MiddlewareSource:    GetMiddlewareSource(),
+	}
+
+	addMetadataToPayload(payload, metadata)
+	return payload
+}
@@ -0,0 +1,99 @@
+package revenium
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newHangingAzureClient returns a client for an Azure endpoint that never
+// answers, metering into the returned sink
+func newHangingAzureClient(t *testing.T) (*ReveniumOpenAI, *MemorySink) {
+	t.Helper()
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() { close(release) })
+
+	sink := NewMemorySink()
+	client, err := NewReveniumOpenAI(&Config{
+		AzureAPIKey:     "azure-key",
+		AzureEndpoint:   upstream.URL,
+		AzureAPIVersion: "2024-10-21",
+		Sink:            sink,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return client, sink
+}
+
+func TestBuildEmbeddingMeteringPayload(t *testing.T) {
+	resp := &openai.CreateEmbeddingResponse{
+		Model: "text-embedding-3-small",
+		Usage: openai.CreateEmbeddingResponseUsage{
+			PromptTokens: 42,
+			TotalTokens:  42,
+		},
+	}
+	metadata := map[string]interface{}{
+		"organizationId": "org-123",
+		"notAllowed":     "ignored",
+	}
+
+	payload := buildEmbeddingMeteringPayload(resp, metadata, 150*time.Millisecond, "AZURE", time.Now())
+
+	assert.Equal(t, OperationTypeEmbed, payload.OperationType)
+	assert.Equal(t, StopReasonEnd, payload.StopReason)
+	assert.False(t, payload.IsStreamed)
+	assert.Equal(t, int64(42), payload.InputTokenCount)
+	assert.Equal(t, int64(0), payload.OutputTokenCount)
+	assert.Equal(t, int64(42), payload.TotalTokenCount)
+	assert.Equal(t, "text-embedding-3-small", payload.Model)
+	assert.Equal(t, "AZURE", payload.Provider)
+	assert.Equal(t, int64(150), payload.RequestDuration)
+	assert.Equal(t, "org-123", payload.OrganizationID)
+}
+
+func TestBuildEmbeddingMeteringPayloadDefaults(t *testing.T) {
+	resp := &openai.CreateEmbeddingResponse{
+		Model: "text-embedding-3-large",
+		Usage: openai.CreateEmbeddingResponseUsage{
+			PromptTokens: 7,
+		},
+	}
+
+	payload := buildEmbeddingMeteringPayload(resp, nil, 0, "", time.Now())
+
+	assert.Equal(t, "OPENAI", payload.Provider)
+	assert.Equal(t, int64(7), payload.TotalTokenCount)
+}
+
+func TestEmbeddingsAzureTimeoutSkipsFallback(t *testing.T) {
+	client, sink := newHangingAzureClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.Embeddings().New(ctx, openai.EmbeddingNewParams{
+		Model: "my-embedding-deployment",
+		Input: openai.EmbeddingNewParamsInputUnion{OfString: openai.String("Hello")},
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	client.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1, "no fallback request is made or metered")
+	assert.Equal(t, StopReasonTimeout, payloads[0].StopReason)
+	assert.Equal(t, OperationTypeEmbed, payloads[0].OperationType)
+	assert.Equal(t, "AZURE", payloads[0].Provider)
+}
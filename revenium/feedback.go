@@ -0,0 +1,134 @@
+package revenium
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"sync"
+	"time"
+)
+
+// SubmitFeedback reports a response quality score for a previously metered
+// transaction, e.g. once the user has rated the answer. It queues a linked
+// event with the score and no token counts, whose parentTransactionId is the
+// transaction ID of the original call; details are sent as feedbackDetails.
+// The event has costType AI, operationType OTHER, operationSubtype feedback,
+// the model of the original call and no estimated cost, and is delivered with
+// the same queue and retries as regular metering.
+//
+// The metering API has no event type that links to a transaction without
+// being counted as an AI call, so Revenium counts every feedback event as one
+// more call; filter on operationSubtype feedback to exclude them.
+//
+// The model is taken from the transactions this client metered recently. For
+// other transactions, e.g. after a restart, use SubmitModelFeedback;
+// SubmitFeedback returns a validation error and sends nothing.
+//
+// score must be between 0.0 and 1.0. Usage metadata in ctx is added to the
+// event, and a MeteredResult in ctx reports its delivery outcome.
+func (r *ReveniumOpenAI) SubmitFeedback(ctx context.Context, transactionID string, score float64, details map[string]interface{}) error {
+	return r.submitFeedback(ctx, transactionID, r.models.lookup(transactionID), score, details)
+}
+
+// SubmitModelFeedback is like SubmitFeedback for a transaction metered with
+// model, which need not have been metered by this client
+func (r *ReveniumOpenAI) SubmitModelFeedback(ctx context.Context, transactionID, model string, score float64, details map[string]interface{}) error {
+	return r.submitFeedback(ctx, transactionID, model, score, details)
+}
+
+// SubmitResultFeedback is like SubmitFeedback for the call reported by result,
+// once it is metered
+func (r *ReveniumOpenAI) SubmitResultFeedback(ctx context.Context, result *MeteredResult, score float64, details map[string]interface{}) error {
+	if result == nil {
+		return NewValidationError("feedback requires the result of a metered call", nil)
+	}
+	return r.submitFeedback(ctx, result.TransactionID(), result.Model(), score, details)
+}
+
+func (r *ReveniumOpenAI) submitFeedback(ctx context.Context, transactionID, model string, score float64, details map[string]interface{}) error {
+	if transactionID == "" {
+		return NewValidationError("feedback requires the transaction ID of a metered call", nil)
+	}
+	if model == "" {
+		return NewValidationError(fmt.Sprintf("feedback requires the model of transaction %s; use SubmitModelFeedback for calls this client has not metered", transactionID), nil)
+	}
+	if math.IsNaN(score) || score < 0 || score > 1 {
+		return NewValidationError(fmt.Sprintf("responseQualityScore %v is outside 0.0-1.0", score), nil)
+	}
+
+	payload := buildFeedbackPayload(transactionID, model, score, details, r.callMetadata(ctx, nil), r.provider)
+	Debug("[METERING] Queueing feedback for transaction %s...", transactionID)
+	r.enqueueMetering(ctx, payload)
+	return nil
+}
+
+// feedbackModelMemory is how many metered transactions a client remembers the
+// model of for SubmitFeedback
+const feedbackModelMemory = 10000
+
+// transactionModels remembers the model of the most recently metered
+// transactions, evicting the oldest first
+type transactionModels struct {
+	mu     sync.Mutex
+	models map[string]string
+	order  []string // ring of transaction IDs
+	next   int
+}
+
+func newTransactionModels() *transactionModels {
+	return &transactionModels{models: make(map[string]string)}
+}
+
+func (t *transactionModels) record(transactionID, model string) {
+	if transactionID == "" || model == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.models[transactionID]; !ok {
+		if len(t.order) < feedbackModelMemory {
+			t.order = append(t.order, transactionID)
+		} else {
+			delete(t.models, t.order[t.next])
+			t.order[t.next] = transactionID
+			t.next = (t.next + 1) % feedbackModelMemory
+		}
+	}
+	t.models[transactionID] = model
+}
+
+func (t *transactionModels) lookup(transactionID string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.models[transactionID]
+}
+
+// buildFeedbackPayload builds the linked event that carries feedback for a
+// transaction; metadata cannot override the fields that link it
+func buildFeedbackPayload(transactionID, model string, score float64, details, metadata map[string]interface{}, provider Provider) *MeteringPayload {
+	now := time.Now().UTC().Format(time.RFC3339)
+	if provider == "" {
+		provider = ProviderOpenAI
+	}
+
+	payload := &MeteringPayload{
+		StopReason:          StopReasonEnd,
+		CostType:            CostTypeAI,
+		OperationType:       OperationTypeOther,
+		Model:               model,
+		ResponseTime:        now,
+		Provider:            string(provider),
+		RequestTime:         now,
+		CompletionStartTime: now,
+		MiddlewareSource:    GetMiddlewareSource(),
+	}
+	addMetadataToPayload(payload, metadata)
+
+	payload.TransactionID = ""
+	payload.ParentTransactionID = transactionID
+	payload.OperationSubtype = OperationSubtypeFeedback
+	payload.ResponseQualityScore = &score
+	payload.FeedbackDetails = maps.Clone(details)
+	return payload
+}
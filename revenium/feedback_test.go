@@ -0,0 +1,161 @@
+package revenium
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubmitFeedback(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewReveniumOpenAI(&Config{Sink: sink})
+	require.NoError(t, err)
+	defer r.Close()
+
+	r.enqueueMetering(context.Background(), &MeteringPayload{
+		StopReason:    StopReasonEnd,
+		CostType:      CostTypeAI,
+		OperationType: OperationTypeChat,
+		Model:         "gpt-4o-mini",
+		TransactionID: "tx-original",
+	})
+	r.Flush()
+
+	ctx := WithUsageMetadata(context.Background(), map[string]interface{}{
+		"organizationId":       "org-1",
+		"responseQualityScore": 0.1,
+		"parentTransactionId":  "ignored",
+	})
+	ctx, result := WithMeteredResult(ctx)
+	details := map[string]interface{}{"comment": "helpful", "rating": 4}
+	require.NoError(t, r.SubmitFeedback(ctx, "tx-original", 0.8, details))
+	details["comment"] = "changed after submitting"
+
+	require.NoError(t, result.Wait(context.Background()))
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 2)
+	p := payloads[1]
+	require.NoError(t, p.Validate())
+	assert.Equal(t, result.TransactionID(), p.TransactionID)
+	assert.Equal(t, "tx-original", p.ParentTransactionID)
+	assert.Equal(t, CostTypeAI, p.CostType)
+	assert.Equal(t, OperationTypeOther, p.OperationType)
+	assert.Equal(t, OperationSubtypeFeedback, p.OperationSubtype)
+	require.NotNil(t, p.ResponseQualityScore)
+	assert.Equal(t, 0.8, *p.ResponseQualityScore)
+	assert.Equal(t, "helpful", p.FeedbackDetails["comment"])
+	assert.Equal(t, "org-1", p.OrganizationID)
+	assert.Equal(t, "gpt-4o-mini", p.Model, "the model of the metered transaction")
+	assert.Zero(t, p.TotalTokenCount)
+	assert.Nil(t, p.EstimatedCost)
+}
+
+func TestSubmitResultFeedback(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewReveniumOpenAI(&Config{Sink: sink})
+	require.NoError(t, err)
+	defer r.Close()
+
+	ctx, result := WithMeteredResult(context.Background())
+	r.enqueueMetering(ctx, &MeteringPayload{
+		StopReason:       StopReasonEnd,
+		CostType:         CostTypeAI,
+		OperationType:    OperationTypeChat,
+		Model:            "gpt-4o-2024-08-06",
+		InputTokenCount:  100,
+		OutputTokenCount: 50,
+		TotalTokenCount:  150,
+	})
+	require.NoError(t, result.Wait(context.Background()))
+	assert.Equal(t, "gpt-4o-2024-08-06", result.Model())
+
+	feedbackCtx, feedbackResult := WithMeteredResult(context.Background())
+	require.NoError(t, r.SubmitResultFeedback(feedbackCtx, result, 1, nil))
+	require.NoError(t, feedbackResult.Wait(context.Background()))
+
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 2)
+	completion, feedback := payloads[0], payloads[1]
+	require.NoError(t, feedback.Validate())
+	assert.Equal(t, completion.Model, feedback.Model)
+	assert.Equal(t, completion.TransactionID, feedback.ParentTransactionID)
+	assert.Equal(t, OperationSubtypeFeedback, feedback.OperationSubtype)
+	assert.NotEqual(t, completion.OperationType, feedback.OperationType)
+	assert.Zero(t, feedback.InputTokenCount)
+	assert.Zero(t, feedback.OutputTokenCount)
+	assert.Zero(t, feedback.TotalTokenCount)
+	require.NotNil(t, completion.EstimatedCost)
+	assert.Nil(t, feedback.EstimatedCost)
+	_, priced := feedbackResult.EstimatedCost()
+	assert.False(t, priced)
+}
+
+func TestSubmitFeedbackValidation(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewReveniumOpenAI(&Config{Sink: sink})
+	require.NoError(t, err)
+	defer r.Close()
+	client := r.WithMetadata(map[string]interface{}{"organizationId": "org-1"})
+
+	tests := []struct {
+		name          string
+		transactionID string
+		score         float64
+	}{
+		{name: "score below range", transactionID: "tx-1", score: -0.1},
+		{name: "score above range", transactionID: "tx-1", score: 1.5},
+		{name: "score not a number", transactionID: "tx-1", score: math.NaN()},
+		{name: "missing transaction ID", score: 0.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := client.SubmitModelFeedback(context.Background(), tt.transactionID, "gpt-4o-mini", tt.score, nil)
+			assert.True(t, IsValidationError(err))
+		})
+	}
+	assert.True(t, IsValidationError(r.SubmitResultFeedback(context.Background(), nil, 0.5, nil)))
+
+	r.Flush()
+	assert.Empty(t, sink.Payloads())
+	assert.Zero(t, r.MeteringStats().Enqueued)
+}
+
+func TestSubmitFeedbackRequiresModel(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewReveniumOpenAI(&Config{Sink: sink})
+	require.NoError(t, err)
+	defer r.Close()
+
+	assert.True(t, IsValidationError(r.SubmitFeedback(context.Background(), "tx-unknown", 0.5, nil)))
+	_, unmetered := WithMeteredResult(context.Background())
+	assert.True(t, IsValidationError(r.SubmitResultFeedback(context.Background(), unmetered, 0.5, nil)))
+	assert.True(t, IsValidationError(r.SubmitModelFeedback(context.Background(), "tx-unknown", "", 0.5, nil)))
+	r.Flush()
+	assert.Empty(t, sink.Payloads())
+
+	ctx, result := WithMeteredResult(context.Background())
+	require.NoError(t, r.SubmitModelFeedback(ctx, "tx-unknown", "gpt-4o", 0.5, nil))
+	require.NoError(t, result.Wait(context.Background()))
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, "gpt-4o", payloads[0].Model)
+	assert.Equal(t, "tx-unknown", payloads[0].ParentTransactionID)
+	require.NoError(t, payloads[0].Validate())
+}
+
+func TestTransactionModelsEvictsOldest(t *testing.T) {
+	models := newTransactionModels()
+	for i := 0; i <= feedbackModelMemory; i++ {
+		models.record(fmt.Sprintf("tx-%d", i), "gpt-4o")
+	}
+
+	assert.Empty(t, models.lookup("tx-0"))
+	assert.Equal(t, "gpt-4o", models.lookup("tx-1"))
+	assert.Equal(t, "gpt-4o", models.lookup(fmt.Sprintf("tx-%d", feedbackModelMemory)))
+	assert.Len(t, models.models, feedbackModelMemory)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -56,31 +57,37 @@ func (l *DefaultLogger) log(level, message string, args ...interface{}) {
 	log.Printf("%s %s", prefix, message)
 }
 
+// loggerMu guards globalLogger, which background workers and stream timers log through
+var loggerMu sync.RWMutex
 var globalLogger Logger = NewDefaultLogger()
 var globalDebugEnabled bool
 
 func GetLogger() Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
 	return globalLogger
 }
 
 func SetLogger(logger Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
 	globalLogger = logger
 }
 
 func Debug(message string, args ...interface{}) {
-	globalLogger.Debug(message, args...)
+	GetLogger().Debug(message, args...)
 }
 
 func Info(message string, args ...interface{}) {
-	globalLogger.Info(message, args...)
+	GetLogger().Info(message, args...)
 }
 
 func Warn(message string, args ...interface{}) {
-	globalLogger.Warn(message, args...)
+	GetLogger().Warn(message, args...)
 }
 
 func Error(message string, args ...interface{}) {
-	globalLogger.Error(message, args...)
+	GetLogger().Error(message, args...)
 }
 
 func SetGlobalDebug(enabled bool) {
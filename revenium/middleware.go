@@ -1,12 +1,12 @@
 package revenium
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"iter"
 	"net/http"
+	"runtime"
 	"sync"
 	"time"
 
@@ -24,7 +24,13 @@ type ReveniumOpenAI struct {
 	config   *Config
 	provider Provider
 	mu       sync.RWMutex
-	wg       sync.WaitGroup
+	queue    *meteringQueue
+	spool    *meteringSpool // nil unless Config.SpoolDir is set
+	sink     MeteringSink
+	pricing  *PricingCatalog
+	metadata map[string]interface{} // set with WithMetadata
+	attempts *heldAttempts          // network-failed transport attempts awaiting a retry
+	models   *transactionModels     // models of recently metered transactions, for feedback
 }
 
 var (
@@ -62,11 +68,7 @@ func Initialize(opts ...Option) error {
 
 	openaiClient := openai.NewClient(clientOpts...)
 
-	globalClient = &ReveniumOpenAI{
-		client:   openaiClient,
-		config:   cfg,
-		provider: provider,
-	}
+	globalClient = newReveniumOpenAI(openaiClient, cfg, provider)
 
 	initialized = true
 	Info("Revenium middleware initialized successfully with provider: %s", provider)
@@ -99,7 +101,7 @@ func NewReveniumOpenAI(cfg *Config) (*ReveniumOpenAI, error) {
 	}
 
 	// Validate required fields
-	if cfg.ReveniumAPIKey == "" {
+	if cfg.ReveniumAPIKey == "" && cfg.Sink == nil {
 		return nil, NewConfigError("REVENIUM_METERING_API_KEY is required", nil)
 	}
 
@@ -107,11 +109,46 @@ func NewReveniumOpenAI(cfg *Config) (*ReveniumOpenAI, error) {
 	clientOpts := buildClientOptions(cfg, provider)
 	openaiClient := openai.NewClient(clientOpts...)
 
-	return &ReveniumOpenAI{
+	return newReveniumOpenAI(openaiClient, cfg, provider), nil
+}
+
+// newReveniumOpenAI assembles a client, starts its metering workers and replays
+// events left in the spool by a previous run
+func newReveniumOpenAI(openaiClient openai.Client, cfg *Config, provider Provider) *ReveniumOpenAI {
+	cfg.applyDefaultMetadataEnv()
+	r := &ReveniumOpenAI{
 		client:   openaiClient,
 		config:   cfg,
 		provider: provider,
-	}, nil
+		sink:     cfg.Sink,
+		pricing:  newConfiguredPricing(cfg),
+		attempts: newHeldAttempts(),
+		models:   newTransactionModels(),
+	}
+	if r.sink == nil {
+		r.sink = NewHTTPSink(cfg.ReveniumBaseURL, cfg.ReveniumAPIKey)
+	}
+
+	if cfg.SpoolDir != "" {
+		spool, err := openMeteringSpool(cfg.SpoolDir, cfg.SpoolMaxBytes, cfg.SpoolFsync)
+		if err != nil {
+			Warn("Metering spool disabled: %v", err)
+		} else {
+			r.spool = spool
+		}
+	}
+
+	r.queue = newMeteringQueue(cfg.MeteringWorkers, cfg.MeteringQueueSize, meteringBatchSize(cfg), cfg.MeteringBatchLinger, cfg.OverflowPolicy, r.deliverMeteringBatch, r.settleMetering)
+
+	if r.spool != nil {
+		if events := r.spool.pending(); len(events) > 0 {
+			Info("Replaying %d spooled metering events from %s", len(events), cfg.SpoolDir)
+			for _, ev := range events {
+				r.queue.enqueue(ev)
+			}
+		}
+	}
+	return r
 }
 
 // buildClientOptions builds OpenAI client options based on provider
@@ -175,16 +212,170 @@ func (r *ReveniumOpenAI) Chat() *ChatInterface {
 	}
 }
 
+// Embeddings returns the embeddings interface for creating embeddings with metering
+func (r *ReveniumOpenAI) Embeddings() *EmbeddingsInterface {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return &EmbeddingsInterface{
+		client:   r.client,
+		config:   r.config,
+		provider: r.provider,
+		parent:   r,
+	}
+}
+
+// Flush blocks until every queued metering event has been delivered or has failed
 func (r *ReveniumOpenAI) Flush() {
 	Debug("Flushing pending metering requests...")
-	r.wg.Wait()
+	r.queue.flush()
 	Debug("All metering requests completed")
 }
 
+// Close waits for all pending metering requests to complete and stops the
+// metering workers, so defer Close after creating a client. The client stays
+// usable afterwards: metering it again starts the workers anew. Use Shutdown to
+// stop metering for good or to bound the wait.
 func (r *ReveniumOpenAI) Close() error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.Flush()
+	Debug("Closing metering...")
+	r.queue.stop()
+	Debug("All metering requests completed")
+	return nil
+}
+
+// Shutdown stops accepting metering events and delivers the pending ones until ctx
+// is done. Events still undelivered at the deadline are abandoned: they are passed
+// to Config.OnAbandonedMetering, if set, and stay in the spool, if one is configured.
+// A non-nil error reports how many events were abandoned. Sinks must return
+// promptly once their ctx is cancelled: a delivery still running shortly after
+// the deadline is not waited for, and its events are not reported here. Events
+// metered after Shutdown are dropped, so do not shut down the global client of
+// GetClient while other code still uses it.
+func (r *ReveniumOpenAI) Shutdown(ctx context.Context) error {
+	Debug("Shutting down metering...")
+	r.attempts.releaseAll()
+	abandoned := r.queue.shutdown(ctx)
+	if len(abandoned) == 0 {
+		Debug("All metering requests completed")
+		return nil
+	}
+
+	Warn("Metering shutdown deadline reached, abandoned %d events", len(abandoned))
+	r.mu.RLock()
+	onAbandoned := r.config.OnAbandonedMetering
+	r.mu.RUnlock()
+	if onAbandoned != nil {
+		payloads := make([]*MeteringPayload, len(abandoned))
+		for i, ev := range abandoned {
+			payloads[i] = ev.payload
+		}
+		onAbandoned(payloads)
+	}
+	return NewMeteringError(fmt.Sprintf("metering shutdown abandoned %d events", len(abandoned)), ctx.Err())
+}
+
+// WithMetadata returns a client that adds metadata to every call it meters, on
+// top of Config.DefaultMetadata and the metadata of r. The returned client
+// shares the OpenAI client, metering queue and pricing catalog of r, so
+// Shutdown on either stops metering for both.
+func (r *ReveniumOpenAI) WithMetadata(metadata map[string]interface{}) *ReveniumOpenAI {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return &ReveniumOpenAI{
+		client:   r.client,
+		config:   r.config,
+		provider: r.provider,
+		queue:    r.queue,
+		spool:    r.spool,
+		sink:     r.sink,
+		pricing:  r.pricing,
+		metadata: MergeMetadata(r.metadata, metadata),
+		attempts: r.attempts,
+		models:   r.models,
+	}
+}
+
+// Pricing returns the catalog used to estimate the cost of calls; prices set
+// on it apply to calls metered afterwards
+func (r *ReveniumOpenAI) Pricing() *PricingCatalog {
+	return r.pricing
+}
+
+// EstimateCost estimates the cost in USD of a chat completion from the usage it
+// reports, or returns false if the model has no known prices
+func (r *ReveniumOpenAI) EstimateCost(resp *openai.ChatCompletion) (float64, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	return r.pricing.Cost(resp.Model, string(resp.ServiceTier), resp.Usage)
+}
+
+// MeteringStats returns a snapshot of the metering queue counters
+func (r *ReveniumOpenAI) MeteringStats() MeteringStats {
+	return r.queue.stats()
+}
+
+// enqueueMetering validates a payload, spools it if a spool is configured, and
+// hands it to the background metering workers. Payloads without a transaction ID
+// from metadata get the one of the MeteredResult in ctx, or a new one. The result
+// also gets the estimated cost and delivery outcome.
+func (r *ReveniumOpenAI) enqueueMetering(ctx context.Context, payload *MeteringPayload) {
+	r.pricing.apply(payload)
+
+	result := GetMeteredResult(ctx)
+	if result != nil && !result.bind(payload) {
+		Warn("Metering result for transaction %s already reported, use a new context per call", result.TransactionID())
+		result = nil
+	}
+	if payload.TransactionID == "" {
+		payload.TransactionID = generateRequestID()
+	}
+
+	if err := payload.Validate(); err != nil {
+		Error("Dropping invalid metering payload %s: %v", payload.TransactionID, err)
+		r.queue.markInvalid()
+		result.resolve(err)
+		return
+	}
+
+	if payload.OperationSubtype != OperationSubtypeFeedback {
+		r.models.record(payload.TransactionID, payload.Model)
+	}
+
+	ev := meteringEvent{payload: payload, result: result}
+	if r.spool != nil {
+		file, err := r.spool.write(payload)
+		if err != nil {
+			Warn("Metering event not spooled: %v", err)
+		}
+		ev.spoolFile = file
+	}
+	r.queue.enqueue(ev)
+}
+
+// settleMetering removes a spooled event once it has been delivered or
+// permanently rejected (400/422); events that failed transiently, including
+// rate-limited and unauthorized ones, and dropped or abandoned events stay for
+// replay and are no longer claimed by this client
+func (r *ReveniumOpenAI) settleMetering(ev meteringEvent, err error) {
+	if r.spool == nil || ev.spoolFile == "" {
+		return
+	}
+	if err == nil || IsValidationError(err) {
+		r.spool.remove(ev.spoolFile)
+		return
+	}
+	r.spool.unclaim(ev.spoolFile)
+}
+
+// deliverMetering sends a single payload with retries
+func (r *ReveniumOpenAI) deliverMetering(ctx context.Context, payload *MeteringPayload) error {
+	if err := r.sendMeteringWithRetry(ctx, payload); err != nil {
+		Error("Failed to send metering data: %v", err)
+		return err
+	}
+	Debug("[METERING] Metering data sent successfully")
 	return nil
 }
 
@@ -193,7 +384,7 @@ type ChatInterface struct {
 	client   openai.Client
 	config   *Config
 	provider Provider
-	parent   *ReveniumOpenAI // Reference to parent for WaitGroup access
+	parent   *ReveniumOpenAI // Reference to parent for metering queue access
 }
 
 // Completions returns the completions interface
@@ -211,13 +402,13 @@ type CompletionsInterface struct {
 	client   openai.Client
 	config   *Config
 	provider Provider
-	parent   *ReveniumOpenAI // Reference to parent for WaitGroup access
+	parent   *ReveniumOpenAI // Reference to parent for metering queue access
 }
 
 // New creates a chat completion with automatic metering
-func (c *CompletionsInterface) New(ctx context.Context, params openai.ChatCompletionNewParams) (*openai.ChatCompletion, error) {
-	// Extract metadata from context
-	metadata := GetUsageMetadata(ctx)
+func (c *CompletionsInterface) New(ctx context.Context, params openai.ChatCompletionNewParams, opts ...CallOption) (*openai.ChatCompletion, error) {
+	// Resolve metadata from config, client, context and call options
+	metadata := c.parent.callMetadata(ctx, opts)
 
 	// Call the appropriate provider
 	switch c.provider {
@@ -230,21 +421,43 @@ func (c *CompletionsInterface) New(ctx context.Context, params openai.ChatComple
 	}
 }
 
+// NewWithResult creates a chat completion like New and also returns its
+// metering result, which reports the transaction ID and estimated cost and,
+// once known, whether the event was delivered
+func (c *CompletionsInterface) NewWithResult(ctx context.Context, params openai.ChatCompletionNewParams, opts ...CallOption) (*openai.ChatCompletion, *MeteredResult, error) {
+	ctx, result := WithMeteredResult(ctx)
+	resp, err := c.New(ctx, params, opts...)
+	return resp, result, err
+}
+
 // NewStreaming creates a streaming chat completion with automatic metering
 // Returns a StreamingWrapper that intercepts the stream and sends metering data when closed
-func (c *CompletionsInterface) NewStreaming(ctx context.Context, params openai.ChatCompletionNewParams) (*StreamingWrapper, error) {
-	// Extract metadata from context
-	metadata := GetUsageMetadata(ctx)
+//
+// The stream is metered once, when Close is called or Next returns false. As a
+// safety net for callers that forget Close, a stream that is not read for the
+// configured idle timeout, or that is garbage collected, is finalized as well.
+func (c *CompletionsInterface) NewStreaming(ctx context.Context, params openai.ChatCompletionNewParams, opts ...CallOption) (*StreamingWrapper, error) {
+	// Resolve metadata from config, client, context and call options
+	metadata := c.parent.callMetadata(ctx, opts)
 
 	// Call the appropriate provider
+	var wrapper *StreamingWrapper
+	var err error
 	switch c.provider {
 	case ProviderOpenAI:
-		return c.createCompletionStreamingOpenAI(ctx, params, metadata)
+		wrapper, err = c.createCompletionStreamingOpenAI(ctx, params, metadata)
 	case ProviderAzure:
-		return c.createCompletionStreamingAzure(ctx, params, metadata)
+		wrapper, err = c.createCompletionStreamingAzure(ctx, params, metadata)
 	default:
 		return nil, NewProviderError("unknown provider", fmt.Errorf("provider: %v", c.provider))
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	wrapper.ctx, wrapper.result = ensureMeteredResult(wrapper.ctx)
+	wrapper.watch(callerSite(1), streamIdleTimeout(c.config))
+	return wrapper, nil
 }
 
 // createCompletionOpenAI creates a chat completion using OpenAI native API
@@ -257,11 +470,7 @@ func (c *CompletionsInterface) createCompletionOpenAI(ctx context.Context, param
 	if err != nil {
 		// Send error metering data
 		duration := time.Since(requestTime)
-		c.parent.wg.Add(1)
-		go func() {
-			defer c.parent.wg.Done()
-			c.sendMeteringDataForError(ctx, string(params.Model), metadata, false, duration, "OPENAI", requestTime, err.Error())
-		}()
+		c.sendMeteringDataForError(ctx, &params, string(params.Model), metadata, false, duration, "OPENAI", requestTime, requestError(ctx, err), nil)
 		return nil, err
 	}
 
@@ -270,11 +479,7 @@ func (c *CompletionsInterface) createCompletionOpenAI(ctx context.Context, param
 
 	// For non-streaming, completionStartTime is approximately the same as requestTime
 	// timeToFirstToken is 0 for non-streaming
-	c.parent.wg.Add(1)
-	go func() {
-		defer c.parent.wg.Done()
-		c.sendMeteringData(ctx, resp, metadata, false, duration, "OPENAI", requestTime, nil, 0)
-	}()
+	c.sendMeteringData(ctx, &params, resp, metadata, false, duration, "OPENAI", requestTime, nil, 0, c.estimateMissingUsage(params, resp))
 
 	return resp, nil
 }
@@ -286,28 +491,30 @@ func (c *CompletionsInterface) createCompletionAzure(ctx context.Context, params
 
 	resp, err := c.client.Chat.Completions.New(ctx, params)
 	if err != nil {
-		Warn("Azure request failed: %v, falling back to OpenAI", err)
 		duration := time.Since(requestTime)
-		c.parent.wg.Add(1)
-		go func() {
-			defer c.parent.wg.Done()
-			c.sendMeteringDataForError(ctx, originalModel, metadata, false, duration, "AZURE", requestTime, err.Error())
-		}()
+		err = requestError(ctx, err)
+		if ctx.Err() != nil {
+			// A cancelled or expired context would fail the fallback as well
+			c.sendMeteringDataForError(ctx, &params, originalModel, metadata, false, duration, "AZURE", requestTime, err, nil)
+			return nil, err
+		}
+		// The caller's MeteredResult reports the fallback call instead
+		c.sendMeteringDataForError(withoutMeteredResult(ctx), &params, originalModel, metadata, false, duration, "AZURE", requestTime, err, nil)
+		Warn("Azure request failed: %v, falling back to OpenAI", err)
 		return c.createCompletionOpenAI(ctx, params, metadata)
 	}
 
 	duration := time.Since(requestTime)
-	c.parent.wg.Add(1)
-	go func() {
-		defer c.parent.wg.Done()
-		c.sendMeteringData(ctx, resp, metadata, false, duration, "AZURE", requestTime, nil, 0)
-	}()
+	c.sendMeteringData(ctx, &params, resp, metadata, false, duration, "AZURE", requestTime, nil, 0, c.estimateMissingUsage(params, resp))
 
 	return resp, nil
 }
 
 // createCompletionStreamingOpenAI creates a streaming chat completion using OpenAI native API
 func (c *CompletionsInterface) createCompletionStreamingOpenAI(ctx context.Context, params openai.ChatCompletionNewParams, metadata map[string]interface{}) (*StreamingWrapper, error) {
+	// Request usage in the stream so tokens can be metered
+	hideUsageChunk := c.injectStreamUsage(&params)
+
 	// Call OpenAI streaming API
 	stream := c.client.Chat.Completions.NewStreaming(ctx, params)
 
@@ -326,7 +533,8 @@ func (c *CompletionsInterface) createCompletionStreamingOpenAI(ctx context.Conte
 	}
 
 	// Wrap stream for metering tracking
-	wrapper := &StreamingWrapper{
+	wrapper := &StreamingWrapper{&chatStreamState{
+		ctx:         ctx,
 		stream:      stream,
 		config:      c.config,
 		metadata:    streamMetadata,
@@ -335,7 +543,10 @@ func (c *CompletionsInterface) createCompletionStreamingOpenAI(ctx context.Conte
 		model:       string(params.Model),
 		provider:    "OPENAI",
 		parent:      c.parent,
-	}
+
+		hideUsageChunk: hideUsageChunk,
+		request:        params,
+	}}
 
 	// Return the wrapper instead of the raw stream
 	return wrapper, nil
@@ -345,6 +556,8 @@ func (c *CompletionsInterface) createCompletionStreamingAzure(ctx context.Contex
 	originalModel := string(params.Model)
 	Debug("Using Azure deployment name '%s' from user", originalModel)
 
+	// Usage is not requested on the caller's behalf: older Azure OpenAI
+	// api-versions reject stream_options, so without it tokens are estimated
 	stream := c.client.Chat.Completions.NewStreaming(ctx, params)
 
 	streamMetadata := make(map[string]interface{})
@@ -358,7 +571,8 @@ func (c *CompletionsInterface) createCompletionStreamingAzure(ctx context.Contex
 		streamMetadata["model"] = originalModel
 	}
 
-	wrapper := &StreamingWrapper{
+	wrapper := &StreamingWrapper{&chatStreamState{
+		ctx:         ctx,
 		stream:      stream,
 		config:      c.config,
 		metadata:    streamMetadata,
@@ -367,13 +581,54 @@ func (c *CompletionsInterface) createCompletionStreamingAzure(ctx context.Contex
 		model:       originalModel,
 		provider:    "AZURE",
 		parent:      c.parent,
-	}
+		request:     params,
+	}}
 
 	return wrapper, nil
 }
 
+// defaultStreamIdleTimeout is how long an unread stream stays open when
+// Config.StreamIdleTimeout is zero
+const defaultStreamIdleTimeout = 5 * time.Minute
+
+var (
+	// errStreamIdle finalizes a stream that was not read within the idle timeout
+	errStreamIdle = fmt.Errorf("stream not read within the idle timeout: %w", context.DeadlineExceeded)
+
+	// errStreamAbandoned finalizes a stream garbage collected without Close
+	errStreamAbandoned = fmt.Errorf("stream garbage collected without being closed: %w", context.Canceled)
+)
+
+// streamIdleTimeout returns the configured idle timeout, or 0 if disabled
+func streamIdleTimeout(cfg *Config) time.Duration {
+	if cfg == nil || cfg.StreamIdleTimeout == 0 {
+		return defaultStreamIdleTimeout
+	}
+	if cfg.StreamIdleTimeout < 0 {
+		return 0
+	}
+	return cfg.StreamIdleTimeout
+}
+
+// callerSite returns the file:line of the caller skip frames above the caller of callerSite
+func callerSite(skip int) string {
+	_, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
 // StreamingWrapper wraps a streaming response to track tokens and send metering data
 type StreamingWrapper struct {
+	// The state is kept apart so the idle timer, which only references the
+	// state, does not keep an unclosed wrapper reachable from its finalizer
+	*chatStreamState
+}
+
+// chatStreamState is the state of a StreamingWrapper
+type chatStreamState struct {
+	ctx            context.Context // request context, to detect cancellation and timeouts
 	stream         *ssestream.Stream[openai.ChatCompletionChunk]
 	config         *Config
 	metadata       map[string]interface{}
@@ -382,7 +637,7 @@ type StreamingWrapper struct {
 	completions    *CompletionsInterface
 	model          string
 	provider       string
-	parent         *ReveniumOpenAI // Reference to parent for WaitGroup access
+	parent         *ReveniumOpenAI // Reference to parent for metering queue access
 	mu             sync.Mutex
 
 	// Token tracking
@@ -393,34 +648,111 @@ type StreamingWrapper struct {
 	cacheReadTokens     int64
 	cacheCreationTokens int64
 
-	// Finish reason tracking
-	finishReason string
-
-	// System fingerprint tracking
+	// Response tracking, for FinalCompletion
+	id                string
+	responseModel     string
+	created           int64
+	serviceTier       string
 	systemFingerprint string
+	choices           []openai.ChatCompletionChoice // accumulated per choice index
+
+	// hideUsageChunk skips the trailing usage-only chunk, which is only sent
+	// because include_usage was injected on the caller's behalf; current is
+	// the last chunk Next returned to the caller
+	hideUsageChunk bool
+	current        openai.ChatCompletionChunk
+
+	// Inputs for local token estimation when the stream carries no usage
+	request   openai.ChatCompletionNewParams
+	usageSeen bool
+
+	// The stream is finalized (closed and metered) exactly once: by Close, by
+	// Next returning false, by the idle timer or when garbage collected
+	finalizeOnce sync.Once
+	closeErr     error
+	createdAt    string // call site of NewStreaming, for leak warnings
+	idleTimeout  time.Duration
+
+	// idleMu guards the idle timer, which must not be re-armed once finalized
+	// nor finalize the stream while Next is reading from it
+	idleMu    sync.Mutex
+	idleTimer *time.Timer
+	reading   bool
+	finalized bool
+
+	// cutErr is errStreamIdle or errStreamAbandoned when a safety net closed
+	// the stream before every choice finished; Err reports it
+	cutErr error
+
+	// estimatedCost is the cost of the metered payload, set when finalized
+	estimatedCost *float64
+	result        *MeteredResult
 }
 
-func (c *CompletionsInterface) sendMeteringData(ctx context.Context, resp *openai.ChatCompletion, metadata map[string]interface{}, isStreamed bool, duration time.Duration, provider string, requestTime time.Time, completionStartTime *time.Time, timeToFirstToken int64) {
-	payload := buildMeteringPayload(resp, metadata, isStreamed, duration, provider, requestTime, completionStartTime, timeToFirstToken)
-	Debug("[METERING] About to send metering data...")
-	if err := c.sendMeteringWithRetry(payload); err != nil {
-		Error("Failed to send metering data: %v", err)
-	} else {
-		Debug("[METERING] Metering data sent successfully")
+// estimateMissingUsage estimates token counts locally when the response carries no usage
+func (c *CompletionsInterface) estimateMissingUsage(params openai.ChatCompletionNewParams, resp *openai.ChatCompletion) *tokenEstimate {
+	if resp.JSON.Usage.Valid() {
+		return nil
+	}
+	model := resp.Model
+	if model == "" {
+		model = string(params.Model)
 	}
+	Debug("No usage in response for model %s, estimating tokens locally", model)
+	return estimateTokens(c.config, model, params.Messages, completionText(resp))
 }
 
-func (c *CompletionsInterface) sendMeteringDataForError(ctx context.Context, model string, metadata map[string]interface{}, isStreamed bool, duration time.Duration, provider string, requestTime time.Time, errorReason string) {
-	payload := buildErrorMeteringPayload(model, metadata, isStreamed, duration, provider, requestTime, errorReason)
-	Debug("[METERING] About to send error metering data...")
-	if err := c.sendMeteringWithRetry(payload); err != nil {
-		Error("Failed to send error metering data: %v", err)
-	} else {
-		Debug("[METERING] Error metering data sent successfully")
+// injectStreamUsage sets stream_options.include_usage unless the caller already
+// requested it or injection is disabled. It reports whether it was injected.
+func (c *CompletionsInterface) injectStreamUsage(params *openai.ChatCompletionNewParams) bool {
+	if c.config != nil && c.config.StreamUsageInjectionDisabled {
+		return false
+	}
+	if params.StreamOptions.IncludeUsage.Value {
+		return false
+	}
+	params.StreamOptions.IncludeUsage = openai.Bool(true)
+	return true
+}
+
+// sendMeteringData queues the payload for a completion and returns it. Details of the request
+// fill fields the metadata left unset. A non-nil estimate replaces the token
+// counts when the provider returned no usage.
+func (c *CompletionsInterface) sendMeteringData(ctx context.Context, params *openai.ChatCompletionNewParams, resp *openai.ChatCompletion, metadata map[string]interface{}, isStreamed bool, duration time.Duration, provider string, requestTime time.Time, completionStartTime *time.Time, timeToFirstToken int64, estimate *tokenEstimate) *MeteringPayload {
+	payload := buildMeteringPayload(resp, metadata, isStreamed, duration, provider, requestTime, completionStartTime, timeToFirstToken)
+	addRequestDetails(payload, params)
+	estimate.apply(payload)
+	Debug("[METERING] Queueing metering data...")
+	c.parent.enqueueMetering(ctx, payload)
+	return payload
+}
+
+// sendMeteringDataForError queues and returns the payload for a failed or interrupted
+// completion; the stop reason is derived from err with MapRequestError
+func (c *CompletionsInterface) sendMeteringDataForError(ctx context.Context, params *openai.ChatCompletionNewParams, model string, metadata map[string]interface{}, isStreamed bool, duration time.Duration, provider string, requestTime time.Time, err error, estimate *tokenEstimate) *MeteringPayload {
+	payload := buildErrorMeteringPayload(model, metadata, isStreamed, duration, provider, requestTime, err.Error())
+	addRequestDetails(payload, params)
+	payload.StopReason = MapRequestError(err)
+	estimate.apply(payload)
+	Debug("[METERING] Queueing error metering data...")
+	c.parent.enqueueMetering(ctx, payload)
+	return payload
+}
+
+// requestError attributes a request failure to the context when the context
+// was cancelled or expired, since the transport does not always wrap ctx.Err()
+func requestError(ctx context.Context, err error) error {
+	ctxErr := ctx.Err()
+	if ctxErr == nil || errors.Is(err, ctxErr) {
+		return err
+	}
+	if err == nil {
+		return ctxErr
 	}
+	return fmt.Errorf("%w: %w", ctxErr, err)
 }
 
-func buildErrorMeteringPayload(model string, metadata map[string]interface{}, isStreamed bool, duration time.Duration, provider string, requestTime time.Time, errorReason string) map[string]interface{} {
+func buildErrorMeteringPayload(model string, metadata map[string]interface{}, isStreamed bool, duration time.Duration, provider string, requestTime time.Time, errorReason string) *MeteringPayload {
 	responseTime := time.Now().UTC()
 	responseTimeISO := responseTime.Format(time.RFC3339)
 	requestTimeISO := requestTime.UTC().Format(time.RFC3339)
@@ -429,27 +761,19 @@ func buildErrorMeteringPayload(model string, metadata map[string]interface{}, is
 		provider = "OPENAI"
 	}
 
-	payload := map[string]interface{}{
-		"stopReason":              "ERROR",
-		"costType":                "AI",
-		"isStreamed":              isStreamed,
-		"operationType":           "CHAT",
-		"inputTokenCount":         int64(0),
-		"outputTokenCount":        int64(0),
-		"reasoningTokenCount":     int64(0),
-		"cacheCreationTokenCount": int64(0),
-		"cacheReadTokenCount":     int64(0),
-		"totalTokenCount":         int64(0),
-		"model":                   model,
-		"transactionId":           generateRequestID(),
-		"responseTime":            responseTimeISO,
-		"requestDuration":         duration.Milliseconds(),
-		"provider":                provider,
-		"requestTime":             requestTimeISO,
-		"completionStartTime":     requestTimeISO,
-		"timeToFirstToken":        int64(0),
-		"middlewareSource":        GetMiddlewareSource(),
-		"errorReason":             errorReason,
+	payload := &MeteringPayload{
+		StopReason:          StopReasonError,
+		CostType:            CostTypeAI,
+		IsStreamed:          isStreamed,
+		OperationType:       OperationTypeChat,
+		Model:               model,
+		ResponseTime:        responseTimeISO,
+		RequestDuration:     duration.Milliseconds(),
+		Provider:            provider,
+		RequestTime:         requestTimeISO,
+		CompletionStartTime: requestTimeISO,
+		MiddlewareSource:    GetMiddlewareSource(),
+		ErrorReason:         errorReason,
 	}
 
 	addMetadataToPayload(payload, metadata)
@@ -461,29 +785,7 @@ func generateRequestID() string {
 	return fmt.Sprintf("%d-%d", now, now%1000000)
 }
 
-func addMetadataToPayload(payload map[string]interface{}, metadata map[string]interface{}) {
-	if metadata == nil {
-		return
-	}
-	metadataFields := []string{
-		// Core tracking fields
-		"organizationId", "productId", "taskType", "taskId", "agent", "subscriptionId",
-		"traceId", "transactionId", "subscriber", "responseQualityScore",
-		"modelSource", "temperature", "mediationLatency",
-		// Trace visualization fields (distributed tracing)
-		// NOTE: operationType is fixed (API only accepts: CHAT, GENERATE, EMBED, CLASSIFY, SUMMARIZE, TRANSLATE, OTHER)
-		// NOTE: operationSubtype is auto-detected, not user-provided
-		"traceType", "traceName", "environment", "region",
-		"retryNumber", "credentialAlias", "parentTransactionId",
-	}
-	for _, field := range metadataFields {
-		if value, ok := metadata[field]; ok {
-			payload[field] = value
-		}
-	}
-}
-
-func buildMeteringPayload(resp *openai.ChatCompletion, metadata map[string]interface{}, isStreamed bool, duration time.Duration, provider string, requestTime time.Time, completionStartTime *time.Time, timeToFirstToken int64) map[string]interface{} {
+func buildMeteringPayload(resp *openai.ChatCompletion, metadata map[string]interface{}, isStreamed bool, duration time.Duration, provider string, requestTime time.Time, completionStartTime *time.Time, timeToFirstToken int64) *MeteringPayload {
 	responseTime := time.Now().UTC()
 	responseTimeISO := responseTime.Format(time.RFC3339)
 	requestTimeISO := requestTime.UTC().Format(time.RFC3339)
@@ -512,43 +814,55 @@ func buildMeteringPayload(resp *openai.ChatCompletion, metadata map[string]inter
 		cacheReadTokens = resp.Usage.PromptTokensDetails.CachedTokens
 	}
 
-	openaiFinishReason := ""
-	if len(resp.Choices) > 0 {
-		openaiFinishReason = resp.Choices[0].FinishReason
+	choiceStopReasons := make([]ReveniumStopReason, len(resp.Choices))
+	for i, choice := range resp.Choices {
+		choiceStopReasons[i] = MapOpenAIFinishReason(choice.FinishReason, StopReasonEnd)
 	}
-	stopReason := string(MapOpenAIFinishReason(openaiFinishReason, StopReasonEnd))
 
-	payload := map[string]interface{}{
-		"stopReason":              stopReason,
-		"costType":                "AI",
-		"isStreamed":              isStreamed,
-		"operationType":           "CHAT",
-		"inputTokenCount":         inputTokens,
-		"outputTokenCount":        outputTokens,
-		"reasoningTokenCount":     reasoningTokens,
-		"cacheCreationTokenCount": cacheCreationTokens,
-		"cacheReadTokenCount":     cacheReadTokens,
-		"totalTokenCount":         totalTokens,
-		"model":                   string(resp.Model),
-		"transactionId":           generateRequestID(),
-		"responseTime":            responseTimeISO,
-		"requestDuration":         duration.Milliseconds(),
-		"provider":                provider,
-		"requestTime":             requestTimeISO,
-		"completionStartTime":     completionStartTimeISO,
-		"timeToFirstToken":        timeToFirstToken,
-		"middlewareSource":        GetMiddlewareSource(),
+	payload := &MeteringPayload{
+		StopReason:              AggregateStopReason(choiceStopReasons, StopReasonEnd),
+		CostType:                CostTypeAI,
+		IsStreamed:              isStreamed,
+		OperationType:           OperationTypeChat,
+		InputTokenCount:         inputTokens,
+		OutputTokenCount:        outputTokens,
+		ReasoningTokenCount:     reasoningTokens,
+		CacheCreationTokenCount: cacheCreationTokens,
+		CacheReadTokenCount:     cacheReadTokens,
+		TotalTokenCount:         totalTokens,
+		Model:                   string(resp.Model),
+		ResponseTime:            responseTimeISO,
+		RequestDuration:         duration.Milliseconds(),
+		Provider:                provider,
+		RequestTime:             requestTimeISO,
+		CompletionStartTime:     completionStartTimeISO,
+		TimeToFirstToken:        timeToFirstToken,
+		MiddlewareSource:        GetMiddlewareSource(),
+		SystemFingerprint:       resp.SystemFingerprint,
+		ServiceTier:             string(resp.ServiceTier),
+		ChoiceCount:             int64(len(resp.Choices)),
 	}
-
-	if resp.SystemFingerprint != "" {
-		payload["systemFingerprint"] = resp.SystemFingerprint
+	if len(choiceStopReasons) > 1 {
+		payload.ChoiceStopReasons = choiceStopReasons
 	}
+	addToolCallDetails(payload, resp)
 
 	addMetadataToPayload(payload, metadata)
 	return payload
 }
 
-func (c *CompletionsInterface) sendMeteringWithRetry(payload map[string]interface{}) error {
+// sendMeteringWithRetry delivers a metering payload, retrying transient failures
+// with exponential backoff. Validation and auth errors are returned without retrying.
+func (r *ReveniumOpenAI) sendMeteringWithRetry(ctx context.Context, payload *MeteringPayload) error {
+	return withMeteringRetry(ctx, func() error {
+		return r.sink.Send(ctx, payload)
+	})
+}
+
+// withMeteringRetry runs send up to three times with exponential backoff,
+// stopping early on success, on an error retrying cannot fix or when ctx is
+// done. Rate limiting (429) and timeouts (408) are retried like server errors.
+func withMeteringRetry(ctx context.Context, send func() error) error {
 	const maxRetries = 3
 	const initialBackoff = 100 * time.Millisecond
 
@@ -557,18 +871,22 @@ func (c *CompletionsInterface) sendMeteringWithRetry(payload map[string]interfac
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
-			time.Sleep(backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return NewMeteringError("metering cancelled", ctx.Err())
+			}
 			backoff *= 2
 		}
 
-		err := c.sendMeteringRequest(payload)
+		err := send()
 		if err == nil {
 			return nil
 		}
 
 		lastErr = err
 
-		if IsValidationError(err) {
+		if !isRetryableMeteringError(err) {
 			return err
 		}
 	}
@@ -576,60 +894,54 @@ func (c *CompletionsInterface) sendMeteringWithRetry(payload map[string]interfac
 	return NewMeteringError(fmt.Sprintf("metering failed after %d retries", maxRetries), lastErr)
 }
 
-func (c *CompletionsInterface) sendMeteringRequest(payload map[string]interface{}) error {
-	baseURL := c.config.ReveniumBaseURL
-	if baseURL == "" {
-		baseURL = "https://api.revenium.ai"
-	}
-	url := baseURL + "/meter/v2/ai/completions"
-
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return NewMeteringError("failed to marshal metering payload", err)
+// isRetryableMeteringError reports whether an immediate retry may succeed:
+// network and server errors, 408 and 429. Other 4xx responses are returned
+// at once, but only validation errors make the event be discarded.
+func isRetryableMeteringError(err error) bool {
+	if IsValidationError(err) || IsAuthError(err) {
+		return false
 	}
-
-	Debug("Sending metering request to %s", url)
-	Debug("Payload: %s", string(jsonData))
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return NewMeteringError("failed to create metering request", err)
+	var revErr *ReveniumError
+	if !errors.As(err, &revErr) || revErr.StatusCode < 400 || revErr.StatusCode >= 500 {
+		return true
 	}
+	return revErr.StatusCode == http.StatusRequestTimeout || revErr.StatusCode == http.StatusTooManyRequests
+}
 
-	req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	req.Header.Set("x-api-key", c.config.ReveniumAPIKey)
-	req.Header.Set("User-Agent", "revenium-middleware-openai-go/1.0")
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return NewNetworkError("metering request failed", err)
+// Next advances the stream and records the chunk for metering. The usage-only
+// chunk is recorded but skipped if usage was requested on the caller's behalf.
+//
+// When the stream is exhausted the wrapper is finalized, so the call is
+// metered even if the caller never calls Close. The idle timer is paused while
+// Next waits for the upstream, so a slow provider is not mistaken for an idle
+// caller. Next returns false once the stream is finalized.
+func (sw *StreamingWrapper) Next() bool {
+	if !sw.pauseIdle() {
+		return false
 	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
-			return NewValidationError(
-				fmt.Sprintf("metering API returned %d: %s", resp.StatusCode, string(body)),
-				nil,
-			)
+	for sw.stream.Next() {
+		chunk := sw.stream.Current()
+		sw.record(chunk)
+		if sw.hideUsageChunk && len(chunk.Choices) == 0 && chunk.JSON.Usage.Valid() {
+			continue
 		}
-		return NewMeteringError("metering API error", fmt.Errorf("status %d: %s", resp.StatusCode, string(body)))
+		sw.current = chunk
+		sw.touch()
+		return true
 	}
-
-	Debug("Metering request successful")
-	return nil
-}
-
-func (sw *StreamingWrapper) Next() bool {
-	return sw.stream.Next()
+	sw.finalize(sw.stream.Err())
+	return false
 }
 
+// Current returns the chunk Next advanced to. After Next returns false it is
+// still the last chunk returned to the caller, never a hidden usage-only chunk.
 func (sw *StreamingWrapper) Current() openai.ChatCompletionChunk {
-	chunk := sw.stream.Current()
+	return sw.current
+}
 
+// record captures timing, usage and finish reason from a chunk and
+// accumulates its deltas into the per-choice messages
+func (sw *chatStreamState) record(chunk openai.ChatCompletionChunk) {
 	sw.mu.Lock()
 	defer sw.mu.Unlock()
 
@@ -638,7 +950,24 @@ func (sw *StreamingWrapper) Current() openai.ChatCompletionChunk {
 		sw.firstTokenTime = &now
 	}
 
+	if sw.id == "" {
+		sw.id = chunk.ID
+	}
+	if chunk.Model != "" {
+		sw.responseModel = chunk.Model
+	}
+	if chunk.Created != 0 && sw.created == 0 {
+		sw.created = chunk.Created
+	}
+	if chunk.ServiceTier != "" {
+		sw.serviceTier = string(chunk.ServiceTier)
+	}
+	for _, delta := range chunk.Choices {
+		sw.accumulate(delta)
+	}
+
 	if chunk.Usage.PromptTokens > 0 || chunk.Usage.CompletionTokens > 0 {
+		sw.usageSeen = true
 		sw.inputTokens = chunk.Usage.PromptTokens
 		sw.outputTokens = chunk.Usage.CompletionTokens
 		sw.totalTokens = chunk.Usage.TotalTokens
@@ -652,63 +981,99 @@ func (sw *StreamingWrapper) Current() openai.ChatCompletionChunk {
 		}
 	}
 
-	if len(chunk.Choices) > 0 && chunk.Choices[0].FinishReason != "" {
-		sw.finishReason = chunk.Choices[0].FinishReason
-	}
-
 	if chunk.SystemFingerprint != "" {
 		sw.systemFingerprint = chunk.SystemFingerprint
 	}
-
-	return chunk
 }
 
-func (sw *StreamingWrapper) Err() error {
-	return sw.stream.Err()
+// accumulate appends a choice delta to the message of its choice index
+func (sw *chatStreamState) accumulate(delta openai.ChatCompletionChunkChoice) {
+	for int(delta.Index) >= len(sw.choices) {
+		sw.choices = append(sw.choices, openai.ChatCompletionChoice{
+			Index:   int64(len(sw.choices)),
+			Message: openai.ChatCompletionMessage{Role: constant.Assistant("assistant")},
+		})
+	}
+	choice := &sw.choices[delta.Index]
+
+	choice.Message.Content += delta.Delta.Content
+	choice.Message.Refusal += delta.Delta.Refusal
+	if delta.FinishReason != "" {
+		choice.FinishReason = delta.FinishReason
+	}
+
+	for _, call := range delta.Delta.ToolCalls {
+		for int(call.Index) >= len(choice.Message.ToolCalls) {
+			choice.Message.ToolCalls = append(choice.Message.ToolCalls, openai.ChatCompletionMessageToolCallUnion{})
+		}
+		tool := &choice.Message.ToolCalls[call.Index]
+		if call.ID != "" {
+			tool.ID = call.ID
+		}
+		if call.Type != "" {
+			tool.Type = string(call.Type)
+		}
+		tool.Function.Name += call.Function.Name
+		tool.Function.Arguments += call.Function.Arguments
+	}
 }
 
-func (sw *StreamingWrapper) Close() error {
-	err := sw.stream.Close()
-	streamErr := sw.stream.Err()
-	duration := time.Since(sw.startTime)
+// finished reports whether every choice received its finish reason; sw.mu must be held
+func (sw *chatStreamState) finished() bool {
+	for _, choice := range sw.choices {
+		if choice.FinishReason == "" {
+			return false
+		}
+	}
+	return len(sw.choices) > 0
+}
 
+// FinalCompletion returns the completion accumulated from the chunks read so
+// far: the content, refusal and tool calls of every choice, the finish reasons
+// and the usage. Once the stream has ended it is the complete response, and it
+// is what the stream is metered from.
+func (sw *StreamingWrapper) FinalCompletion() *openai.ChatCompletion {
 	sw.mu.Lock()
 	defer sw.mu.Unlock()
+	return sw.finalCompletion()
+}
 
-	if streamErr != nil {
-		sw.parent.wg.Add(1)
-		go func() {
-			defer sw.parent.wg.Done()
-			sw.completions.sendMeteringDataForError(
-				context.Background(),
-				sw.model,
-				sw.metadata,
-				true,
-				duration,
-				sw.provider,
-				sw.startTime,
-				streamErr.Error(),
-			)
-		}()
-		return err
-	}
+// Result returns the metering result of the stream: its transaction ID is known
+// immediately, the estimated cost and delivery outcome once it is finalized.
+// It is the MeteredResult of the context passed to NewStreaming, if any.
+func (sw *StreamingWrapper) Result() *MeteredResult {
+	return sw.result
+}
 
-	timeToFirstToken := int64(0)
-	var completionStartTime *time.Time
-	if sw.firstTokenTime != nil {
-		timeToFirstToken = sw.firstTokenTime.Sub(sw.startTime).Milliseconds()
-		completionStartTime = sw.firstTokenTime
+// EstimatedCost returns the estimated cost in USD the stream was metered with.
+// It returns false until the stream has been fully read or closed, and for
+// models without known prices.
+func (sw *StreamingWrapper) EstimatedCost() (float64, bool) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.estimatedCost == nil {
+		return 0, false
 	}
+	return *sw.estimatedCost, true
+}
 
-	finishReason := sw.finishReason
-	if finishReason == "" {
-		finishReason = "stop"
+// finalCompletion builds the accumulated completion; sw.mu must be held
+func (sw *chatStreamState) finalCompletion() *openai.ChatCompletion {
+	model := sw.responseModel
+	if model == "" {
+		model = sw.model
+	}
+	choices := make([]openai.ChatCompletionChoice, len(sw.choices))
+	for i, choice := range sw.choices {
+		choice.Message.ToolCalls = append([]openai.ChatCompletionMessageToolCallUnion(nil), choice.Message.ToolCalls...)
+		choices[i] = choice
 	}
 
-	resp := &openai.ChatCompletion{
-		ID:                generateRequestID(),
-		Model:             sw.model,
-		Created:           sw.startTime.Unix(),
+	return &openai.ChatCompletion{
+		ID:                sw.id,
+		Model:             model,
+		Created:           sw.created,
+		ServiceTier:       openai.ChatCompletionServiceTier(sw.serviceTier),
 		SystemFingerprint: sw.systemFingerprint,
 		Usage: openai.CompletionUsage{
 			PromptTokens:     sw.inputTokens,
@@ -721,22 +1086,236 @@ func (sw *StreamingWrapper) Close() error {
 				CachedTokens: sw.cacheReadTokens,
 			},
 		},
-		Choices: []openai.ChatCompletionChoice{
-			{
-				FinishReason: finishReason,
-				Message: openai.ChatCompletionMessage{
-					Role:    constant.Assistant("assistant"),
-					Content: "",
-				},
-			},
-		},
+		Choices: choices,
 	}
+}
 
-	sw.parent.wg.Add(1)
+// Err returns the error that ended the stream, including errStreamIdle when
+// the idle timeout closed it before every choice finished
+func (sw *StreamingWrapper) Err() error {
+	if err := sw.stream.Err(); err != nil {
+		return err
+	}
+	sw.idleMu.Lock()
+	defer sw.idleMu.Unlock()
+	return sw.cutErr
+}
+
+// Close closes the underlying stream and meters it. Close is idempotent; a
+// stream already finalized is never metered twice. A stream closed before every
+// choice finished is metered as CANCELLED.
+func (sw *StreamingWrapper) Close() error {
+	streamErr := sw.stream.Err()
+	if streamErr == nil && sw.ctx.Err() == nil && !sw.isFinished() {
+		streamErr = errSSEClosedEarly
+	}
+	return sw.finalize(streamErr)
+}
+
+// StreamChunk is a chunk, or the error that ended the stream, delivered by
+// StreamingWrapper.Channel
+type StreamChunk struct {
+	Chunk openai.ChatCompletionChunk
+	Err   error
+}
+
+// Chunks returns an iterator over the chunks of the stream. If the stream
+// fails, the last pair holds the error. The stream is closed and metered when
+// the loop ends, including on break, so Close does not need to be called:
+//
+//	for chunk, err := range stream.Chunks() {
+//		if err != nil {
+//			return err
+//		}
+//		fmt.Print(chunk.Choices[0].Delta.Content)
+//	}
+func (sw *StreamingWrapper) Chunks() iter.Seq2[openai.ChatCompletionChunk, error] {
+	return func(yield func(openai.ChatCompletionChunk, error) bool) {
+		defer sw.Close()
+		for sw.Next() {
+			if !yield(sw.Current(), nil) {
+				return
+			}
+		}
+		if err := sw.Err(); err != nil {
+			yield(openai.ChatCompletionChunk{}, err)
+		}
+	}
+}
+
+// Channel streams the chunks on a channel that is closed when the stream ends;
+// an error ending the stream is sent as the last value. The stream is closed
+// and metered when it ends or when ctx is done, in which case it is metered
+// as CANCELLED or TIMEOUT. The caller must drain the channel or cancel ctx.
+func (sw *StreamingWrapper) Channel(ctx context.Context) <-chan StreamChunk {
+	ch := make(chan StreamChunk)
 	go func() {
-		defer sw.parent.wg.Done()
-		sw.completions.sendMeteringData(context.Background(), resp, sw.metadata, true, duration, sw.provider, sw.startTime, completionStartTime, timeToFirstToken)
+		defer close(ch)
+		// Closing the stream unblocks a Next waiting on the upstream
+		stop := context.AfterFunc(ctx, func() { sw.finalize(ctx.Err()) })
+		defer stop()
+		for chunk, err := range sw.Chunks() {
+			select {
+			case ch <- StreamChunk{Chunk: chunk, Err: err}:
+			case <-ctx.Done():
+				sw.finalize(ctx.Err())
+				return
+			}
+		}
 	}()
+	return ch
+}
+
+// finalize closes the underlying stream and meters it, once. streamErr is the
+// reason the stream ended, or nil if it ended normally or was closed early.
+func (sw *chatStreamState) finalize(streamErr error) error {
+	sw.finalizeOnce.Do(func() {
+		cut := (errors.Is(streamErr, errStreamIdle) || errors.Is(streamErr, errStreamAbandoned)) && !sw.isFinished()
+
+		sw.idleMu.Lock()
+		sw.finalized = true
+		if cut {
+			sw.cutErr = streamErr
+		}
+		if sw.idleTimer != nil {
+			sw.idleTimer.Stop()
+		}
+		sw.idleMu.Unlock()
+
+		sw.closeErr = sw.stream.Close()
+		sw.meter(streamErr)
+	})
+	return sw.closeErr
+}
+
+// watch arms the safety nets for a caller that never closes the stream: an
+// idle timer and a finalizer that meter the stream and log where it was
+// created. The timer holds only the state, so the wrapper can be collected.
+func (sw *StreamingWrapper) watch(createdAt string, idleTimeout time.Duration) {
+	state := sw.chatStreamState
+	state.createdAt = createdAt
+	if idleTimeout > 0 {
+		state.idleMu.Lock()
+		state.idleTimeout = idleTimeout
+		state.idleTimer = time.AfterFunc(idleTimeout, state.idleExpired)
+		state.idleMu.Unlock()
+	}
+	runtime.SetFinalizer(sw, func(sw *StreamingWrapper) {
+		if sw.isFinalized() {
+			return
+		}
+		Warn("Stream created at %s was garbage collected without being closed; call Close() when done with a stream", sw.createdAt)
+		// Metering may block on a full queue or a spool fsync, so it must not
+		// hold up the runtime's finalizer goroutine
+		go sw.chatStreamState.finalize(errStreamAbandoned)
+	})
+}
+
+// idleExpired finalizes a stream the caller has not read within the idle
+// timeout, unless Next started reading it in the meantime
+func (sw *chatStreamState) idleExpired() {
+	sw.idleMu.Lock()
+	if sw.reading || sw.finalized {
+		sw.idleMu.Unlock()
+		return
+	}
+	// Claim the stream so that a Next starting now does not read from it
+	sw.finalized = true
+	sw.idleMu.Unlock()
+
+	Warn("Stream created at %s was not read for %s, closing it; call Close() when done with a stream", sw.createdAt, sw.idleTimeout)
+	sw.finalize(errStreamIdle)
+}
+
+// touch restarts the idle timer once Next returns a chunk, unless the stream
+// is already finalized
+func (sw *chatStreamState) touch() {
+	sw.idleMu.Lock()
+	defer sw.idleMu.Unlock()
+	sw.reading = false
+	if sw.idleTimer != nil && !sw.finalized {
+		sw.idleTimer.Reset(sw.idleTimeout)
+	}
+}
+
+// pauseIdle stops the idle timer while the wrapper waits for the upstream. It
+// returns false if the stream is already finalized and must not be read.
+func (sw *chatStreamState) pauseIdle() bool {
+	sw.idleMu.Lock()
+	defer sw.idleMu.Unlock()
+	if sw.finalized {
+		return false
+	}
+	sw.reading = true
+	if sw.idleTimer != nil {
+		sw.idleTimer.Stop()
+	}
+	return true
+}
+
+// isFinished reports whether every choice of the stream has finished
+func (sw *chatStreamState) isFinished() bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.finished()
+}
+
+// isFinalized reports whether the stream was closed and metered, or is being so
+func (sw *chatStreamState) isFinalized() bool {
+	sw.idleMu.Lock()
+	defer sw.idleMu.Unlock()
+	return sw.finalized
+}
 
-	return err
+// meter queues the metering payload for the stream
+func (sw *chatStreamState) meter(streamErr error) {
+	duration := time.Since(sw.startTime)
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	// A stream left open after its final chunk completed normally
+	if sw.finished() && (errors.Is(streamErr, errStreamIdle) || errors.Is(streamErr, errStreamAbandoned)) {
+		streamErr = nil
+	}
+
+	// A stream abandoned after its context was cancelled or expired, before
+	// the final chunk, is metered as CANCELLED or TIMEOUT
+	if streamErr != nil || (!sw.finished() && sw.ctx.Err() != nil) {
+		streamErr = requestError(sw.ctx, streamErr)
+	}
+
+	resp := sw.finalCompletion()
+
+	// Estimate tokens locally if the stream produced output but no usage; for
+	// interrupted streams this counts the output received before the cut-off
+	var estimate *tokenEstimate
+	if !sw.usageSeen && (streamErr == nil || sw.firstTokenTime != nil) {
+		estimate = estimateTokens(sw.config, resp.Model, sw.request.Messages, completionText(resp))
+	}
+
+	var payload *MeteringPayload
+	if streamErr != nil {
+		payload = sw.completions.sendMeteringDataForError(
+			sw.ctx,
+			&sw.request,
+			sw.model,
+			sw.metadata,
+			true,
+			duration,
+			sw.provider,
+			sw.startTime,
+			streamErr,
+			estimate,
+		)
+	} else {
+		timeToFirstToken := int64(0)
+		var completionStartTime *time.Time
+		if sw.firstTokenTime != nil {
+			timeToFirstToken = sw.firstTokenTime.Sub(sw.startTime).Milliseconds()
+			completionStartTime = sw.firstTokenTime
+		}
+		payload = sw.completions.sendMeteringData(sw.ctx, &sw.request, resp, sw.metadata, true, duration, sw.provider, sw.startTime, completionStartTime, timeToFirstToken, estimate)
+	}
+	sw.estimatedCost = payload.EstimatedCost
 }
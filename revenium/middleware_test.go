@@ -0,0 +1,46 @@
+package revenium
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/revenium/revenium-middleware-openai-go/revenium/openaitest"
+)
+
+func TestStreamIdleTimerDoesNotFinalizeDuringNext(t *testing.T) {
+	upstream := openaitest.NewServer()
+	defer upstream.Close()
+	upstream.Enqueue(openaitest.Response{Content: "one two three"})
+
+	sink := NewMemorySink()
+	r, err := NewReveniumOpenAI(&Config{Sink: sink, OpenAIAPIKey: "sk-test", BaseURL: upstream.URL, StreamIdleTimeout: -1})
+	require.NoError(t, err)
+	defer r.Close()
+
+	stream, err := r.Chat().Completions().NewStreaming(context.Background(), openai.ChatCompletionNewParams{
+		Model:    "gpt-4o-mini",
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("hello")},
+	})
+	require.NoError(t, err)
+	require.True(t, stream.Next())
+
+	// The timer fires while a Next is starting to read
+	require.True(t, stream.pauseIdle())
+	stream.idleExpired()
+	assert.False(t, stream.isFinalized(), "a Next in progress keeps the stream open")
+	stream.touch()
+
+	// The timer fires before the next Next, which must not read the stream
+	stream.idleExpired()
+	assert.True(t, stream.isFinalized())
+	assert.False(t, stream.Next())
+
+	r.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, StopReasonTimeout, payloads[0].StopReason)
+}
@@ -0,0 +1,352 @@
+// Package openaitest provides a fake OpenAI / Azure OpenAI chat completions API
+// for testing code that uses the revenium middleware without network access.
+//
+// The server answers both OpenAI paths (/chat/completions, /v1/chat/completions)
+// and Azure deployment paths (/openai/deployments/{deployment}/chat/completions
+// with an api-version query). Responses are scripted with Enqueue; requests with
+// "stream": true are answered with SSE chunks, followed by a usage-only chunk when
+// stream_options.include_usage is set.
+//
+//	srv := openaitest.NewServer()
+//	defer srv.Close()
+//	srv.Enqueue(openaitest.Response{Content: "Hello there", PromptTokens: 12, CompletionTokens: 3})
+//
+//	cfg := &revenium.Config{OpenAIAPIKey: "sk-test", BaseURL: srv.URL, ReveniumAPIKey: "hak_test"}
+//
+// For Azure, set AzureEndpoint to srv.URL together with AzureAPIKey and AzureAPIVersion.
+package openaitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const chatCompletionsSuffix = "/chat/completions"
+
+// Response scripts the answer to one chat completion request
+type Response struct {
+	// Status, when not 2xx, makes the server return an OpenAI-style error with
+	// ErrorMessage instead of a completion. The openai-go client retries 429 and
+	// 5xx responses by default, so each retry consumes another scripted response.
+	Status       int
+	ErrorMessage string
+
+	// Content is the assistant message; streamed responses send it in Chunks if
+	// set, otherwise split on spaces
+	Content string
+	Chunks  []string
+
+	// Refusal and ToolCalls are added to the assistant message; streamed
+	// responses send tool call arguments in two deltas
+	Refusal   string
+	ToolCalls []ToolCall
+
+	FinishReason string // defaults to "tool_calls" with ToolCalls, otherwise "stop"
+
+	// Choices, if set, answers with one choice per entry (as for n > 1)
+	// instead of the single choice described by Content, Chunks, Refusal,
+	// ToolCalls and FinishReason. Streamed choices are interleaved.
+	Choices []Choice
+
+	Model             string // defaults to the requested model
+	SystemFingerprint string
+	ServiceTier       string // the service tier reported as used, e.g. "default"
+
+	PromptTokens     int64
+	CompletionTokens int64
+	ReasoningTokens  int64
+	CachedTokens     int64
+
+	// OmitUsage leaves usage out of the response, as some OpenAI-compatible
+	// backends and aborted streams do
+	OmitUsage bool
+
+	// StreamError, if set, ends a streamed response with an error event after
+	// StreamErrorAfter content chunks
+	StreamError      string
+	StreamErrorAfter int
+
+	// Delay postpones the response, or each streamed chunk
+	Delay time.Duration
+}
+
+// Choice is one choice of a response with several choices
+type Choice struct {
+	Content      string
+	Refusal      string
+	ToolCalls    []ToolCall
+	FinishReason string // defaults to "tool_calls" with ToolCalls, otherwise "stop"
+}
+
+// ToolCall is a function tool call made by the assistant
+type ToolCall struct {
+	ID        string // defaults to "call_<index>"
+	Name      string
+	Arguments string
+}
+
+// Request is a chat completion request received by the server
+type Request struct {
+	Header http.Header
+	Path   string
+	Query  url.Values
+	Body   []byte
+
+	Model        string
+	Stream       bool
+	IncludeUsage bool
+
+	// Azure is set for deployment-style paths; Deployment and APIVersion come from the URL
+	Azure      bool
+	Deployment string
+	APIVersion string
+}
+
+// Server is a fake chat completions API
+type Server struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	responses   []Response
+	fallback    Response
+	requests    []Request
+	apiKey      string
+	apiVersions []string
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithAPIKey makes the server reject requests without the key, passed as a bearer
+// token (OpenAI) or api-key header (Azure), with 401
+func WithAPIKey(key string) Option {
+	return func(s *Server) {
+		s.apiKey = key
+	}
+}
+
+// WithAzureAPIVersions restricts the api-version values accepted on Azure paths.
+// By default any non-empty version is accepted.
+func WithAzureAPIVersions(versions ...string) Option {
+	return func(s *Server) {
+		s.apiVersions = versions
+	}
+}
+
+// WithDefaultResponse sets the response used when no scripted response is queued
+func WithDefaultResponse(resp Response) Option {
+	return func(s *Server) {
+		s.fallback = resp
+	}
+}
+
+// NewServer starts a fake chat completions server. The caller must Close it.
+func NewServer(opts ...Option) *Server {
+	s := &Server{fallback: Response{Content: "Hello from openaitest", PromptTokens: 10, CompletionTokens: 4}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Enqueue scripts the responses to the next requests, in order
+func (s *Server) Enqueue(responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses = append(s.responses, responses...)
+}
+
+// Requests returns a copy of the chat completion requests received
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Reset discards recorded requests and scripted responses
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+	s.responses = nil
+}
+
+// next returns the next scripted response, or the default one
+func (s *Server) next() Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.responses) == 0 {
+		return s.fallback
+	}
+	resp := s.responses[0]
+	s.responses = s.responses[1:]
+	return resp
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, chatCompletionsSuffix) {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	req := Request{Header: r.Header.Clone(), Path: r.URL.Path, Query: r.URL.Query(), Body: body}
+	if deployment, ok := azureDeployment(r.URL.Path); ok {
+		req.Azure = true
+		req.Deployment = deployment
+		req.APIVersion = req.Query.Get("api-version")
+	}
+
+	var params struct {
+		Model         string `json:"model"`
+		Stream        bool   `json:"stream"`
+		StreamOptions struct {
+			IncludeUsage bool `json:"include_usage"`
+		} `json:"stream_options"`
+	}
+	if err := json.Unmarshal(body, &params); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	req.Model = params.Model
+	req.Stream = params.Stream
+	req.IncludeUsage = params.StreamOptions.IncludeUsage
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	apiKey := s.apiKey
+	apiVersions := s.apiVersions
+	s.mu.Unlock()
+
+	if apiKey != "" && !hasAPIKey(r, req.Azure, apiKey) {
+		writeError(w, http.StatusUnauthorized, "invalid API key")
+		return
+	}
+	if req.Azure && !validAPIVersion(req.APIVersion, apiVersions) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unsupported api-version %q", req.APIVersion))
+		return
+	}
+
+	resp := s.next()
+	if resp.Model == "" {
+		resp.Model = req.Model
+		if resp.Model == "" {
+			resp.Model = req.Deployment
+		}
+	}
+	resp.Choices = resp.choices()
+
+	if resp.Delay > 0 && !req.Stream {
+		select {
+		case <-time.After(resp.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if resp.Status != 0 && (resp.Status < 200 || resp.Status >= 300) {
+		msg := resp.ErrorMessage
+		if msg == "" {
+			msg = http.StatusText(resp.Status)
+		}
+		writeError(w, resp.Status, msg)
+		return
+	}
+
+	if req.Stream {
+		s.stream(w, r, req, resp)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(completion(resp))
+}
+
+// choices returns the choices of the response with defaults applied
+func (resp Response) choices() []Choice {
+	choices := resp.Choices
+	if len(choices) == 0 {
+		choices = []Choice{{Content: resp.Content, Refusal: resp.Refusal, ToolCalls: resp.ToolCalls, FinishReason: resp.FinishReason}}
+	}
+
+	normalized := make([]Choice, len(choices))
+	for i, choice := range choices {
+		if choice.FinishReason == "" {
+			choice.FinishReason = "stop"
+			if len(choice.ToolCalls) > 0 {
+				choice.FinishReason = "tool_calls"
+			}
+		}
+		calls := make([]ToolCall, len(choice.ToolCalls))
+		for j, call := range choice.ToolCalls {
+			if call.ID == "" {
+				call.ID = fmt.Sprintf("call_%d", j)
+			}
+			calls[j] = call
+		}
+		choice.ToolCalls = calls
+		normalized[i] = choice
+	}
+	return normalized
+}
+
+// azureDeployment extracts the deployment from /openai/deployments/{deployment}/chat/completions
+func azureDeployment(path string) (string, bool) {
+	const prefix = "/openai/deployments/"
+	i := strings.Index(path, prefix)
+	if i < 0 {
+		return "", false
+	}
+	deployment := strings.TrimSuffix(path[i+len(prefix):], chatCompletionsSuffix)
+	if deployment == "" || strings.Contains(deployment, "/") {
+		return "", false
+	}
+	return deployment, true
+}
+
+func hasAPIKey(r *http.Request, azure bool, key string) bool {
+	if azure && r.Header.Get("api-key") == key {
+		return true
+	}
+	return r.Header.Get("Authorization") == "Bearer "+key
+}
+
+func validAPIVersion(version string, allowed []string) bool {
+	if version == "" {
+		return false
+	}
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, v := range allowed {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    "invalid_request_error",
+			"code":    status,
+		},
+	})
+}
@@ -0,0 +1,201 @@
+package openaitest
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/azure"
+	"github.com/openai/openai-go/v3/option"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newOpenAIClient(srv *Server) openai.Client {
+	return openai.NewClient(option.WithAPIKey("sk-test"), option.WithBaseURL(srv.URL), option.WithMaxRetries(0))
+}
+
+func chatParams(model string) openai.ChatCompletionNewParams {
+	return openai.ChatCompletionNewParams{
+		Model:    openai.ChatModel(model),
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("Hi")},
+	}
+}
+
+func TestServerChatCompletion(t *testing.T) {
+	srv := NewServer(WithAPIKey("sk-test"))
+	defer srv.Close()
+	srv.Enqueue(Response{Content: "Hello there", FinishReason: "length", PromptTokens: 12, CompletionTokens: 3, CachedTokens: 2})
+
+	client := newOpenAIClient(srv)
+	resp, err := client.Chat.Completions.New(context.Background(), chatParams("gpt-4o-mini"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "gpt-4o-mini", resp.Model)
+	assert.Equal(t, "Hello there", resp.Choices[0].Message.Content)
+	assert.Equal(t, "length", resp.Choices[0].FinishReason)
+	assert.Equal(t, int64(15), resp.Usage.TotalTokens)
+	assert.Equal(t, int64(2), resp.Usage.PromptTokensDetails.CachedTokens)
+
+	reqs := srv.Requests()
+	require.Len(t, reqs, 1)
+	assert.Equal(t, "gpt-4o-mini", reqs[0].Model)
+	assert.False(t, reqs[0].Azure)
+}
+
+func TestServerStreaming(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	params := chatParams("gpt-4o-mini")
+	params.StreamOptions = openai.ChatCompletionStreamOptionsParam{IncludeUsage: openai.Bool(true)}
+	srv.Enqueue(
+		Response{Content: "one two three", PromptTokens: 8, CompletionTokens: 3},
+		Response{Content: "one two three", PromptTokens: 8, CompletionTokens: 3},
+	)
+
+	var content strings.Builder
+	var usageChunks int
+	client := newOpenAIClient(srv)
+	stream := client.Chat.Completions.NewStreaming(context.Background(), params)
+	for stream.Next() {
+		chunk := stream.Current()
+		if len(chunk.Choices) > 0 {
+			content.WriteString(chunk.Choices[0].Delta.Content)
+		}
+		if chunk.Usage.TotalTokens > 0 {
+			usageChunks++
+			assert.Empty(t, chunk.Choices, "usage is sent in a separate chunk without choices")
+			assert.Equal(t, int64(11), chunk.Usage.TotalTokens)
+		}
+	}
+	require.NoError(t, stream.Err())
+	assert.Equal(t, "one two three", content.String())
+	assert.Equal(t, 1, usageChunks)
+	assert.True(t, srv.Requests()[0].IncludeUsage)
+
+	// Without include_usage no usage chunk is sent
+	params.StreamOptions = openai.ChatCompletionStreamOptionsParam{}
+	stream = client.Chat.Completions.NewStreaming(context.Background(), params)
+	for stream.Next() {
+		assert.Zero(t, stream.Current().Usage.TotalTokens)
+	}
+	require.NoError(t, stream.Err())
+}
+
+func TestServerStreamError(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Enqueue(Response{Content: "one two three", StreamError: "overloaded", StreamErrorAfter: 1})
+
+	var chunks int
+	client := newOpenAIClient(srv)
+	stream := client.Chat.Completions.NewStreaming(context.Background(), chatParams("gpt-4o-mini"))
+	for stream.Next() {
+		chunks++
+	}
+	require.Error(t, stream.Err())
+	assert.Contains(t, stream.Err().Error(), "overloaded")
+	assert.Equal(t, 2, chunks, "role chunk and one content chunk")
+}
+
+func TestServerErrorResponse(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Enqueue(Response{Status: http.StatusTooManyRequests, ErrorMessage: "rate limited"})
+
+	client := newOpenAIClient(srv)
+	_, err := client.Chat.Completions.New(context.Background(), chatParams("gpt-4o-mini"))
+	var apiErr *openai.Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+}
+
+func TestServerAzureDeployment(t *testing.T) {
+	srv := NewServer(WithAPIKey("azure-key"), WithAzureAPIVersions("2024-10-21"))
+	defer srv.Close()
+
+	client := openai.NewClient(azure.WithEndpoint(srv.URL, "2024-10-21"), azure.WithAPIKey("azure-key"), option.WithMaxRetries(0))
+	resp, err := client.Chat.Completions.New(context.Background(), chatParams("my-gpt4o-deployment"))
+	require.NoError(t, err)
+	assert.Equal(t, "my-gpt4o-deployment", resp.Model)
+
+	reqs := srv.Requests()
+	require.Len(t, reqs, 1)
+	assert.True(t, reqs[0].Azure)
+	assert.Equal(t, "my-gpt4o-deployment", reqs[0].Deployment)
+	assert.Equal(t, "2024-10-21", reqs[0].APIVersion)
+
+	wrongVersion := openai.NewClient(azure.WithEndpoint(srv.URL, "2023-01-01"), azure.WithAPIKey("azure-key"), option.WithMaxRetries(0))
+	_, err = wrongVersion.Chat.Completions.New(context.Background(), chatParams("my-gpt4o-deployment"))
+	require.Error(t, err)
+}
+
+func TestServerToolCallsAndRefusal(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	scripted := Response{
+		Content:   "Let me check.",
+		Refusal:   "I can't share that.",
+		ToolCalls: []ToolCall{{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+	}
+	srv.Enqueue(scripted, scripted)
+
+	client := newOpenAIClient(srv)
+	resp, err := client.Chat.Completions.New(context.Background(), chatParams("gpt-4o-mini"))
+	require.NoError(t, err)
+	msg := resp.Choices[0].Message
+	assert.Equal(t, "tool_calls", resp.Choices[0].FinishReason)
+	assert.Equal(t, "I can't share that.", msg.Refusal)
+	require.Len(t, msg.ToolCalls, 1)
+	assert.Equal(t, "call_0", msg.ToolCalls[0].ID)
+	assert.Equal(t, "get_weather", msg.ToolCalls[0].Function.Name)
+	assert.Equal(t, `{"city":"Paris"}`, msg.ToolCalls[0].Function.Arguments)
+
+	// Streamed deltas accumulate to the same message
+	acc := openai.ChatCompletionAccumulator{}
+	stream := client.Chat.Completions.NewStreaming(context.Background(), chatParams("gpt-4o-mini"))
+	for stream.Next() {
+		require.True(t, acc.AddChunk(stream.Current()))
+	}
+	require.NoError(t, stream.Err())
+	msg = acc.Choices[0].Message
+	assert.Equal(t, "Let me check.", msg.Content)
+	assert.Equal(t, "I can't share that.", msg.Refusal)
+	require.Len(t, msg.ToolCalls, 1)
+	assert.Equal(t, "get_weather", msg.ToolCalls[0].Function.Name)
+	assert.Equal(t, `{"city":"Paris"}`, msg.ToolCalls[0].Function.Arguments)
+}
+
+func TestServerMultipleChoices(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	scripted := Response{Choices: []Choice{
+		{Content: "first answer"},
+		{Content: "second, much longer answer", FinishReason: "length"},
+	}}
+	srv.Enqueue(scripted, scripted)
+
+	client := newOpenAIClient(srv)
+	resp, err := client.Chat.Completions.New(context.Background(), chatParams("gpt-4o-mini"))
+	require.NoError(t, err)
+	require.Len(t, resp.Choices, 2)
+	assert.Equal(t, "stop", resp.Choices[0].FinishReason)
+	assert.Equal(t, "length", resp.Choices[1].FinishReason)
+	assert.Equal(t, "second, much longer answer", resp.Choices[1].Message.Content)
+
+	acc := openai.ChatCompletionAccumulator{}
+	stream := client.Chat.Completions.NewStreaming(context.Background(), chatParams("gpt-4o-mini"))
+	for stream.Next() {
+		require.True(t, acc.AddChunk(stream.Current()))
+	}
+	require.NoError(t, stream.Err())
+	require.Len(t, acc.Choices, 2)
+	assert.Equal(t, "first answer", acc.Choices[0].Message.Content)
+	assert.Equal(t, "second, much longer answer", acc.Choices[1].Message.Content)
+	assert.Equal(t, "length", acc.Choices[1].FinishReason)
+}
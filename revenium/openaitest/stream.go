@@ -0,0 +1,242 @@
+package openaitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	completionID = "chatcmpl-openaitest"
+	createdAt    = 1700000000
+)
+
+// usage renders the usage object of a response
+func usage(resp Response) map[string]interface{} {
+	return map[string]interface{}{
+		"prompt_tokens":     resp.PromptTokens,
+		"completion_tokens": resp.CompletionTokens,
+		"total_tokens":      resp.PromptTokens + resp.CompletionTokens,
+		"prompt_tokens_details": map[string]interface{}{
+			"cached_tokens": resp.CachedTokens,
+		},
+		"completion_tokens_details": map[string]interface{}{
+			"reasoning_tokens": resp.ReasoningTokens,
+		},
+	}
+}
+
+// message renders the assistant message of a non-streamed choice
+func message(choice Choice) map[string]interface{} {
+	msg := map[string]interface{}{
+		"role":    "assistant",
+		"content": choice.Content,
+		"refusal": nil,
+	}
+	if choice.Refusal != "" {
+		msg["refusal"] = choice.Refusal
+	}
+	if len(choice.ToolCalls) > 0 {
+		calls := make([]interface{}, len(choice.ToolCalls))
+		for i, call := range choice.ToolCalls {
+			calls[i] = map[string]interface{}{
+				"id":   call.ID,
+				"type": "function",
+				"function": map[string]interface{}{
+					"name":      call.Name,
+					"arguments": call.Arguments,
+				},
+			}
+		}
+		msg["tool_calls"] = calls
+	}
+	return msg
+}
+
+// completion renders a non-streamed chat.completion object
+func completion(resp Response) map[string]interface{} {
+	choices := make([]interface{}, len(resp.Choices))
+	for i, choice := range resp.Choices {
+		choices[i] = map[string]interface{}{
+			"index":         i,
+			"finish_reason": choice.FinishReason,
+			"logprobs":      nil,
+			"message":       message(choice),
+		}
+	}
+
+	body := map[string]interface{}{
+		"id":      completionID,
+		"object":  "chat.completion",
+		"created": createdAt,
+		"model":   resp.Model,
+		"choices": choices,
+	}
+	if resp.SystemFingerprint != "" {
+		body["system_fingerprint"] = resp.SystemFingerprint
+	}
+	if resp.ServiceTier != "" {
+		body["service_tier"] = resp.ServiceTier
+	}
+	if !resp.OmitUsage {
+		body["usage"] = usage(resp)
+	}
+	return body
+}
+
+// chunk renders one chat.completion.chunk object
+func chunk(resp Response, choices []interface{}) map[string]interface{} {
+	body := map[string]interface{}{
+		"id":      completionID,
+		"object":  "chat.completion.chunk",
+		"created": createdAt,
+		"model":   resp.Model,
+		"choices": choices,
+	}
+	if resp.SystemFingerprint != "" {
+		body["system_fingerprint"] = resp.SystemFingerprint
+	}
+	if resp.ServiceTier != "" {
+		body["service_tier"] = resp.ServiceTier
+	}
+	return body
+}
+
+func deltaChoice(index int, delta map[string]interface{}, finishReason interface{}) []interface{} {
+	return []interface{}{
+		map[string]interface{}{
+			"index":         index,
+			"delta":         delta,
+			"finish_reason": finishReason,
+			"logprobs":      nil,
+		},
+	}
+}
+
+// contentChunks splits the content of a choice into the pieces streamed to the
+// client; Response.Chunks applies to a single-choice response
+func contentChunks(resp Response, choice Choice) []string {
+	if len(resp.Chunks) > 0 && len(resp.Choices) == 1 {
+		return resp.Chunks
+	}
+	if choice.Content == "" {
+		return nil
+	}
+	return strings.SplitAfter(choice.Content, " ")
+}
+
+// choiceDeltas returns the deltas streamed for a choice: its content pieces,
+// its refusal, and for each tool call one delta with the id and name followed
+// by the arguments in two pieces
+func choiceDeltas(resp Response, choice Choice) []map[string]interface{} {
+	var deltas []map[string]interface{}
+	for _, piece := range contentChunks(resp, choice) {
+		deltas = append(deltas, map[string]interface{}{"content": piece})
+	}
+	if choice.Refusal != "" {
+		deltas = append(deltas, map[string]interface{}{"refusal": choice.Refusal})
+	}
+	for i, call := range choice.ToolCalls {
+		deltas = append(deltas, map[string]interface{}{"tool_calls": []interface{}{
+			map[string]interface{}{
+				"index":    i,
+				"id":       call.ID,
+				"type":     "function",
+				"function": map[string]interface{}{"name": call.Name, "arguments": ""},
+			},
+		}})
+		half := len(call.Arguments) / 2
+		for _, piece := range []string{call.Arguments[:half], call.Arguments[half:]} {
+			deltas = append(deltas, map[string]interface{}{"tool_calls": []interface{}{
+				map[string]interface{}{"index": i, "function": map[string]interface{}{"arguments": piece}},
+			}})
+		}
+	}
+	return deltas
+}
+
+// stream writes the response as server-sent events: a role chunk per choice,
+// the content, refusal and tool call deltas of the choices interleaved, a
+// finish chunk per choice, an optional usage-only chunk and [DONE]
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, req Request, resp Response) {
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(v interface{}) bool {
+		if resp.Delay > 0 {
+			select {
+			case <-time.After(resp.Delay):
+			case <-r.Context().Done():
+				return false
+			}
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return false
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+	sendError := func() {
+		send(map[string]interface{}{"error": map[string]interface{}{"message": resp.StreamError}})
+	}
+
+	deltas := make([][]map[string]interface{}, len(resp.Choices))
+	rounds := 0
+	for i, choice := range resp.Choices {
+		if !send(chunk(resp, deltaChoice(i, map[string]interface{}{"role": "assistant", "content": ""}, nil))) {
+			return
+		}
+		deltas[i] = choiceDeltas(resp, choice)
+		rounds = max(rounds, len(deltas[i]))
+	}
+
+	sent := 0
+	for round := 0; round < rounds; round++ {
+		for i := range resp.Choices {
+			if round >= len(deltas[i]) {
+				continue
+			}
+			if resp.StreamError != "" && sent == resp.StreamErrorAfter {
+				sendError()
+				return
+			}
+			if !send(chunk(resp, deltaChoice(i, deltas[i][round], nil))) {
+				return
+			}
+			sent++
+		}
+	}
+	if resp.StreamError != "" {
+		sendError()
+		return
+	}
+
+	for i, choice := range resp.Choices {
+		if !send(chunk(resp, deltaChoice(i, map[string]interface{}{}, choice.FinishReason))) {
+			return
+		}
+	}
+
+	if req.IncludeUsage && !resp.OmitUsage {
+		final := chunk(resp, []interface{}{})
+		final["usage"] = usage(resp)
+		if !send(final) {
+			return
+		}
+	}
+
+	_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
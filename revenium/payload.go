@@ -0,0 +1,345 @@
+package revenium
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// OperationType is the kind of AI operation reported to Revenium
+type OperationType string
+
+const (
+	OperationTypeChat      OperationType = "CHAT"
+	OperationTypeGenerate  OperationType = "GENERATE"
+	OperationTypeEmbed     OperationType = "EMBED"
+	OperationTypeClassify  OperationType = "CLASSIFY"
+	OperationTypeSummarize OperationType = "SUMMARIZE"
+	OperationTypeTranslate OperationType = "TRANSLATE"
+	OperationTypeOther     OperationType = "OTHER"
+)
+
+// CostType is the cost category reported to Revenium
+type CostType string
+
+const (
+	CostTypeAI CostType = "AI"
+)
+
+// MeteringPayload is the body sent to the Revenium metering API for one AI call.
+// Optional metadata fields are omitted from the JSON when unset.
+type MeteringPayload struct {
+	// Usage and timing, always set by the middleware
+	StopReason              ReveniumStopReason `json:"stopReason"`
+	CostType                CostType           `json:"costType"`
+	IsStreamed              bool               `json:"isStreamed"`
+	OperationType           OperationType      `json:"operationType"`
+	InputTokenCount         int64              `json:"inputTokenCount"`
+	OutputTokenCount        int64              `json:"outputTokenCount"`
+	ReasoningTokenCount     int64              `json:"reasoningTokenCount"`
+	CacheCreationTokenCount int64              `json:"cacheCreationTokenCount"`
+	CacheReadTokenCount     int64              `json:"cacheReadTokenCount"`
+	TotalTokenCount         int64              `json:"totalTokenCount"`
+	Model                   string             `json:"model"`
+	TransactionID           string             `json:"transactionId"`
+	ResponseTime            string             `json:"responseTime"`
+	RequestDuration         int64              `json:"requestDuration"`
+	Provider                string             `json:"provider"`
+	RequestTime             string             `json:"requestTime"`
+	CompletionStartTime     string             `json:"completionStartTime"`
+	TimeToFirstToken        int64              `json:"timeToFirstToken"`
+	MiddlewareSource        string             `json:"middlewareSource"`
+	SystemFingerprint       string             `json:"systemFingerprint,omitempty"`
+	ErrorReason             string             `json:"errorReason,omitempty"`
+
+	// Choices of a chat completion: ChoiceCount is always set, the per-choice
+	// stop reasons only when there is more than one (n > 1); StopReason is
+	// then derived from them with AggregateStopReason
+	ChoiceCount       int64                `json:"choiceCount,omitempty"`
+	ChoiceStopReasons []ReveniumStopReason `json:"choiceStopReasons,omitempty"`
+
+	// Request parameters, captured from the chat completion request unless set
+	// in usage metadata (Temperature is with the metadata fields below), and
+	// the service tier the provider actually used
+	TopP                 *float64 `json:"topP,omitempty"`
+	MaxCompletionTokens  *int64   `json:"maxCompletionTokens,omitempty"`
+	ReasoningEffort      string   `json:"reasoningEffort,omitempty"`
+	Seed                 *int64   `json:"seed,omitempty"`
+	ResponseFormat       string   `json:"responseFormat,omitempty"`
+	ServiceTierRequested string   `json:"serviceTierRequested,omitempty"`
+	ServiceTier          string   `json:"serviceTier,omitempty"`
+
+	// Tool usage: the tool calls made by the model in all choices, and how the
+	// request let it call tools. OperationSubtype is "function_call" when the
+	// model called tools.
+	OperationSubtype  string   `json:"operationSubtype,omitempty"`
+	ToolCallCount     int64    `json:"toolCallCount,omitempty"`
+	ToolNames         []string `json:"toolNames,omitempty"`
+	ToolChoice        string   `json:"toolChoice,omitempty"`
+	ParallelToolCalls *bool    `json:"parallelToolCalls,omitempty"`
+
+	// TokensEstimated is set when the provider returned no usage and the token
+	// counts were estimated locally
+	TokensEstimated bool `json:"tokensEstimated,omitempty"`
+
+	// FeedbackDetails is the free-form feedback sent with SubmitFeedback
+	FeedbackDetails map[string]interface{} `json:"feedbackDetails,omitempty"`
+
+	// EstimatedCost is the cost of the call in USD, estimated from the token
+	// counts with the local pricing catalog; unset for models without prices
+	EstimatedCost *float64 `json:"estimatedCost,omitempty"`
+
+	// Core tracking fields, from usage metadata
+	OrganizationID       string              `json:"organizationId,omitempty"`
+	ProductID            string              `json:"productId,omitempty"`
+	TaskType             string              `json:"taskType,omitempty"`
+	TaskID               string              `json:"taskId,omitempty"`
+	Agent                string              `json:"agent,omitempty"`
+	SubscriptionID       string              `json:"subscriptionId,omitempty"`
+	TraceID              string              `json:"traceId,omitempty"`
+	Subscriber           *MeteringSubscriber `json:"subscriber,omitempty"`
+	ResponseQualityScore *float64            `json:"responseQualityScore,omitempty"`
+	ModelSource          string              `json:"modelSource,omitempty"`
+	Temperature          *float64            `json:"temperature,omitempty"`
+	MediationLatency     *int64              `json:"mediationLatency,omitempty"`
+
+	// Trace visualization fields (distributed tracing), from usage metadata
+	TraceType           string `json:"traceType,omitempty"`
+	TraceName           string `json:"traceName,omitempty"`
+	Environment         string `json:"environment,omitempty"`
+	Region              string `json:"region,omitempty"`
+	RetryNumber         *int64 `json:"retryNumber,omitempty"`
+	CredentialAlias     string `json:"credentialAlias,omitempty"`
+	ParentTransactionID string `json:"parentTransactionId,omitempty"`
+}
+
+// MeteringSubscriber identifies the end user an AI call is attributed to
+type MeteringSubscriber struct {
+	ID         string              `json:"id,omitempty"`
+	Email      string              `json:"email,omitempty"`
+	Credential *MeteringCredential `json:"credential,omitempty"`
+}
+
+// MeteringCredential names the credential a subscriber used
+type MeteringCredential struct {
+	Name  string `json:"name,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// Validate checks the enum fields and value ranges accepted by the Revenium API
+func (p *MeteringPayload) Validate() error {
+	if !p.StopReason.IsValid() {
+		return NewValidationError(fmt.Sprintf("invalid stopReason %q", p.StopReason), nil)
+	}
+	for _, reason := range p.ChoiceStopReasons {
+		if !reason.IsValid() {
+			return NewValidationError(fmt.Sprintf("invalid choiceStopReasons value %q", reason), nil)
+		}
+	}
+	if !p.OperationType.IsValid() {
+		return NewValidationError(fmt.Sprintf("invalid operationType %q", p.OperationType), nil)
+	}
+	if !p.CostType.IsValid() {
+		return NewValidationError(fmt.Sprintf("invalid costType %q", p.CostType), nil)
+	}
+	if p.InputTokenCount < 0 || p.OutputTokenCount < 0 || p.ReasoningTokenCount < 0 ||
+		p.CacheCreationTokenCount < 0 || p.CacheReadTokenCount < 0 || p.TotalTokenCount < 0 {
+		return NewValidationError("token counts must not be negative", nil)
+	}
+	if p.ResponseQualityScore != nil && !(*p.ResponseQualityScore >= 0 && *p.ResponseQualityScore <= 1) {
+		return NewValidationError(fmt.Sprintf("responseQualityScore %v is outside 0.0-1.0", *p.ResponseQualityScore), nil)
+	}
+	return nil
+}
+
+// IsValid reports whether the stop reason is one of the Revenium enum values
+func (s ReveniumStopReason) IsValid() bool {
+	switch s {
+	case StopReasonEnd, StopReasonEndSequence, StopReasonTimeout, StopReasonTokenLimit,
+		StopReasonCostLimit, StopReasonCompletionLimit, StopReasonError, StopReasonCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsValid reports whether the operation type is one of the Revenium enum values
+func (o OperationType) IsValid() bool {
+	switch o {
+	case OperationTypeChat, OperationTypeGenerate, OperationTypeEmbed, OperationTypeClassify,
+		OperationTypeSummarize, OperationTypeTranslate, OperationTypeOther:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsValid reports whether the cost type is one of the Revenium enum values
+func (c CostType) IsValid() bool {
+	return c == CostTypeAI
+}
+
+// addMetadataToPayload copies the supported usage metadata fields into the payload.
+// Values of the wrong type and unsupported keys are ignored with a log message.
+//
+// NOTE: operationType is fixed (API only accepts: CHAT, GENERATE, EMBED, CLASSIFY, SUMMARIZE, TRANSLATE, OTHER)
+// NOTE: operationSubtype is auto-detected from the tool calls, not user-provided
+func addMetadataToPayload(payload *MeteringPayload, metadata map[string]interface{}) {
+	for key, value := range metadata {
+		if value == nil {
+			continue
+		}
+		switch key {
+		// Core tracking fields
+		case "organizationId":
+			setString(&payload.OrganizationID, key, value)
+		case "productId":
+			setString(&payload.ProductID, key, value)
+		case "taskType":
+			setString(&payload.TaskType, key, value)
+		case "taskId":
+			setString(&payload.TaskID, key, value)
+		case "agent":
+			setString(&payload.Agent, key, value)
+		case "subscriptionId":
+			setString(&payload.SubscriptionID, key, value)
+		case "traceId":
+			setString(&payload.TraceID, key, value)
+		case "transactionId":
+			setString(&payload.TransactionID, key, value)
+		case "subscriber":
+			if subscriber, ok := toSubscriber(value); ok {
+				payload.Subscriber = subscriber
+			} else {
+				warnMetadataType(key, "object with id, email and credential", value)
+			}
+		case "responseQualityScore":
+			setFloat(&payload.ResponseQualityScore, key, value)
+		case "modelSource":
+			setString(&payload.ModelSource, key, value)
+		case "temperature":
+			setFloat(&payload.Temperature, key, value)
+		case "topP":
+			setFloat(&payload.TopP, key, value)
+		case "maxCompletionTokens":
+			setInt(&payload.MaxCompletionTokens, key, value)
+		case "reasoningEffort":
+			setString(&payload.ReasoningEffort, key, value)
+		case "seed":
+			setInt(&payload.Seed, key, value)
+		case "responseFormat":
+			setString(&payload.ResponseFormat, key, value)
+		case "mediationLatency":
+			setInt(&payload.MediationLatency, key, value)
+
+		// Trace visualization fields (distributed tracing)
+		case "traceType":
+			setString(&payload.TraceType, key, value)
+		case "traceName":
+			setString(&payload.TraceName, key, value)
+		case "environment":
+			setString(&payload.Environment, key, value)
+		case "region":
+			setString(&payload.Region, key, value)
+		case "retryNumber":
+			setInt(&payload.RetryNumber, key, value)
+		case "credentialAlias":
+			setString(&payload.CredentialAlias, key, value)
+		case "parentTransactionId":
+			setString(&payload.ParentTransactionID, key, value)
+
+		default:
+			Debug("Ignoring unsupported metadata field %q", key)
+		}
+	}
+}
+
+func warnMetadataType(key, expected string, value interface{}) {
+	Warn("Ignoring metadata field %q: expected %s, got %T", key, expected, value)
+}
+
+func setString(dst *string, key string, value interface{}) {
+	if s, ok := value.(string); ok {
+		*dst = s
+		return
+	}
+	warnMetadataType(key, "string", value)
+}
+
+func setFloat(dst **float64, key string, value interface{}) {
+	if f, ok := toFloat(value); ok {
+		*dst = &f
+		return
+	}
+	warnMetadataType(key, "number", value)
+}
+
+func setInt(dst **int64, key string, value interface{}) {
+	if f, ok := toFloat(value); ok && f == math.Trunc(f) {
+		i := int64(f)
+		*dst = &i
+		return
+	}
+	warnMetadataType(key, "integer", value)
+}
+
+// toFloat converts the numeric types found in metadata maps (including values
+// decoded from JSON and numeric strings) to float64
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// toSubscriber converts a subscriber metadata value (a typed struct or a map
+// with id, email and credential.name/credential.value) to a MeteringSubscriber
+func toSubscriber(value interface{}) (*MeteringSubscriber, bool) {
+	switch v := value.(type) {
+	case *MeteringSubscriber:
+		return v, v != nil
+	case MeteringSubscriber:
+		return &v, true
+	case map[string]interface{}:
+		subscriber := &MeteringSubscriber{}
+		subscriber.ID, _ = v["id"].(string)
+		subscriber.Email, _ = v["email"].(string)
+		switch cred := v["credential"].(type) {
+		case map[string]interface{}:
+			name, _ := cred["name"].(string)
+			credValue, _ := cred["value"].(string)
+			subscriber.Credential = &MeteringCredential{Name: name, Value: credValue}
+		case map[string]string:
+			subscriber.Credential = &MeteringCredential{Name: cred["name"], Value: cred["value"]}
+		}
+		return subscriber, true
+	case map[string]string:
+		return &MeteringSubscriber{ID: v["id"], Email: v["email"]}, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,132 @@
+package revenium
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPayload returns a minimal valid payload with the given transaction ID
+func testPayload(transactionID string) *MeteringPayload {
+	return &MeteringPayload{
+		StopReason:    StopReasonEnd,
+		CostType:      CostTypeAI,
+		OperationType: OperationTypeChat,
+		Model:         "gpt-4o-mini",
+		TransactionID: transactionID,
+	}
+}
+
+func TestMeteringPayloadValidate(t *testing.T) {
+	score := 1.5
+	nan := math.NaN()
+
+	tests := []struct {
+		name    string
+		modify  func(p *MeteringPayload)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(p *MeteringPayload) {}},
+		{name: "unknown stop reason", modify: func(p *MeteringPayload) { p.StopReason = "DONE" }, wantErr: true},
+		{name: "empty stop reason", modify: func(p *MeteringPayload) { p.StopReason = "" }, wantErr: true},
+		{name: "unknown operation type", modify: func(p *MeteringPayload) { p.OperationType = "CHAT_COMPLETION" }, wantErr: true},
+		{name: "unknown cost type", modify: func(p *MeteringPayload) { p.CostType = "COMPUTE" }, wantErr: true},
+		{name: "negative tokens", modify: func(p *MeteringPayload) { p.InputTokenCount = -1 }, wantErr: true},
+		{name: "quality score out of range", modify: func(p *MeteringPayload) { p.ResponseQualityScore = &score }, wantErr: true},
+		{name: "quality score not a number", modify: func(p *MeteringPayload) { p.ResponseQualityScore = &nan }, wantErr: true},
+		{name: "valid choice stop reasons", modify: func(p *MeteringPayload) {
+			p.ChoiceStopReasons = []ReveniumStopReason{StopReasonEnd, StopReasonTokenLimit}
+		}},
+		{name: "unknown choice stop reason", modify: func(p *MeteringPayload) {
+			p.ChoiceStopReasons = []ReveniumStopReason{StopReasonEnd, "length"}
+		}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testPayload("tx-1")
+			tt.modify(p)
+			err := p.Validate()
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.True(t, IsValidationError(err))
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAddMetadataToPayload(t *testing.T) {
+	payload := testPayload("generated")
+	addMetadataToPayload(payload, map[string]interface{}{
+		"organizationId":       "org-1",
+		"transactionId":        "tx-custom",
+		"responseQualityScore": 0.95,
+		"temperature":          float32(0.5),
+		"mediationLatency":     15,
+		"retryNumber":          "2",
+		"subscriber": map[string]interface{}{
+			"id":    "user-1",
+			"email": "user@example.com",
+			"credential": map[string]interface{}{
+				"name":  "key",
+				"value": "key-1",
+			},
+		},
+		"taskType":     42,     // wrong type, ignored
+		"customField1": "x",    // unsupported, ignored
+		"traceName":    nil,    // nil, ignored
+		"region":       "us-1", // trace field
+	})
+
+	assert.Equal(t, "org-1", payload.OrganizationID)
+	assert.Equal(t, "tx-custom", payload.TransactionID)
+	require.NotNil(t, payload.ResponseQualityScore)
+	assert.Equal(t, 0.95, *payload.ResponseQualityScore)
+	require.NotNil(t, payload.Temperature)
+	assert.InDelta(t, 0.5, *payload.Temperature, 1e-6)
+	require.NotNil(t, payload.MediationLatency)
+	assert.Equal(t, int64(15), *payload.MediationLatency)
+	require.NotNil(t, payload.RetryNumber)
+	assert.Equal(t, int64(2), *payload.RetryNumber)
+	assert.Equal(t, &MeteringSubscriber{
+		ID:         "user-1",
+		Email:      "user@example.com",
+		Credential: &MeteringCredential{Name: "key", Value: "key-1"},
+	}, payload.Subscriber)
+	assert.Empty(t, payload.TaskType)
+	assert.Empty(t, payload.TraceName)
+	assert.Equal(t, "us-1", payload.Region)
+}
+
+func TestMeteringPayloadJSON(t *testing.T) {
+	resp := &openai.ChatCompletion{Model: "gpt-4o-mini"}
+	resp.Usage.PromptTokens = 10
+	resp.Usage.CompletionTokens = 5
+	resp.Usage.TotalTokens = 15
+
+	payload := buildMeteringPayload(resp, map[string]interface{}{"organizationId": "org-1"}, false, time.Second, "", time.Now(), nil, 0)
+	require.NoError(t, payload.Validate())
+
+	data, err := json.Marshal(payload)
+	require.NoError(t, err)
+
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+
+	assert.Equal(t, "END", decoded["stopReason"])
+	assert.Equal(t, "AI", decoded["costType"])
+	assert.Equal(t, "CHAT", decoded["operationType"])
+	assert.Equal(t, float64(10), decoded["inputTokenCount"])
+	assert.Equal(t, float64(0), decoded["reasoningTokenCount"], "zero token counts are always sent")
+	assert.Equal(t, "org-1", decoded["organizationId"])
+	assert.NotContains(t, decoded, "errorReason")
+	assert.NotContains(t, decoded, "subscriber")
+	assert.NotContains(t, decoded, "temperature")
+}
@@ -0,0 +1,210 @@
+package revenium
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/openai/openai-go/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultPricingJSON is the built-in price list for OpenAI models
+//
+//go:embed pricing.json
+var defaultPricingJSON []byte
+
+// ModelPricing holds the prices of a model in USD per million tokens. A zero
+// CachedInput is billed as Input and a zero Reasoning as Output.
+type ModelPricing struct {
+	Input       float64 `json:"input" yaml:"input"`
+	CachedInput float64 `json:"cachedInput,omitempty" yaml:"cachedInput,omitempty"`
+	Output      float64 `json:"output,omitempty" yaml:"output,omitempty"`
+	Reasoning   float64 `json:"reasoning,omitempty" yaml:"reasoning,omitempty"`
+}
+
+// PricingEntry prices a model and its dated snapshots in one service tier; an
+// empty ServiceTier is the default tier
+type PricingEntry struct {
+	Model        string `json:"model" yaml:"model"`
+	ServiceTier  string `json:"serviceTier,omitempty" yaml:"serviceTier,omitempty"`
+	ModelPricing `yaml:",inline"`
+}
+
+// pricingFile is the layout of the embedded table and of pricing files
+type pricingFile struct {
+	Models []PricingEntry `json:"models" yaml:"models"`
+}
+
+// PricingCatalog looks up model prices to estimate the cost of a call locally.
+// Models are matched exactly once a snapshot date is stripped, so
+// "gpt-4o-2024-08-06" uses the "gpt-4o" prices but "o3-pro" does not use the
+// "o3" ones; calls to models without prices get no estimate.
+type PricingCatalog struct {
+	mu     sync.RWMutex
+	prices map[string]map[string]ModelPricing // model -> service tier -> pricing
+}
+
+// snapshotSuffix matches the date of a model snapshot: "-2024-08-06", or
+// "-0613" for older models
+var snapshotSuffix = regexp.MustCompile(`-(\d{4}-\d{2}-\d{2}|\d{4})$`)
+
+// NewPricingCatalog creates a catalog holding only the given entries
+func NewPricingCatalog(entries ...PricingEntry) *PricingCatalog {
+	c := &PricingCatalog{prices: make(map[string]map[string]ModelPricing)}
+	for _, entry := range entries {
+		c.Set(entry.Model, entry.ServiceTier, entry.ModelPricing)
+	}
+	return c
+}
+
+// DefaultPricingCatalog creates a catalog holding the built-in OpenAI prices
+func DefaultPricingCatalog() *PricingCatalog {
+	var file pricingFile
+	if err := json.Unmarshal(defaultPricingJSON, &file); err != nil {
+		panic(fmt.Sprintf("revenium: invalid embedded pricing table: %v", err))
+	}
+	return NewPricingCatalog(file.Models...)
+}
+
+// Set adds or replaces the pricing of a model in a service tier
+func (c *PricingCatalog) Set(model, serviceTier string, pricing ModelPricing) {
+	model = pricingModelKey(model)
+	tier := normalizeServiceTier(serviceTier)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.prices[model] == nil {
+		c.prices[model] = make(map[string]ModelPricing)
+	}
+	c.prices[model][tier] = pricing
+}
+
+// LoadFile adds the entries of a JSON or YAML pricing file to the catalog,
+// replacing existing prices for the same model and tier. The format is picked
+// from the file extension, JSON unless it is .yaml or .yml.
+func (c *PricingCatalog) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return NewConfigError("failed to read pricing file", err)
+	}
+
+	var file pricingFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	default:
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return NewConfigError(fmt.Sprintf("invalid pricing file %s", path), err)
+	}
+
+	for i, entry := range file.Models {
+		if entry.Model == "" {
+			return NewConfigError(fmt.Sprintf("invalid pricing file %s: entry %d has no model", path, i), nil)
+		}
+	}
+	for _, entry := range file.Models {
+		c.Set(entry.Model, entry.ServiceTier, entry.ModelPricing)
+	}
+	return nil
+}
+
+// Lookup returns the pricing of a model in a service tier. An empty, "auto" or
+// "default" tier is the default one; a tier the model has no prices for, such
+// as flex for a model only priced in the default tier, is not found, since its
+// prices differ.
+func (c *PricingCatalog) Lookup(model, serviceTier string) (ModelPricing, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	pricing, ok := c.prices[pricingModelKey(model)][normalizeServiceTier(serviceTier)]
+	return pricing, ok
+}
+
+// Cost estimates the cost in USD of a chat completion's usage, or returns
+// false if the model has no known prices
+func (c *PricingCatalog) Cost(model, serviceTier string, usage openai.CompletionUsage) (float64, bool) {
+	return c.cost(model, serviceTier, usage.PromptTokens, usage.PromptTokensDetails.CachedTokens,
+		usage.CompletionTokens, usage.CompletionTokensDetails.ReasoningTokens)
+}
+
+// cost prices token counts; cached tokens are part of the input tokens and
+// reasoning tokens part of the output tokens, as OpenAI reports them
+func (c *PricingCatalog) cost(model, serviceTier string, input, cachedInput, output, reasoning int64) (float64, bool) {
+	pricing, ok := c.Lookup(model, serviceTier)
+	if !ok {
+		return 0, false
+	}
+
+	cachedPrice := pricing.CachedInput
+	if cachedPrice == 0 {
+		cachedPrice = pricing.Input
+	}
+	reasoningPrice := pricing.Reasoning
+	if reasoningPrice == 0 {
+		reasoningPrice = pricing.Output
+	}
+
+	cachedInput = min(cachedInput, input)
+	reasoning = min(reasoning, output)
+	total := float64(input-cachedInput)*pricing.Input +
+		float64(cachedInput)*cachedPrice +
+		float64(output-reasoning)*pricing.Output +
+		float64(reasoning)*reasoningPrice
+	return total / 1_000_000, true
+}
+
+// apply sets the estimated cost of a payload from its token counts, unless it
+// is already set, the event carries feedback rather than an AI call or the
+// model has no known prices
+func (c *PricingCatalog) apply(payload *MeteringPayload) {
+	if c == nil || payload.EstimatedCost != nil || payload.OperationSubtype == OperationSubtypeFeedback {
+		return
+	}
+	tier := payload.ServiceTier
+	if tier == "" {
+		tier = payload.ServiceTierRequested
+	}
+	cost, ok := c.cost(payload.Model, tier, payload.InputTokenCount, payload.CacheReadTokenCount,
+		payload.OutputTokenCount, payload.ReasoningTokenCount)
+	if !ok {
+		return
+	}
+	payload.EstimatedCost = &cost
+}
+
+// pricingModelKey is the catalog key of a model: lower case, without a snapshot date
+func pricingModelKey(model string) string {
+	return snapshotSuffix.ReplaceAllString(strings.ToLower(model), "")
+}
+
+// normalizeServiceTier maps the tiers billed at standard prices to the default tier
+func normalizeServiceTier(tier string) string {
+	switch tier = strings.ToLower(tier); tier {
+	case "auto", "default", "standard":
+		return ""
+	}
+	return tier
+}
+
+// newConfiguredPricing builds the catalog of a client: the built-in prices,
+// then the pricing file, then the prices set in code
+func newConfiguredPricing(cfg *Config) *PricingCatalog {
+	catalog := DefaultPricingCatalog()
+	if cfg.PricingFile != "" {
+		if err := catalog.LoadFile(cfg.PricingFile); err != nil {
+			Warn("Pricing file not loaded, using built-in prices: %v", err)
+		}
+	}
+	for _, entry := range cfg.ModelPricing {
+		catalog.Set(entry.Model, entry.ServiceTier, entry.ModelPricing)
+	}
+	return catalog
+}
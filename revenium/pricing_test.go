@@ -0,0 +1,129 @@
+package revenium
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultPricingCatalogLookup(t *testing.T) {
+	catalog := DefaultPricingCatalog()
+
+	tests := []struct {
+		name        string
+		model       string
+		serviceTier string
+		expected    ModelPricing
+		found       bool
+	}{
+		{name: "exact model", model: "gpt-4o", expected: ModelPricing{Input: 2.50, CachedInput: 1.25, Output: 10.00}, found: true},
+		{name: "dated snapshot", model: "gpt-4o-mini-2024-07-18", expected: ModelPricing{Input: 0.15, CachedInput: 0.075, Output: 0.60}, found: true},
+		{name: "case insensitive", model: "GPT-4o", expected: ModelPricing{Input: 2.50, CachedInput: 1.25, Output: 10.00}, found: true},
+		{name: "flex tier", model: "o3", serviceTier: "flex", expected: ModelPricing{Input: 1.00, CachedInput: 0.25, Output: 4.00}, found: true},
+		{name: "default tier", model: "o3", serviceTier: "default", expected: ModelPricing{Input: 2.00, CachedInput: 0.50, Output: 8.00}, found: true},
+		{name: "auto tier", model: "o3", serviceTier: "auto", expected: ModelPricing{Input: 2.00, CachedInput: 0.50, Output: 8.00}, found: true},
+		{name: "priority tier without prices", model: "gpt-4-turbo", serviceTier: "priority", found: false},
+		{name: "flex tier without prices", model: "gpt-4o", serviceTier: "flex", found: false},
+		{name: "legacy snapshot", model: "gpt-4-0613", expected: ModelPricing{Input: 30.00, Output: 60.00}, found: true},
+		{name: "unknown model", model: "my-deployment", found: false},
+		{name: "unpriced variant of a priced model", model: "o3-pro", found: false},
+		{name: "unpriced dated variant", model: "o1-pro-2025-03-19", found: false},
+		{name: "unpriced model sharing a prefix", model: "gpt-4.5-preview", found: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pricing, ok := catalog.Lookup(tt.model, tt.serviceTier)
+			assert.Equal(t, tt.found, ok)
+			assert.Equal(t, tt.expected, pricing)
+		})
+	}
+}
+
+func TestPricingCatalogCost(t *testing.T) {
+	catalog := NewPricingCatalog(
+		PricingEntry{Model: "reasoner", ModelPricing: ModelPricing{Input: 2, CachedInput: 0.5, Output: 8, Reasoning: 16}},
+		PricingEntry{Model: "plain", ModelPricing: ModelPricing{Input: 1, Output: 2}},
+	)
+
+	usage := openai.CompletionUsage{PromptTokens: 1000, CompletionTokens: 500}
+	usage.PromptTokensDetails.CachedTokens = 400
+	usage.CompletionTokensDetails.ReasoningTokens = 200
+
+	// 600*2 + 400*0.5 + 300*8 + 200*16 per million tokens
+	cost, ok := catalog.Cost("reasoner", "", usage)
+	require.True(t, ok)
+	assert.InDelta(t, 0.007, cost, 1e-12)
+
+	// Cached and reasoning tokens are billed at the input and output prices when unpriced
+	cost, ok = catalog.Cost("plain", "", usage)
+	require.True(t, ok)
+	assert.InDelta(t, 0.002, cost, 1e-12)
+
+	_, ok = catalog.Cost("unknown", "", usage)
+	assert.False(t, ok)
+}
+
+func TestPricingCatalogLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "pricing.json")
+	require.NoError(t, os.WriteFile(jsonPath, []byte(`{"models": [{"model": "gpt-4o", "input": 2, "output": 9}]}`), 0o600))
+	yamlPath := filepath.Join(dir, "pricing.yaml")
+	require.NoError(t, os.WriteFile(yamlPath, []byte("models:\n  - model: my-deployment\n    serviceTier: priority\n    input: 3\n    cachedInput: 1\n    output: 12\n"), 0o600))
+
+	catalog := DefaultPricingCatalog()
+	require.NoError(t, catalog.LoadFile(jsonPath))
+	require.NoError(t, catalog.LoadFile(yamlPath))
+
+	pricing, ok := catalog.Lookup("gpt-4o", "")
+	require.True(t, ok)
+	assert.Equal(t, ModelPricing{Input: 2, Output: 9}, pricing)
+
+	pricing, ok = catalog.Lookup("my-deployment", "priority")
+	require.True(t, ok)
+	assert.Equal(t, ModelPricing{Input: 3, CachedInput: 1, Output: 12}, pricing)
+	_, ok = catalog.Lookup("my-deployment", "")
+	assert.False(t, ok)
+
+	// Other built-in prices are kept
+	_, ok = catalog.Lookup("gpt-4o-mini", "")
+	assert.True(t, ok)
+}
+
+func TestPricingCatalogLoadFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	require.NoError(t, os.WriteFile(invalid, []byte(`{"models": [`), 0o600))
+	noModel := filepath.Join(dir, "no-model.yml")
+	require.NoError(t, os.WriteFile(noModel, []byte("models:\n  - model: gpt-4o\n    input: 1\n  - input: 2\n"), 0o600))
+
+	catalog := DefaultPricingCatalog()
+	for _, path := range []string{filepath.Join(dir, "missing.json"), invalid, noModel} {
+		err := catalog.LoadFile(path)
+		require.Error(t, err, path)
+		assert.True(t, IsConfigError(err))
+	}
+
+	// A rejected file leaves the catalog unchanged
+	pricing, _ := catalog.Lookup("gpt-4o", "")
+	assert.Equal(t, 2.50, pricing.Input)
+}
+
+func TestConfiguredPricingPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pricing.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"models": [{"model": "gpt-4o", "input": 2, "output": 9}, {"model": "gpt-4.1", "input": 1, "output": 3}]}`), 0o600))
+
+	cfg := &Config{}
+	WithPricingFile(path)(cfg)
+	WithModelPricing("gpt-4o", "", ModelPricing{Input: 1, Output: 1})(cfg)
+	catalog := newConfiguredPricing(cfg)
+
+	pricing, _ := catalog.Lookup("gpt-4o", "")
+	assert.Equal(t, ModelPricing{Input: 1, Output: 1}, pricing, "code overrides the file")
+	pricing, _ = catalog.Lookup("gpt-4.1", "")
+	assert.Equal(t, ModelPricing{Input: 1, Output: 3}, pricing, "the file overrides the built-in prices")
+}
@@ -0,0 +1,487 @@
+package revenium
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy controls what happens when the metering queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowBlock blocks the caller until a worker frees space in the queue
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropOldest discards the oldest queued event to make room for the new one
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowDropNewest discards the new event and keeps the queue unchanged
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+)
+
+const (
+	defaultMeteringWorkers   = 4
+	defaultMeteringQueueSize = 1000
+	defaultOverflowPolicy    = OverflowDropNewest
+	defaultMeteringBatchSize = 100
+	defaultBatchLinger       = time.Second
+
+	// dropWarnInterval is the minimum time between warnings about a full queue
+	dropWarnInterval = 10 * time.Second
+
+	// abandonGrace is how long shutdown waits, once its deadline has expired, for
+	// the workers to return from cancelled deliveries
+	abandonGrace = 100 * time.Millisecond
+)
+
+// IsValid reports whether the policy is one of the supported values
+func (p OverflowPolicy) IsValid() bool {
+	switch p {
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest:
+		return true
+	default:
+		return false
+	}
+}
+
+// MeteringStats is a snapshot of the metering queue counters
+type MeteringStats struct {
+	// Enqueued is the number of events accepted into the queue
+	Enqueued int64
+	// Delivered is the number of events successfully sent to Revenium
+	Delivered int64
+	// Failed is the number of events that could not be delivered after retries,
+	// including payloads rejected by validation before being queued
+	Failed int64
+	// Dropped is the number of events discarded by the overflow policy or after Shutdown
+	Dropped int64
+	// Pending is the number of events queued or in flight
+	Pending int64
+	// Abandoned is the number of events still undelivered when a Shutdown deadline expired
+	Abandoned int64
+}
+
+// batchDeliverer sends a batch of payloads and returns one error (or nil) per payload.
+// ctx is cancelled when a shutdown deadline expires.
+type batchDeliverer func(ctx context.Context, batch []*MeteringPayload) []error
+
+// meteringEvent is a queued payload together with its spool file, if it was
+// spooled, and the result of the call awaiting its delivery outcome, if any
+type meteringEvent struct {
+	payload   *MeteringPayload
+	spoolFile string
+	result    *MeteredResult
+}
+
+// meteringQueue is a bounded channel drained by a fixed pool of workers.
+// Each worker coalesces up to batchSize events, waiting at most linger for a batch to fill.
+// The workers stop when the queue is stopped or shut down; enqueue starts them
+// again after stop.
+type meteringQueue struct {
+	events      chan meteringEvent
+	policy      OverflowPolicy
+	batchSize   int
+	linger      time.Duration
+	deliver     batchDeliverer
+	settle      func(ev meteringEvent, err error) // optional, called once per delivered, failed, dropped or abandoned event
+	workerCount int
+
+	mu      sync.RWMutex // guards closed, running, quit and sends on events
+	closed  bool
+	running bool
+	quit    chan struct{} // closed by stop to make the running workers drain the queue and exit
+	workers sync.WaitGroup
+
+	// closing is closed when shutdown starts, releasing producers blocked on a
+	// full queue so they give up their read lock
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	// pending counts events queued or in flight; idle is signalled when it reaches zero
+	pendingMu sync.Mutex
+	idle      *sync.Cond
+	pending   int64
+
+	// ctx is passed to deliveries and cancelled once a shutdown deadline expires;
+	// from then on workers set remaining events aside in abandonedEvents
+	ctx             context.Context
+	cancel          context.CancelFunc
+	abandoning      atomic.Bool
+	abandonMu       sync.Mutex
+	abandonedEvents []meteringEvent
+
+	enqueued  atomic.Int64
+	delivered atomic.Int64
+	failed    atomic.Int64
+	dropped   atomic.Int64
+	abandoned atomic.Int64
+
+	lastDropWarn atomic.Int64 // unix nanoseconds of the last full-queue warning
+}
+
+// newMeteringQueue creates a queue and starts its workers. Non-positive sizes and
+// unknown policies fall back to the defaults; a batchSize of 1 or less disables batching.
+func newMeteringQueue(workers, size, batchSize int, linger time.Duration, policy OverflowPolicy, deliver batchDeliverer, settle func(ev meteringEvent, err error)) *meteringQueue {
+	if workers <= 0 {
+		workers = defaultMeteringWorkers
+	}
+	if size <= 0 {
+		size = defaultMeteringQueueSize
+	}
+	if !policy.IsValid() {
+		if policy != "" {
+			Warn("Unknown metering overflow policy %q, using %q", policy, defaultOverflowPolicy)
+		}
+		policy = defaultOverflowPolicy
+	}
+	if batchSize <= 1 {
+		batchSize = 1
+	}
+	if linger <= 0 {
+		linger = defaultBatchLinger
+	}
+
+	q := &meteringQueue{
+		events:      make(chan meteringEvent, size),
+		policy:      policy,
+		batchSize:   batchSize,
+		linger:      linger,
+		deliver:     deliver,
+		settle:      settle,
+		workerCount: workers,
+		closing:     make(chan struct{}),
+	}
+	q.idle = sync.NewCond(&q.pendingMu)
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+
+	q.start()
+	return q
+}
+
+// start starts the workers; q.mu must be held for writing, or not yet shared
+func (q *meteringQueue) start() {
+	q.running = true
+	q.quit = make(chan struct{})
+	q.workers.Add(q.workerCount)
+	for i := 0; i < q.workerCount; i++ {
+		go q.run(q.quit)
+	}
+}
+
+// run delivers events until the queue is shut down, or until quit is closed
+// and the events left in the queue are delivered
+func (q *meteringQueue) run(quit <-chan struct{}) {
+	defer q.workers.Done()
+
+	var batch []meteringEvent
+	timer := time.NewTimer(q.linger)
+	stopTimer(timer)
+
+	add := func(ev meteringEvent) {
+		batch = append(batch, ev)
+		if len(batch) == 1 && q.batchSize > 1 {
+			timer.Reset(q.linger)
+		}
+		if len(batch) >= q.batchSize {
+			stopTimer(timer)
+			q.process(batch)
+			batch = nil
+		}
+	}
+
+	for {
+		select {
+		case ev, ok := <-q.events:
+			if !ok {
+				stopTimer(timer)
+				q.process(batch)
+				return
+			}
+			add(ev)
+		case <-timer.C:
+			q.process(batch)
+			batch = nil
+		case <-quit:
+			for {
+				select {
+				case ev, ok := <-q.events:
+					if ok {
+						add(ev)
+						continue
+					}
+				default:
+				}
+				stopTimer(timer)
+				q.process(batch)
+				return
+			}
+		}
+	}
+}
+
+// stopTimer stops t and drains its channel so it can be safely reset
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+func (q *meteringQueue) process(batch []meteringEvent) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if q.abandoning.Load() {
+		q.abandon(batch...)
+		return
+	}
+
+	payloads := make([]*MeteringPayload, len(batch))
+	for i, ev := range batch {
+		payloads[i] = ev.payload
+	}
+
+	errs := q.deliver(q.ctx, payloads)
+	for i, ev := range batch {
+		var err error
+		if i < len(errs) {
+			err = errs[i]
+		}
+		if err != nil && q.abandoning.Load() {
+			// Delivery was cut short by the shutdown deadline
+			q.abandon(ev)
+			continue
+		}
+		if err != nil {
+			q.failed.Add(1)
+		} else {
+			q.delivered.Add(1)
+		}
+		q.settleEvent(ev, err)
+		q.donePending()
+	}
+}
+
+// enqueue adds an event according to the overflow policy. It returns false if
+// the event was dropped.
+func (q *meteringQueue) enqueue(ev meteringEvent) bool {
+	q.mu.RLock()
+	for !q.closed && !q.running {
+		q.mu.RUnlock()
+		q.mu.Lock()
+		if !q.closed && !q.running {
+			q.start()
+		}
+		q.mu.Unlock()
+		q.mu.RLock()
+	}
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		q.dropClosed(ev)
+		return false
+	}
+
+	q.addPending()
+
+	switch q.policy {
+	case OverflowBlock:
+		select {
+		case q.events <- ev:
+			q.enqueued.Add(1)
+			return true
+		case <-q.closing:
+			q.donePending()
+			q.dropClosed(ev)
+			return false
+		}
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case q.events <- ev:
+				q.enqueued.Add(1)
+				return true
+			default:
+			}
+			select {
+			case oldest := <-q.events:
+				q.markDropped(oldest)
+				Debug("Metering queue full, dropped oldest event")
+			default:
+			}
+		}
+
+	default:
+		select {
+		case q.events <- ev:
+			q.enqueued.Add(1)
+			return true
+		default:
+			q.markDropped(ev)
+			Debug("Metering queue full, dropped newest event")
+			return false
+		}
+	}
+}
+
+// dropClosed rejects an event offered after shutdown started
+func (q *meteringQueue) dropClosed(ev meteringEvent) {
+	q.dropped.Add(1)
+	Warn("Metering queue is closed, dropping event")
+	q.settleEvent(ev, NewMeteringError("metering event dropped: queue is closed", nil))
+}
+
+// markDropped accounts for an event that was accepted into pending but never delivered
+func (q *meteringQueue) markDropped(ev meteringEvent) {
+	dropped := q.dropped.Add(1)
+	q.warnDropped(dropped)
+	q.settleEvent(ev, NewMeteringError("metering event dropped: queue is full", nil))
+	q.donePending()
+}
+
+// warnDropped warns that the queue is dropping events, at most once per
+// dropWarnInterval so that an outage does not flood the log
+func (q *meteringQueue) warnDropped(dropped int64) {
+	now := time.Now().UnixNano()
+	last := q.lastDropWarn.Load()
+	if last != 0 && now-last < int64(dropWarnInterval) {
+		return
+	}
+	if !q.lastDropWarn.CompareAndSwap(last, now) {
+		return
+	}
+	Warn("Metering queue is full (%s policy), %d events dropped so far; raise the queue size or worker count", q.policy, dropped)
+}
+
+// settleEvent reports the outcome of an event to the settle hook and its result
+func (q *meteringQueue) settleEvent(ev meteringEvent, err error) {
+	if q.settle != nil {
+		q.settle(ev, err)
+	}
+	ev.result.resolve(err)
+}
+
+// markInvalid accounts for a payload rejected before it was queued
+func (q *meteringQueue) markInvalid() {
+	q.failed.Add(1)
+}
+
+func (q *meteringQueue) addPending() {
+	q.pendingMu.Lock()
+	q.pending++
+	q.pendingMu.Unlock()
+}
+
+func (q *meteringQueue) donePending() {
+	q.pendingMu.Lock()
+	q.pending--
+	if q.pending == 0 {
+		q.idle.Broadcast()
+	}
+	q.pendingMu.Unlock()
+}
+
+// flush blocks until every accepted event has been delivered, failed or dropped.
+// With batching enabled this may take up to the linger interval.
+func (q *meteringQueue) flush() {
+	q.pendingMu.Lock()
+	for q.pending > 0 {
+		q.idle.Wait()
+	}
+	q.pendingMu.Unlock()
+}
+
+// abandon sets events aside for the shutdown hook instead of delivering them
+func (q *meteringQueue) abandon(events ...meteringEvent) {
+	q.abandonMu.Lock()
+	q.abandonedEvents = append(q.abandonedEvents, events...)
+	q.abandonMu.Unlock()
+
+	for _, ev := range events {
+		q.abandoned.Add(1)
+		q.settleEvent(ev, NewMeteringError("metering event abandoned at shutdown", nil))
+		q.donePending()
+	}
+}
+
+// stop waits for the workers to deliver every queued event and exit. The queue
+// stays usable: the next enqueue starts the workers again.
+func (q *meteringQueue) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || !q.running {
+		return
+	}
+	q.running = false
+	close(q.quit)
+	q.workers.Wait()
+}
+
+// close drains the queue, stops the workers and rejects further events
+func (q *meteringQueue) close() {
+	q.shutdown(context.Background())
+}
+
+// shutdown rejects further events, including those of producers blocked on a
+// full queue, and lets the workers drain the queue until ctx is done. It then
+// cancels in-flight deliveries, waits up to abandonGrace for the workers to set
+// the remaining events aside, and returns the events that were not delivered.
+// Events still queued behind workers stuck in a delivery that ignores the
+// cancellation are abandoned by shutdown itself; the stuck deliveries are not
+// waited for, and their events are settled when they return.
+func (q *meteringQueue) shutdown(ctx context.Context) []meteringEvent {
+	q.closingOnce.Do(func() { close(q.closing) })
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		q.abandoning.Store(true)
+		q.cancel()
+		select {
+		case <-done:
+		case <-time.After(abandonGrace):
+			Warn("Metering deliveries did not stop when cancelled, not waiting for them")
+			for ev := range q.events {
+				q.abandon(ev)
+			}
+		}
+	}
+	q.cancel()
+
+	q.abandonMu.Lock()
+	defer q.abandonMu.Unlock()
+	abandoned := q.abandonedEvents
+	q.abandonedEvents = nil
+	return abandoned
+}
+
+func (q *meteringQueue) stats() MeteringStats {
+	q.pendingMu.Lock()
+	pending := q.pending
+	q.pendingMu.Unlock()
+
+	return MeteringStats{
+		Enqueued:  q.enqueued.Load(),
+		Delivered: q.delivered.Load(),
+		Failed:    q.failed.Load(),
+		Dropped:   q.dropped.Load(),
+		Pending:   pending,
+		Abandoned: q.abandoned.Load(),
+	}
+}
@@ -0,0 +1,308 @@
+package revenium
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingDeliverer records delivered payload ids and blocks until released
+type blockingDeliverer struct {
+	mu        sync.Mutex
+	delivered []string
+	started   chan struct{}
+	release   chan struct{}
+}
+
+func newBlockingDeliverer() *blockingDeliverer {
+	return &blockingDeliverer{
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+}
+
+func (d *blockingDeliverer) deliver(payload *MeteringPayload) error {
+	d.started <- struct{}{}
+	<-d.release
+	d.mu.Lock()
+	d.delivered = append(d.delivered, payload.TransactionID)
+	d.mu.Unlock()
+	return nil
+}
+
+// eachPayload adapts a single-payload function to a batchDeliverer
+func eachPayload(deliver func(payload *MeteringPayload) error) batchDeliverer {
+	return func(ctx context.Context, batch []*MeteringPayload) []error {
+		errs := make([]error, len(batch))
+		for i, payload := range batch {
+			errs[i] = deliver(payload)
+		}
+		return errs
+	}
+}
+
+func TestMeteringQueueDeliversAndFlushes(t *testing.T) {
+	var mu sync.Mutex
+	count := 0
+	q := newMeteringQueue(2, 10, 1, 0, OverflowBlock, eachPayload(func(payload *MeteringPayload) error {
+		mu.Lock()
+		count++
+		mu.Unlock()
+		return nil
+	}), nil)
+
+	for i := 0; i < 25; i++ {
+		assert.True(t, q.enqueue(meteringEvent{payload: &MeteringPayload{}}))
+	}
+	q.flush()
+
+	assert.Equal(t, 25, count)
+	stats := q.stats()
+	assert.Equal(t, int64(25), stats.Enqueued)
+	assert.Equal(t, int64(25), stats.Delivered)
+	assert.Equal(t, int64(0), stats.Pending)
+	q.close()
+}
+
+func TestMeteringQueueDropNewest(t *testing.T) {
+	d := newBlockingDeliverer()
+	q := newMeteringQueue(1, 1, 1, 0, OverflowDropNewest, eachPayload(d.deliver), nil)
+
+	assert.True(t, q.enqueue(meteringEvent{payload: testPayload("a")}))
+	<-d.started
+	assert.True(t, q.enqueue(meteringEvent{payload: testPayload("b")}))
+	assert.False(t, q.enqueue(meteringEvent{payload: testPayload("c")}))
+
+	close(d.release)
+	q.flush()
+
+	assert.Equal(t, []string{"a", "b"}, d.delivered)
+	assert.Equal(t, int64(1), q.stats().Dropped)
+	q.close()
+}
+
+// warningCounter counts warnings and discards everything else
+type warningCounter struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (l *warningCounter) Debug(string, ...interface{}) {}
+func (l *warningCounter) Info(string, ...interface{})  {}
+func (l *warningCounter) Error(string, ...interface{}) {}
+func (l *warningCounter) Warn(string, ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count++
+}
+
+func TestMeteringQueueWarnsOncePerDropBurst(t *testing.T) {
+	logger := &warningCounter{}
+	previous := GetLogger()
+	SetLogger(logger)
+	defer SetLogger(previous)
+
+	d := newBlockingDeliverer()
+	q := newMeteringQueue(1, 1, 1, 0, OverflowDropNewest, eachPayload(d.deliver), nil)
+
+	q.enqueue(meteringEvent{payload: testPayload("a")})
+	<-d.started
+	q.enqueue(meteringEvent{payload: testPayload("b")})
+	for i := 0; i < 5; i++ {
+		assert.False(t, q.enqueue(meteringEvent{payload: testPayload("dropped")}))
+	}
+
+	logger.mu.Lock()
+	assert.Equal(t, 1, logger.count, "drops are warned about once per interval")
+	logger.mu.Unlock()
+	assert.Equal(t, int64(5), q.stats().Dropped)
+
+	close(d.release)
+	q.close()
+}
+
+func TestMeteringQueueDropOldest(t *testing.T) {
+	d := newBlockingDeliverer()
+	q := newMeteringQueue(1, 1, 1, 0, OverflowDropOldest, eachPayload(d.deliver), nil)
+
+	assert.True(t, q.enqueue(meteringEvent{payload: testPayload("a")}))
+	<-d.started
+	assert.True(t, q.enqueue(meteringEvent{payload: testPayload("b")}))
+	assert.True(t, q.enqueue(meteringEvent{payload: testPayload("c")}))
+
+	close(d.release)
+	q.flush()
+
+	assert.Equal(t, []string{"a", "c"}, d.delivered)
+	assert.Equal(t, int64(1), q.stats().Dropped)
+	q.close()
+}
+
+func TestMeteringQueueRejectsAfterClose(t *testing.T) {
+	q := newMeteringQueue(1, 1, 1, 0, OverflowBlock, eachPayload(func(payload *MeteringPayload) error { return nil }), nil)
+	q.close()
+
+	assert.False(t, q.enqueue(meteringEvent{payload: &MeteringPayload{}}))
+	assert.Equal(t, int64(1), q.stats().Dropped)
+}
+
+func TestNewMeteringQueueDefaults(t *testing.T) {
+	q := newMeteringQueue(0, 0, 0, 0, "bogus", eachPayload(func(payload *MeteringPayload) error { return nil }), nil)
+	defer q.close()
+
+	assert.Equal(t, defaultMeteringQueueSize, cap(q.events))
+	assert.Equal(t, defaultOverflowPolicy, q.policy)
+	assert.Equal(t, 1, q.batchSize)
+	assert.Equal(t, defaultBatchLinger, q.linger)
+}
+
+func TestMeteringQueueBatchesBySizeAndLinger(t *testing.T) {
+	var mu sync.Mutex
+	var sizes []int
+	q := newMeteringQueue(1, 10, 3, 20*time.Millisecond, OverflowBlock, func(ctx context.Context, batch []*MeteringPayload) []error {
+		mu.Lock()
+		sizes = append(sizes, len(batch))
+		mu.Unlock()
+		return []error{nil, errors.New("rejected")}
+	}, nil)
+	defer q.close()
+
+	for i := 0; i < 4; i++ {
+		q.enqueue(meteringEvent{payload: &MeteringPayload{}})
+	}
+	q.flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []int{3, 1}, sizes)
+	stats := q.stats()
+	assert.Equal(t, int64(3), stats.Delivered)
+	assert.Equal(t, int64(1), stats.Failed)
+}
+
+// stalledSink blocks every Send until its context is cancelled
+type stalledSink struct{}
+
+func (stalledSink) Send(ctx context.Context, payload *MeteringPayload) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestShutdownAbandonsEventsAtDeadline(t *testing.T) {
+	var abandoned []string
+	r, err := NewReveniumOpenAI(&Config{
+		Sink:            stalledSink{},
+		MeteringWorkers: 1,
+		OnAbandonedMetering: func(payloads []*MeteringPayload) {
+			for _, p := range payloads {
+				abandoned = append(abandoned, p.TransactionID)
+			}
+		},
+	})
+	require.NoError(t, err)
+
+	for _, id := range []string{"tx-1", "tx-2", "tx-3"} {
+		r.enqueueMetering(context.Background(), testPayload(id))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = r.Shutdown(ctx)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	assert.ElementsMatch(t, []string{"tx-1", "tx-2", "tx-3"}, abandoned)
+	stats := r.MeteringStats()
+	assert.Equal(t, int64(3), stats.Abandoned)
+	assert.Equal(t, int64(0), stats.Pending)
+
+	r.enqueueMetering(context.Background(), testPayload("tx-4"))
+	assert.Equal(t, int64(1), r.MeteringStats().Dropped, "events after Shutdown are dropped")
+}
+
+func TestShutdownReleasesBlockedProducers(t *testing.T) {
+	q := newMeteringQueue(1, 1, 1, 0, OverflowBlock, func(ctx context.Context, batch []*MeteringPayload) []error {
+		<-ctx.Done()
+		return []error{ctx.Err()}
+	}, nil)
+
+	q.enqueue(meteringEvent{payload: testPayload("tx-1")})
+	q.enqueue(meteringEvent{payload: testPayload("tx-2")})
+	blocked := make(chan bool)
+	go func() { blocked <- q.enqueue(meteringEvent{payload: testPayload("tx-3")}) }()
+	require.Eventually(t, func() bool { return q.stats().Pending == 3 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	abandoned := q.shutdown(ctx)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.False(t, <-blocked, "the blocked producer's event is dropped")
+	assert.Len(t, abandoned, 2)
+	stats := q.stats()
+	assert.Equal(t, int64(1), stats.Dropped)
+	assert.Equal(t, int64(0), stats.Pending)
+}
+
+func TestShutdownDoesNotWaitForDeliveriesIgnoringCancellation(t *testing.T) {
+	release := make(chan struct{})
+	q := newMeteringQueue(1, 10, 1, 0, OverflowBlock, func(ctx context.Context, batch []*MeteringPayload) []error {
+		<-release
+		return []error{nil}
+	}, nil)
+	defer close(release)
+
+	q.enqueue(meteringEvent{payload: testPayload("tx-1")})
+	q.enqueue(meteringEvent{payload: testPayload("tx-2")})
+	require.Eventually(t, func() bool { return len(q.events) == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	abandoned := q.shutdown(ctx)
+	assert.Less(t, time.Since(start), time.Second)
+	require.Len(t, abandoned, 1, "the queued event is abandoned, the stuck one is not waited for")
+	assert.Equal(t, "tx-2", abandoned[0].payload.TransactionID)
+}
+
+func TestCloseFlushesAndKeepsMetering(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewReveniumOpenAI(&Config{Sink: sink, MeteringBatchEnabled: true, MeteringBatchLinger: time.Hour})
+	require.NoError(t, err)
+
+	r.enqueueMetering(context.Background(), testPayload("tx-1"))
+	require.NoError(t, r.Close())
+	assert.Len(t, sink.Payloads(), 1, "Close delivers a batch still lingering")
+	assert.False(t, r.queue.running, "Close stops the workers")
+
+	r.enqueueMetering(context.Background(), testPayload("tx-2"))
+	require.NoError(t, r.Close())
+	assert.Len(t, sink.Payloads(), 2, "events after Close are still metered")
+	assert.Equal(t, int64(0), r.MeteringStats().Dropped)
+	require.NoError(t, r.Shutdown(context.Background()))
+}
+
+func TestShutdownDrainsBeforeDeadline(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewReveniumOpenAI(&Config{Sink: sink})
+	require.NoError(t, err)
+
+	r.enqueueMetering(context.Background(), testPayload("tx-1"))
+	r.enqueueMetering(context.Background(), testPayload("tx-2"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, r.Shutdown(ctx))
+	assert.Len(t, sink.Payloads(), 2)
+	assert.Equal(t, int64(0), r.MeteringStats().Abandoned)
+}
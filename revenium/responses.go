@@ -0,0 +1,305 @@
+package revenium
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/packages/ssestream"
+	"github.com/openai/openai-go/v3/responses"
+)
+
+// ResponsesInterface provides methods for creating Responses API calls with metering
+type ResponsesInterface struct {
+	client   openai.Client
+	config   *Config
+	provider Provider
+	parent   *ReveniumOpenAI // Reference to parent for metering queue access
+}
+
+// Responses returns the Responses API interface
+func (r *ReveniumOpenAI) Responses() *ResponsesInterface {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return &ResponsesInterface{
+		client:   r.client,
+		config:   r.config,
+		provider: r.provider,
+		parent:   r,
+	}
+}
+
+// New creates a model response with automatic metering
+func (ri *ResponsesInterface) New(ctx context.Context, params responses.ResponseNewParams, opts ...CallOption) (*responses.Response, error) {
+	// Resolve metadata from config, client, context and call options
+	metadata := ri.parent.callMetadata(ctx, opts)
+
+	// Call the appropriate provider
+	switch ri.provider {
+	case ProviderOpenAI:
+		return ri.createResponseOpenAI(ctx, params, metadata)
+	case ProviderAzure:
+		return ri.createResponseAzure(ctx, params, metadata)
+	default:
+		return nil, NewProviderError("unknown provider", fmt.Errorf("provider: %v", ri.provider))
+	}
+}
+
+// NewStreaming creates a streaming model response with automatic metering
+// Returns a ResponsesStreamingWrapper that captures the terminal event's usage and sends metering data when closed
+func (ri *ResponsesInterface) NewStreaming(ctx context.Context, params responses.ResponseNewParams, opts ...CallOption) (*ResponsesStreamingWrapper, error) {
+	// Resolve metadata from config, client, context and call options
+	metadata := ri.parent.callMetadata(ctx, opts)
+
+	var provider string
+	switch ri.provider {
+	case ProviderOpenAI:
+		provider = "OPENAI"
+	case ProviderAzure:
+		provider = "AZURE"
+		Debug("Using Azure deployment name '%s' from user", params.Model)
+	default:
+		return nil, NewProviderError("unknown provider", fmt.Errorf("provider: %v", ri.provider))
+	}
+
+	stream := ri.client.Responses.NewStreaming(ctx, params)
+	ctx, result := ensureMeteredResult(ctx)
+
+	return &ResponsesStreamingWrapper{
+		ctx:       ctx,
+		result:    result,
+		stream:    stream,
+		metadata:  metadata,
+		startTime: time.Now(),
+		responses: ri,
+		model:     params.Model,
+		provider:  provider,
+		parent:    ri.parent,
+	}, nil
+}
+
+// createResponseOpenAI creates a model response using OpenAI native API
+func (ri *ResponsesInterface) createResponseOpenAI(ctx context.Context, params responses.ResponseNewParams, metadata map[string]interface{}) (*responses.Response, error) {
+	requestTime := time.Now()
+
+	resp, err := ri.client.Responses.New(ctx, params)
+	if err != nil {
+		duration := time.Since(requestTime)
+		err = requestError(ctx, err)
+		ri.sendMeteringDataForError(ctx, params.Model, metadata, false, duration, "OPENAI", requestTime, err)
+		return nil, err
+	}
+
+	duration := time.Since(requestTime)
+	ri.sendMeteringData(ctx, resp, metadata, false, duration, "OPENAI", requestTime, nil, 0)
+
+	return resp, nil
+}
+
+func (ri *ResponsesInterface) createResponseAzure(ctx context.Context, params responses.ResponseNewParams, metadata map[string]interface{}) (*responses.Response, error) {
+	requestTime := time.Now()
+	originalModel := params.Model
+	Debug("Using Azure deployment name '%s' from user", originalModel)
+
+	resp, err := ri.client.Responses.New(ctx, params)
+	if err != nil {
+		duration := time.Since(requestTime)
+		err = requestError(ctx, err)
+		if ctx.Err() != nil {
+			// A cancelled or expired context would fail the fallback as well
+			ri.sendMeteringDataForError(ctx, originalModel, metadata, false, duration, "AZURE", requestTime, err)
+			return nil, err
+		}
+		// The caller's MeteredResult reports the fallback call instead
+		ri.sendMeteringDataForError(withoutMeteredResult(ctx), originalModel, metadata, false, duration, "AZURE", requestTime, err)
+		Warn("Azure responses request failed: %v, falling back to OpenAI", err)
+		return ri.createResponseOpenAI(ctx, params, metadata)
+	}
+
+	duration := time.Since(requestTime)
+	ri.sendMeteringData(ctx, resp, metadata, false, duration, "AZURE", requestTime, nil, 0)
+
+	return resp, nil
+}
+
+func (ri *ResponsesInterface) sendMeteringData(ctx context.Context, resp *responses.Response, metadata map[string]interface{}, isStreamed bool, duration time.Duration, provider string, requestTime time.Time, completionStartTime *time.Time, timeToFirstToken int64) {
+	payload := buildResponsesMeteringPayload(resp, metadata, isStreamed, duration, provider, requestTime, completionStartTime, timeToFirstToken)
+	Debug("[METERING] Queueing responses metering data...")
+	ri.parent.enqueueMetering(ctx, payload)
+}
+
+// sendMeteringDataForError queues the payload for a failed or interrupted
+// response; the stop reason is derived from err with MapRequestError
+func (ri *ResponsesInterface) sendMeteringDataForError(ctx context.Context, model string, metadata map[string]interface{}, isStreamed bool, duration time.Duration, provider string, requestTime time.Time, err error) {
+	payload := buildErrorMeteringPayload(model, metadata, isStreamed, duration, provider, requestTime, err.Error())
+	payload.StopReason = MapRequestError(err)
+	Debug("[METERING] Queueing responses error metering data...")
+	ri.parent.enqueueMetering(ctx, payload)
+}
+
+// buildResponsesMeteringPayload builds the metering payload for a Responses API response
+func buildResponsesMeteringPayload(resp *responses.Response, metadata map[string]interface{}, isStreamed bool, duration time.Duration, provider string, requestTime time.Time, completionStartTime *time.Time, timeToFirstToken int64) *MeteringPayload {
+	responseTimeISO := time.Now().UTC().Format(time.RFC3339)
+	requestTimeISO := requestTime.UTC().Format(time.RFC3339)
+
+	completionStartTimeISO := requestTimeISO
+	if completionStartTime != nil {
+		completionStartTimeISO = completionStartTime.UTC().Format(time.RFC3339)
+	}
+
+	if provider == "" {
+		provider = "OPENAI"
+	}
+
+	payload := &MeteringPayload{
+		StopReason:          MapResponseStatus(string(resp.Status), resp.IncompleteDetails.Reason, StopReasonEnd),
+		CostType:            CostTypeAI,
+		IsStreamed:          isStreamed,
+		OperationType:       OperationTypeChat,
+		InputTokenCount:     resp.Usage.InputTokens,
+		OutputTokenCount:    resp.Usage.OutputTokens,
+		ReasoningTokenCount: resp.Usage.OutputTokensDetails.ReasoningTokens,
+		CacheReadTokenCount: resp.Usage.InputTokensDetails.CachedTokens,
+		TotalTokenCount:     resp.Usage.TotalTokens,
+		Model:               resp.Model,
+		ResponseTime:        responseTimeISO,
+		RequestDuration:     duration.Milliseconds(),
+		Provider:            provider,
+		RequestTime:         requestTimeISO,
+		CompletionStartTime: completionStartTimeISO,
+		TimeToFirstToken:    timeToFirstToken,
+		MiddlewareSource:    GetMiddlewareSource(),
+	}
+	if resp.Status == responses.ResponseStatusFailed {
+		payload.ErrorReason = responseErrorReason(resp.Error)
+	}
+
+	addMetadataToPayload(payload, metadata)
+	return payload
+}
+
+// responseErrorReason describes the error of a failed response
+func responseErrorReason(err responses.ResponseError) string {
+	switch {
+	case err.Code != "" && err.Message != "":
+		return fmt.Sprintf("%s: %s", err.Code, err.Message)
+	case err.Message != "":
+		return err.Message
+	case err.Code != "":
+		return string(err.Code)
+	default:
+		return "response failed"
+	}
+}
+
+// ResponsesStreamingWrapper wraps a Responses API event stream to capture usage and send metering data
+type ResponsesStreamingWrapper struct {
+	ctx            context.Context
+	result         *MeteredResult
+	stream         *ssestream.Stream[responses.ResponseStreamEventUnion]
+	metadata       map[string]interface{}
+	startTime      time.Time
+	firstTokenTime *time.Time
+	responses      *ResponsesInterface
+	model          string
+	provider       string
+	parent         *ReveniumOpenAI // Reference to parent for metering queue access
+	mu             sync.Mutex
+
+	// Terminal response (response.completed, response.incomplete or response.failed)
+	final *responses.Response
+
+	// The stream is closed and metered exactly once, by the first Close
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Next advances the stream and records the event for metering, so usage and
+// time to first token are captured whether or not Current is called
+func (sw *ResponsesStreamingWrapper) Next() bool {
+	if !sw.stream.Next() {
+		return false
+	}
+	sw.record(sw.stream.Current())
+	return true
+}
+
+func (sw *ResponsesStreamingWrapper) Current() responses.ResponseStreamEventUnion {
+	return sw.stream.Current()
+}
+
+// record captures the time to first token and the terminal response from an event
+func (sw *ResponsesStreamingWrapper) record(event responses.ResponseStreamEventUnion) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if sw.firstTokenTime == nil && event.Delta != "" {
+		now := time.Now()
+		sw.firstTokenTime = &now
+	}
+
+	switch event.Type {
+	case "response.completed", "response.incomplete", "response.failed":
+		resp := event.Response
+		sw.final = &resp
+	}
+}
+
+// Result returns the metering result of the stream; its transaction ID is known
+// immediately, the estimated cost and delivery outcome once the stream is closed
+func (sw *ResponsesStreamingWrapper) Result() *MeteredResult {
+	return sw.result
+}
+
+func (sw *ResponsesStreamingWrapper) Err() error {
+	return sw.stream.Err()
+}
+
+// Close closes the underlying stream and meters it. Close is idempotent; the
+// stream is metered only once.
+func (sw *ResponsesStreamingWrapper) Close() error {
+	sw.closeOnce.Do(func() {
+		sw.closeErr = sw.stream.Close()
+		sw.meter(sw.stream.Err())
+	})
+	return sw.closeErr
+}
+
+// meter queues the metering payload for the stream
+func (sw *ResponsesStreamingWrapper) meter(streamErr error) {
+	duration := time.Since(sw.startTime)
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	// A stream closed before its terminal event is metered as CANCELLED, or as
+	// TIMEOUT if its context expired, like in the transport middleware
+	if streamErr == nil && sw.final == nil {
+		streamErr = sw.ctx.Err()
+		if streamErr == nil {
+			streamErr = errSSEClosedEarly
+		}
+	}
+
+	if streamErr != nil {
+		sw.responses.sendMeteringDataForError(sw.ctx, sw.model, sw.metadata, true, duration, sw.provider, sw.startTime, requestError(sw.ctx, streamErr))
+		return
+	}
+
+	timeToFirstToken := int64(0)
+	var completionStartTime *time.Time
+	if sw.firstTokenTime != nil {
+		timeToFirstToken = sw.firstTokenTime.Sub(sw.startTime).Milliseconds()
+		completionStartTime = sw.firstTokenTime
+	}
+
+	resp := sw.final
+	if resp.Model == "" {
+		resp.Model = sw.model
+	}
+
+	sw.responses.sendMeteringData(sw.ctx, resp, sw.metadata, true, duration, sw.provider, sw.startTime, completionStartTime, timeToFirstToken)
+}
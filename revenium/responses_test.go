@@ -0,0 +1,166 @@
+package revenium
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/responses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildResponsesMeteringPayload(t *testing.T) {
+	resp := &responses.Response{
+		Model:  "gpt-4.1",
+		Status: responses.ResponseStatusCompleted,
+		Usage: responses.ResponseUsage{
+			InputTokens:  100,
+			OutputTokens: 50,
+			TotalTokens:  150,
+			InputTokensDetails: responses.ResponseUsageInputTokensDetails{
+				CachedTokens: 20,
+			},
+			OutputTokensDetails: responses.ResponseUsageOutputTokensDetails{
+				ReasoningTokens: 10,
+			},
+		},
+	}
+	metadata := map[string]interface{}{"traceId": "trace-1"}
+	start := time.Now()
+	firstToken := start.Add(30 * time.Millisecond)
+
+	payload := buildResponsesMeteringPayload(resp, metadata, true, time.Second, "OPENAI", start, &firstToken, 30)
+
+	assert.Equal(t, StopReasonEnd, payload.StopReason)
+	assert.Equal(t, OperationTypeChat, payload.OperationType)
+	assert.True(t, payload.IsStreamed)
+	assert.Equal(t, int64(100), payload.InputTokenCount)
+	assert.Equal(t, int64(50), payload.OutputTokenCount)
+	assert.Equal(t, int64(10), payload.ReasoningTokenCount)
+	assert.Equal(t, int64(20), payload.CacheReadTokenCount)
+	assert.Equal(t, int64(150), payload.TotalTokenCount)
+	assert.Equal(t, "gpt-4.1", payload.Model)
+	assert.Equal(t, int64(30), payload.TimeToFirstToken)
+	assert.Equal(t, "trace-1", payload.TraceID)
+}
+
+func TestBuildResponsesMeteringPayloadIncomplete(t *testing.T) {
+	resp := &responses.Response{
+		Model:  "gpt-4.1",
+		Status: responses.ResponseStatusIncomplete,
+		IncompleteDetails: responses.ResponseIncompleteDetails{
+			Reason: "max_output_tokens",
+		},
+	}
+
+	payload := buildResponsesMeteringPayload(resp, nil, false, 0, "", time.Now(), nil, 0)
+
+	assert.Equal(t, StopReasonTokenLimit, payload.StopReason)
+	assert.Equal(t, "OPENAI", payload.Provider)
+}
+
+func TestBuildResponsesMeteringPayloadFailed(t *testing.T) {
+	resp := &responses.Response{
+		Model:  "gpt-4.1",
+		Status: responses.ResponseStatusFailed,
+		Error: responses.ResponseError{
+			Code:    "server_error",
+			Message: "The model failed to respond",
+		},
+	}
+
+	payload := buildResponsesMeteringPayload(resp, nil, true, 0, "", time.Now(), nil, 0)
+
+	assert.Equal(t, StopReasonError, payload.StopReason)
+	assert.Equal(t, "server_error: The model failed to respond", payload.ErrorReason)
+}
+
+func TestResponsesAzureCancellationSkipsFallback(t *testing.T) {
+	client, sink := newHangingAzureClient(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := client.Responses().New(ctx, responses.ResponseNewParams{
+		Model: "my-gpt4o-deployment",
+		Input: responses.ResponseNewParamsInputUnion{OfString: openai.String("Hello")},
+	})
+	require.ErrorIs(t, err, context.Canceled)
+
+	client.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1, "no fallback request is made or metered")
+	assert.Equal(t, StopReasonCancelled, payloads[0].StopReason)
+	assert.Equal(t, "AZURE", payloads[0].Provider)
+}
+
+func TestResponsesStreamingMetersOnceWithoutCurrent(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, data := range []string{
+			`{"type":"response.output_text.delta","delta":"Hi","sequence_number":1}`,
+			`{"type":"response.completed","sequence_number":2,"response":{"id":"resp_1","model":"gpt-4o-2024-08-06","status":"completed","usage":{"input_tokens":5,"output_tokens":2,"total_tokens":7}}}`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+	}))
+	defer upstream.Close()
+
+	sink := NewMemorySink()
+	client, err := NewReveniumOpenAI(&Config{OpenAIAPIKey: "sk-test", BaseURL: upstream.URL, Sink: sink})
+	require.NoError(t, err)
+	defer client.Close()
+
+	stream, err := client.Responses().NewStreaming(context.Background(), responses.ResponseNewParams{
+		Model: "gpt-4o",
+		Input: responses.ResponseNewParamsInputUnion{OfString: openai.String("Hello")},
+	})
+	require.NoError(t, err)
+	for stream.Next() {
+		// Current is never called
+	}
+	require.NoError(t, stream.Close())
+	require.NoError(t, stream.Close())
+	assert.NotNil(t, stream.firstTokenTime, "time to first token is recorded in Next")
+
+	client.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1, "a second Close does not meter again")
+	assert.Equal(t, int64(5), payloads[0].InputTokenCount)
+	assert.Equal(t, int64(2), payloads[0].OutputTokenCount)
+	assert.Equal(t, "gpt-4o-2024-08-06", payloads[0].Model)
+}
+
+func TestResponsesStreamingClosedEarlyIsCancelled(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: %s\n\n", `{"type":"response.output_text.delta","delta":"Hi","sequence_number":1}`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	sink := NewMemorySink()
+	client, err := NewReveniumOpenAI(&Config{OpenAIAPIKey: "sk-test", BaseURL: upstream.URL, Sink: sink})
+	require.NoError(t, err)
+	defer client.Close()
+
+	stream, err := client.Responses().NewStreaming(context.Background(), responses.ResponseNewParams{
+		Model: "gpt-4o",
+		Input: responses.ResponseNewParamsInputUnion{OfString: openai.String("Hello")},
+	})
+	require.NoError(t, err)
+	require.True(t, stream.Next())
+	require.NoError(t, stream.Close())
+
+	client.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, StopReasonCancelled, payloads[0].StopReason)
+	assert.Equal(t, "gpt-4o", payloads[0].Model)
+	assert.True(t, payloads[0].IsStreamed)
+}
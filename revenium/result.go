@@ -0,0 +1,154 @@
+package revenium
+
+import (
+	"context"
+	"sync"
+)
+
+const meteredResultKey contextKey = "revenium_metered_result"
+
+// MeteredResult reports the metering of one call: the transaction ID sent to
+// Revenium, the model and estimated cost and, once known, whether the event was
+// delivered.
+// Obtain one with WithMeteredResult, CompletionsInterface.NewWithResult or
+// StreamingWrapper.Result.
+type MeteredResult struct {
+	done chan struct{}
+
+	mu            sync.Mutex
+	transactionID string
+	bound         bool
+	model         string
+	estimatedCost *float64
+	err           error
+}
+
+// newMeteredResult creates a result with a fresh transaction ID
+func newMeteredResult() *MeteredResult {
+	return &MeteredResult{
+		transactionID: generateRequestID(),
+		done:          make(chan struct{}),
+	}
+}
+
+// WithMeteredResult returns a context that reports the metering of the call it
+// is passed to, and the result receiving the report. The transaction ID is
+// assigned up front, so it can be logged before the call is made, unless the
+// call's usage metadata sets a transactionId, which then replaces it. Use a new
+// context for every call: only the first event metered with it is reported.
+func WithMeteredResult(ctx context.Context) (context.Context, *MeteredResult) {
+	result := newMeteredResult()
+	return context.WithValue(ctx, meteredResultKey, result), result
+}
+
+// GetMeteredResult retrieves the result set with WithMeteredResult from context
+func GetMeteredResult(ctx context.Context) *MeteredResult {
+	if result, ok := ctx.Value(meteredResultKey).(*MeteredResult); ok {
+		return result
+	}
+	return nil
+}
+
+// ensureMeteredResult returns ctx and its result, adding a result if it has none
+func ensureMeteredResult(ctx context.Context) (context.Context, *MeteredResult) {
+	if result := GetMeteredResult(ctx); result != nil {
+		return ctx, result
+	}
+	return WithMeteredResult(ctx)
+}
+
+// withoutMeteredResult hides the result of ctx from events that are not the
+// outcome of the call, such as the failed Azure attempt before a fallback
+func withoutMeteredResult(ctx context.Context) context.Context {
+	if GetMeteredResult(ctx) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, meteredResultKey, (*MeteredResult)(nil))
+}
+
+// TransactionID returns the transaction ID the call is metered with
+func (m *MeteredResult) TransactionID() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.transactionID
+}
+
+// Model returns the model the call was metered with, empty until the event is
+// queued. SubmitResultFeedback sends it with the feedback for the call.
+func (m *MeteredResult) Model() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.model
+}
+
+// EstimatedCost returns the estimated cost in USD the call was metered with. It
+// returns false until the event is queued, and for models without known prices.
+func (m *MeteredResult) EstimatedCost() (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.estimatedCost == nil {
+		return 0, false
+	}
+	return *m.estimatedCost, true
+}
+
+// Done returns a channel that is closed once the delivery outcome is known
+func (m *MeteredResult) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns the delivery outcome once Done is closed: nil if Revenium
+// accepted the event, otherwise why it was rejected, dropped or abandoned.
+// It returns nil while the outcome is unknown.
+func (m *MeteredResult) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Wait blocks until the delivery outcome is known and returns it, or returns
+// ctx.Err() if ctx is done first
+func (m *MeteredResult) Wait(ctx context.Context) error {
+	select {
+	case <-m.done:
+		return m.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// bind ties the result to a payload about to be queued. A transaction ID set by
+// metadata is adopted; otherwise the payload gets the result's transaction ID.
+// It returns false if the result already has an event.
+func (m *MeteredResult) bind(payload *MeteringPayload) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.bound {
+		return false
+	}
+	m.bound = true
+	if payload.TransactionID != "" {
+		m.transactionID = payload.TransactionID
+	} else {
+		payload.TransactionID = m.transactionID
+	}
+	m.model = payload.Model
+	m.estimatedCost = payload.EstimatedCost
+	return true
+}
+
+// resolve records the delivery outcome; only the first outcome counts
+func (m *MeteredResult) resolve(err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-m.done:
+		return
+	default:
+	}
+	m.err = err
+	close(m.done)
+}
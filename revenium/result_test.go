@@ -0,0 +1,81 @@
+package revenium
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeteredResultResolvesOnce(t *testing.T) {
+	ctx, result := WithMeteredResult(context.Background())
+	assert.Same(t, result, GetMeteredResult(ctx))
+	assert.NotEmpty(t, result.TransactionID())
+	assert.Nil(t, GetMeteredResult(withoutMeteredResult(ctx)))
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, result.Wait(waitCtx), context.DeadlineExceeded)
+
+	first := errors.New("rejected")
+	result.resolve(first)
+	result.resolve(nil)
+	<-result.Done()
+	assert.Equal(t, first, result.Err())
+	assert.Equal(t, first, result.Wait(context.Background()))
+}
+
+func TestMeteredResultBindsFirstEvent(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewReveniumOpenAI(&Config{Sink: sink})
+	require.NoError(t, err)
+	defer r.Close()
+
+	ctx, result := WithMeteredResult(context.Background())
+	r.enqueueMetering(ctx, testPayload(""))
+	r.enqueueMetering(ctx, testPayload("tx-2"))
+
+	require.NoError(t, result.Wait(context.Background()))
+	r.Flush()
+	ids := []string{}
+	for _, p := range sink.Payloads() {
+		ids = append(ids, p.TransactionID)
+	}
+	assert.ElementsMatch(t, []string{result.TransactionID(), "tx-2"}, ids)
+
+	cost, ok := result.EstimatedCost()
+	require.True(t, ok, "gpt-4o-mini has built-in prices")
+	assert.Zero(t, cost)
+}
+
+func TestMeteredResultAdoptsMetadataTransactionID(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewReveniumOpenAI(&Config{Sink: sink})
+	require.NoError(t, err)
+	defer r.Close()
+
+	ctx, result := WithMeteredResult(context.Background())
+	r.enqueueMetering(ctx, testPayload("my-tx"))
+	require.NoError(t, result.Wait(context.Background()))
+	assert.Equal(t, "my-tx", result.TransactionID())
+	assert.Equal(t, "my-tx", sink.Payloads()[0].TransactionID)
+}
+
+func TestMeteredResultReportsUndeliveredEvents(t *testing.T) {
+	r, err := NewReveniumOpenAI(&Config{Sink: NewMemorySink()})
+	require.NoError(t, err)
+
+	ctx, invalid := WithMeteredResult(context.Background())
+	payload := testPayload("")
+	payload.StopReason = "DONE"
+	r.enqueueMetering(ctx, payload)
+	assert.True(t, IsValidationError(invalid.Wait(context.Background())))
+
+	require.NoError(t, r.Shutdown(context.Background()))
+	ctx, dropped := WithMeteredResult(context.Background())
+	r.enqueueMetering(ctx, testPayload(""))
+	assert.True(t, IsMeteringError(dropped.Wait(context.Background())))
+}
@@ -0,0 +1,101 @@
+package reveniumtest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/revenium/revenium-middleware-openai-go/revenium"
+)
+
+// Match selects events by field. Zero-valued fields match any value.
+type Match struct {
+	OperationType  revenium.OperationType
+	StopReason     revenium.ReveniumStopReason
+	Model          string
+	Provider       string
+	TransactionID  string
+	OrganizationID string
+	ProductID      string
+	TraceID        string
+	IsStreamed     *bool
+}
+
+// Matches reports whether the payload has every field set in m
+func (m Match) Matches(p revenium.MeteringPayload) bool {
+	return (m.OperationType == "" || p.OperationType == m.OperationType) &&
+		(m.StopReason == "" || p.StopReason == m.StopReason) &&
+		(m.Model == "" || p.Model == m.Model) &&
+		(m.Provider == "" || p.Provider == m.Provider) &&
+		(m.TransactionID == "" || p.TransactionID == m.TransactionID) &&
+		(m.OrganizationID == "" || p.OrganizationID == m.OrganizationID) &&
+		(m.ProductID == "" || p.ProductID == m.ProductID) &&
+		(m.TraceID == "" || p.TraceID == m.TraceID) &&
+		(m.IsStreamed == nil || p.IsStreamed == *m.IsStreamed)
+}
+
+// String describes the fields set in m, for failure messages
+func (m Match) String() string {
+	var parts []string
+	add := func(name, value string) {
+		if value != "" {
+			parts = append(parts, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+	add("operationType", string(m.OperationType))
+	add("stopReason", string(m.StopReason))
+	add("model", m.Model)
+	add("provider", m.Provider)
+	add("transactionId", m.TransactionID)
+	add("organizationId", m.OrganizationID)
+	add("productId", m.ProductID)
+	add("traceId", m.TraceID)
+	if m.IsStreamed != nil {
+		add("isStreamed", fmt.Sprint(*m.IsStreamed))
+	}
+	if len(parts) == 0 {
+		return "any event"
+	}
+	return strings.Join(parts, " ")
+}
+
+// Streamed returns a pointer to b, for Match.IsStreamed
+func Streamed(b bool) *bool {
+	return &b
+}
+
+// Find returns the received events matching m
+func (s *Server) Find(m Match) []revenium.MeteringPayload {
+	var found []revenium.MeteringPayload
+	for _, ev := range s.Events() {
+		if m.Matches(ev) {
+			found = append(found, ev)
+		}
+	}
+	return found
+}
+
+// ExpectEventCount fails the test unless exactly n events were received
+func (s *Server) ExpectEventCount(t testing.TB, n int) {
+	t.Helper()
+	if got := len(s.Events()); got != n {
+		t.Errorf("reveniumtest: expected %d metering events, got %d", n, got)
+	}
+}
+
+// ExpectOneEvent fails the test unless exactly one received event matches m, and returns it
+func (s *Server) ExpectOneEvent(t testing.TB, m Match) revenium.MeteringPayload {
+	t.Helper()
+	found := s.Find(m)
+	if len(found) != 1 {
+		t.Errorf("reveniumtest: expected one metering event with %s, got %d (of %d received)", m, len(found), len(s.Events()))
+		return revenium.MeteringPayload{}
+	}
+	return found[0]
+}
+
+// ExpectNoEvents fails the test if any event was received
+func (s *Server) ExpectNoEvents(t testing.TB) {
+	t.Helper()
+	s.ExpectEventCount(t, 0)
+}
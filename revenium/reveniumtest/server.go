@@ -0,0 +1,250 @@
+// Package reveniumtest provides a fake Revenium metering API for testing code
+// that uses the revenium middleware.
+//
+// Point a client at the fake server with Config.ReveniumBaseURL, or with
+// revenium.WithReveniumBaseURL passed to Initialize, call Flush on the client,
+// then inspect or assert on the received events:
+//
+//	srv := reveniumtest.NewServer()
+//	defer srv.Close()
+//
+//	cfg := &revenium.Config{ReveniumAPIKey: "hak_test", ReveniumBaseURL: srv.URL, OpenAIAPIKey: "sk-test"}
+//	client, _ := revenium.NewReveniumOpenAI(cfg)
+//	// ... make calls ...
+//	client.Flush()
+//
+//	srv.ExpectOneEvent(t, reveniumtest.Match{
+//		OperationType: revenium.OperationTypeChat,
+//		Model:         "gpt-4o-mini",
+//		StopReason:    revenium.StopReasonEnd,
+//	})
+package reveniumtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/revenium/revenium-middleware-openai-go/revenium"
+)
+
+const (
+	completionsPath = "/meter/v2/ai/completions"
+	batchPath       = "/meter/v2/ai/completions/batch"
+)
+
+// Server is a fake Revenium metering API. Payloads are decoded and checked with
+// MeteringPayload.Validate: malformed payloads and payloads that fail those
+// local checks are rejected with 400. The real API may reject payloads the fake
+// accepts.
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	events     []revenium.MeteringPayload
+	requests   int
+	apiKey     string
+	latency    time.Duration
+	statusCode int
+	failNext   []int
+	batch      bool
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithAPIKey makes the server reject requests whose x-api-key header differs from key with 401
+func WithAPIKey(key string) Option {
+	return func(s *Server) {
+		s.apiKey = key
+	}
+}
+
+// WithLatency delays every response by d
+func WithLatency(d time.Duration) Option {
+	return func(s *Server) {
+		s.latency = d
+	}
+}
+
+// WithStatusCode makes the server answer every request with code instead of
+// accepting it. Events are only recorded for 2xx codes.
+func WithStatusCode(code int) Option {
+	return func(s *Server) {
+		s.statusCode = code
+	}
+}
+
+// WithBatchEndpoint makes the server accept /meter/v2/ai/completions/batch.
+// That endpoint is not part of the documented metering API, so by default the
+// server answers it with 404; enable it only to test clients that opt in to
+// batched delivery with revenium.WithMeteringBatchEnabled.
+func WithBatchEndpoint() Option {
+	return func(s *Server) {
+		s.batch = true
+	}
+}
+
+// NewServer starts a fake Revenium server. The caller must Close it.
+func NewServer(opts ...Option) *Server {
+	s := &Server{statusCode: http.StatusCreated}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// FailNext makes the next n requests fail with status, before any configured status code applies
+func (s *Server) FailNext(n int, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.failNext = append(s.failNext, status)
+	}
+}
+
+// SetStatusCode changes the status code returned by subsequent requests
+func (s *Server) SetStatusCode(code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statusCode = code
+}
+
+// SetLatency changes the delay applied to subsequent responses
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// Events returns a copy of the accepted events, in the order received
+func (s *Server) Events() []revenium.MeteringPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]revenium.MeteringPayload(nil), s.events...)
+}
+
+// Requests returns the number of HTTP requests received, including failed ones
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// Reset discards recorded events and request counts and clears pending failures
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = nil
+	s.requests = 0
+	s.failNext = nil
+}
+
+// WaitForEvents polls until at least n events have been accepted or timeout
+// elapses, and returns the events received so far
+func (s *Server) WaitForEvents(n int, timeout time.Duration) []revenium.MeteringPayload {
+	deadline := time.Now().Add(timeout)
+	for {
+		events := s.Events()
+		if len(events) >= n || time.Now().After(deadline) {
+			return events
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	latency := s.latency
+	status := s.statusCode
+	if len(s.failNext) > 0 {
+		status = s.failNext[0]
+		s.failNext = s.failNext[1:]
+	}
+	apiKey := s.apiKey
+	batch := s.batch
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if apiKey != "" && r.Header.Get("x-api-key") != apiKey {
+		http.Error(w, "invalid API key", http.StatusUnauthorized)
+		return
+	}
+	if status < 200 || status >= 300 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	var payloads []revenium.MeteringPayload
+	var err error
+	switch r.URL.Path {
+	case completionsPath:
+		var payload *revenium.MeteringPayload
+		payload, err = DecodePayload(r.Body)
+		if payload != nil {
+			payloads = append(payloads, *payload)
+		}
+	case batchPath:
+		if !batch {
+			http.NotFound(w, r)
+			return
+		}
+		payloads, err = DecodePayloads(r.Body)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.events = append(s.events, payloads...)
+	s.mu.Unlock()
+
+	w.WriteHeader(status)
+}
+
+// DecodePayload decodes and validates a single metering payload
+func DecodePayload(r io.Reader) (*revenium.MeteringPayload, error) {
+	var payload revenium.MeteringPayload
+	if err := json.NewDecoder(r).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("decode metering payload: %w", err)
+	}
+	if err := payload.Validate(); err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
+
+// DecodePayloads decodes and validates a JSON array of metering payloads, as sent to the batch endpoint
+func DecodePayloads(r io.Reader) ([]revenium.MeteringPayload, error) {
+	var payloads []revenium.MeteringPayload
+	if err := json.NewDecoder(r).Decode(&payloads); err != nil {
+		return nil, fmt.Errorf("decode metering batch: %w", err)
+	}
+	for i := range payloads {
+		if err := payloads[i].Validate(); err != nil {
+			return nil, fmt.Errorf("batch item %d: %w", i, err)
+		}
+	}
+	return payloads, nil
+}
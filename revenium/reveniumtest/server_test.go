@@ -0,0 +1,149 @@
+package reveniumtest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openai/openai-go/v3"
+
+	"github.com/revenium/revenium-middleware-openai-go/revenium"
+	"github.com/revenium/revenium-middleware-openai-go/revenium/openaitest"
+)
+
+func chatPayload(id, model string) *revenium.MeteringPayload {
+	return &revenium.MeteringPayload{
+		StopReason:    revenium.StopReasonEnd,
+		CostType:      revenium.CostTypeAI,
+		OperationType: revenium.OperationTypeChat,
+		Model:         model,
+		TransactionID: id,
+		Provider:      "OPENAI",
+	}
+}
+
+// recordingTB captures assertion failures instead of failing the test
+type recordingTB struct {
+	testing.TB
+	failed bool
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.failed = true
+}
+
+func TestServerRecordsEvents(t *testing.T) {
+	srv := NewServer(WithAPIKey("hak_test"), WithBatchEndpoint())
+	defer srv.Close()
+
+	sink := revenium.NewHTTPSink(srv.URL, "hak_test")
+	require.NoError(t, sink.Send(context.Background(), chatPayload("tx-1", "gpt-4o")))
+	errs := sink.SendBatch(context.Background(), []*revenium.MeteringPayload{
+		chatPayload("tx-2", "gpt-4o-mini"),
+		chatPayload("tx-3", "gpt-4o-mini"),
+	})
+	assert.Equal(t, []error{nil, nil}, errs)
+
+	srv.ExpectEventCount(t, 3)
+	ev := srv.ExpectOneEvent(t, Match{OperationType: revenium.OperationTypeChat, Model: "gpt-4o", StopReason: revenium.StopReasonEnd})
+	assert.Equal(t, "tx-1", ev.TransactionID)
+	assert.Len(t, srv.Find(Match{Model: "gpt-4o-mini", IsStreamed: Streamed(false)}), 2)
+	assert.Equal(t, 2, srv.Requests())
+
+	rec := &recordingTB{TB: t}
+	srv.ExpectOneEvent(rec, Match{Model: "gpt-4o-mini"})
+	assert.True(t, rec.failed, "two events match, not one")
+
+	srv.Reset()
+	srv.ExpectNoEvents(t)
+}
+
+func TestServerRejectsInvalidRequests(t *testing.T) {
+	srv := NewServer(WithAPIKey("hak_test"))
+	defer srv.Close()
+
+	err := revenium.NewHTTPSink(srv.URL, "wrong").Send(context.Background(), chatPayload("tx-1", "gpt-4o"))
+	require.Error(t, err)
+	assert.True(t, revenium.IsAuthError(err))
+
+	invalid := chatPayload("tx-2", "gpt-4o")
+	invalid.StopReason = "DONE"
+	err = revenium.NewHTTPSink(srv.URL, "hak_test").Send(context.Background(), invalid)
+	require.Error(t, err)
+	assert.True(t, revenium.IsValidationError(err))
+
+	srv.ExpectNoEvents(t)
+}
+
+func TestServerFailures(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	sink := revenium.NewHTTPSink(srv.URL, "hak_test")
+
+	srv.FailNext(1, http.StatusServiceUnavailable)
+	err := sink.Send(context.Background(), chatPayload("tx-1", "gpt-4o"))
+	require.Error(t, err)
+	assert.True(t, revenium.IsMeteringError(err))
+	require.NoError(t, sink.Send(context.Background(), chatPayload("tx-1", "gpt-4o")))
+
+	srv.SetStatusCode(http.StatusInternalServerError)
+	assert.Error(t, sink.Send(context.Background(), chatPayload("tx-2", "gpt-4o")))
+	srv.ExpectEventCount(t, 1)
+}
+
+func TestServerBatchEndpointIsOptIn(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	errs := revenium.NewHTTPSink(srv.URL, "hak_test").SendBatch(context.Background(), []*revenium.MeteringPayload{
+		chatPayload("tx-1", "gpt-4o"),
+		chatPayload("tx-2", "gpt-4o"),
+	})
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.Len(t, srv.WaitForEvents(2, time.Second), 2)
+	assert.Equal(t, 3, srv.Requests(), "one rejected batch, then one request per event")
+}
+
+func TestServerLatency(t *testing.T) {
+	srv := NewServer(WithLatency(50 * time.Millisecond))
+	defer srv.Close()
+
+	start := time.Now()
+	require.NoError(t, revenium.NewHTTPSink(srv.URL, "hak_test").Send(context.Background(), chatPayload("tx-1", "gpt-4o")))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestServerWithClient(t *testing.T) {
+	srv := NewServer(WithAPIKey("hak_test"))
+	defer srv.Close()
+	upstream := openaitest.NewServer()
+	defer upstream.Close()
+	upstream.Enqueue(openaitest.Response{Content: "Hello", PromptTokens: 5, CompletionTokens: 1})
+
+	// A client of its own rather than the Initialize/GetClient singleton, which
+	// would outlive this test and its servers
+	client, err := revenium.NewReveniumOpenAI(&revenium.Config{
+		ReveniumBaseURL: srv.URL,
+		ReveniumAPIKey:  "hak_test",
+		OpenAIAPIKey:    "sk-test",
+		BaseURL:         upstream.URL,
+		AzureDisabled:   true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Shutdown(context.Background()) })
+
+	_, err = client.Chat().Completions().New(context.Background(), openai.ChatCompletionNewParams{
+		Model:    "gpt-4o-mini",
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("Hi")},
+	})
+	require.NoError(t, err)
+	client.Flush()
+
+	srv.ExpectOneEvent(t, Match{OperationType: revenium.OperationTypeChat, Model: "gpt-4o-mini", StopReason: revenium.StopReasonEnd})
+}
@@ -0,0 +1,204 @@
+package revenium
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MeteringSink is the destination of metering payloads. Send is called from the
+// background metering workers, possibly concurrently, and is retried by the
+// middleware unless it returns a validation or auth error. Validation errors
+// are permanent: a spooled event rejected with one is discarded. Send should
+// return promptly once ctx is cancelled, which happens when a Shutdown
+// deadline expires.
+type MeteringSink interface {
+	Send(ctx context.Context, payload *MeteringPayload) error
+}
+
+// BatchMeteringSink is implemented by sinks that can deliver several payloads in
+// one call. SendBatch returns one error (or nil) per payload, in order, and is
+// responsible for its own retries.
+type BatchMeteringSink interface {
+	MeteringSink
+	SendBatch(ctx context.Context, payloads []*MeteringPayload) []error
+}
+
+// HTTPSink sends metering payloads to the Revenium metering API. It is the default sink.
+type HTTPSink struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+
+	// batchUnsupported is set once the batch endpoint rejects batches as unsupported
+	batchUnsupported atomic.Bool
+}
+
+// NewHTTPSink creates a sink for the Revenium API at baseURL (the default URL when empty)
+func NewHTTPSink(baseURL, apiKey string) *HTTPSink {
+	if baseURL == "" {
+		baseURL = defaultReveniumBaseURL
+	}
+	return &HTTPSink{
+		baseURL: baseURL,
+		apiKey:  apiKey,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Send performs a single POST of the payload to the Revenium API
+func (s *HTTPSink) Send(ctx context.Context, payload *MeteringPayload) error {
+	_, err := s.post(ctx, meteringCompletionsPath, payload)
+	return err
+}
+
+// post POSTs a JSON body to the given Revenium API path and returns the response
+// body. Non-2xx responses are returned as errors carrying the status code.
+func (s *HTTPSink) post(ctx context.Context, path string, body interface{}) ([]byte, error) {
+	url := s.baseURL + path
+
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, NewMeteringError("failed to marshal metering payload", err)
+	}
+
+	Debug("Sending metering request to %s", url)
+	Debug("Payload: %s", string(jsonData))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, NewMeteringError("failed to create metering request", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("x-api-key", s.apiKey)
+	req.Header.Set("User-Agent", "revenium-middleware-openai-go/1.0")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, NewNetworkError("metering request failed", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return respBody, meteringStatusError(resp.StatusCode, respBody)
+	}
+
+	Debug("Metering request successful")
+	return respBody, nil
+}
+
+// meteringStatusError classifies a non-2xx response of the metering API. Only
+// 400 and 422 reject the payload itself and are returned as validation errors;
+// auth failures, timeouts, rate limits and server errors may succeed later, so
+// the event is kept for retry and replay.
+func meteringStatusError(status int, body []byte) *ReveniumError {
+	var revErr *ReveniumError
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		revErr = NewValidationError(fmt.Sprintf("metering API returned %d: %s", status, string(body)), nil)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		revErr = NewAuthError("metering API rejected the API key", fmt.Errorf("status %d: %s", status, string(body)))
+	default:
+		revErr = NewMeteringError("metering API error", fmt.Errorf("status %d: %s", status, string(body)))
+	}
+	revErr.StatusCode = status
+	return revErr
+}
+
+// WriterSink writes each payload as one JSON line to an io.Writer
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink creates a sink writing JSON lines to w
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// NewStdoutSink creates a sink writing JSON lines to standard output
+func NewStdoutSink() *WriterSink {
+	return NewWriterSink(os.Stdout)
+}
+
+// Send writes the payload as a single JSON line
+func (s *WriterSink) Send(ctx context.Context, payload *MeteringPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return NewValidationError("failed to marshal metering payload", err)
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(data); err != nil {
+		return NewMeteringError("failed to write metering payload", err)
+	}
+	return nil
+}
+
+// FileSink appends each payload as one JSON line to a file, e.g. for local audit logs
+type FileSink struct {
+	*WriterSink
+	file *os.File
+}
+
+// NewFileSink opens (or creates) path for appending JSON lines.
+// The caller owns the sink and must Close it after the client has been closed.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, NewConfigError("failed to open metering sink file", err)
+	}
+	return &FileSink{WriterSink: NewWriterSink(file), file: file}, nil
+}
+
+// Close closes the underlying file
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// MemorySink keeps payloads in memory, e.g. for asserting metering in tests
+type MemorySink struct {
+	mu       sync.Mutex
+	payloads []*MeteringPayload
+}
+
+// NewMemorySink creates an empty in-memory sink
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+// Send records the payload
+func (s *MemorySink) Send(ctx context.Context, payload *MeteringPayload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payloads = append(s.payloads, payload)
+	return nil
+}
+
+// Payloads returns a copy of the recorded payloads, oldest first
+func (s *MemorySink) Payloads() []*MeteringPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*MeteringPayload(nil), s.payloads...)
+}
+
+// Reset discards all recorded payloads
+func (s *MemorySink) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payloads = nil
+}
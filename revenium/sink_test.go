@@ -0,0 +1,153 @@
+package revenium
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPSinkSend(t *testing.T) {
+	var gotKey, gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey = r.Header.Get("x-api-key")
+		gotPath = r.URL.Path
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	sink := NewHTTPSink(server.URL, "hak_test")
+	require.NoError(t, sink.Send(context.Background(), &MeteringPayload{Model: "gpt-4o"}))
+	assert.Equal(t, "hak_test", gotKey)
+	assert.Equal(t, "/meter/v2/ai/completions", gotPath)
+}
+
+func TestHTTPSinkSendValidationError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	err := NewHTTPSink(server.URL, "hak_test").Send(context.Background(), &MeteringPayload{})
+	require.Error(t, err)
+	assert.True(t, IsValidationError(err))
+}
+
+func TestHTTPSinkStatusClassification(t *testing.T) {
+	tests := []struct {
+		status    int
+		permanent bool
+		auth      bool
+	}{
+		{http.StatusBadRequest, true, false},
+		{http.StatusUnprocessableEntity, true, false},
+		{http.StatusUnauthorized, false, true},
+		{http.StatusForbidden, false, true},
+		{http.StatusRequestTimeout, false, false},
+		{http.StatusTooManyRequests, false, false},
+		{http.StatusServiceUnavailable, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			err := NewHTTPSink(server.URL, "hak_test").Send(context.Background(), &MeteringPayload{})
+			require.Error(t, err)
+			assert.Equal(t, tt.permanent, IsValidationError(err))
+			assert.Equal(t, tt.auth, IsAuthError(err))
+
+			var revErr *ReveniumError
+			require.ErrorAs(t, err, &revErr)
+			assert.Equal(t, tt.status, revErr.StatusCode)
+		})
+	}
+}
+
+func TestWithMeteringRetryRetriesRateLimits(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	sink := NewHTTPSink(server.URL, "hak_test")
+	err := withMeteringRetry(context.Background(), func() error {
+		return sink.Send(context.Background(), testPayload("tx-1"))
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestWriterSinkWritesJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterSink(&buf)
+
+	require.NoError(t, sink.Send(context.Background(), testPayload("tx-1")))
+	require.NoError(t, sink.Send(context.Background(), testPayload("tx-2")))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	for i, id := range []string{"tx-1", "tx-2"} {
+		var payload MeteringPayload
+		require.NoError(t, json.Unmarshal([]byte(lines[i]), &payload))
+		assert.Equal(t, id, payload.TransactionID)
+	}
+}
+
+func TestFileSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metering.jsonl")
+
+	for _, id := range []string{"tx-1", "tx-2"} {
+		sink, err := NewFileSink(path)
+		require.NoError(t, err)
+		require.NoError(t, sink.Send(context.Background(), testPayload(id)))
+		require.NoError(t, sink.Close())
+	}
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var ids []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var payload map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &payload))
+		ids = append(ids, payload["transactionId"].(string))
+	}
+	assert.Equal(t, []string{"tx-1", "tx-2"}, ids)
+}
+
+func TestClientWithMemorySink(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewReveniumOpenAI(&Config{Sink: sink})
+	require.NoError(t, err, "a custom sink does not require a Revenium API key")
+
+	r.enqueueMetering(context.Background(), testPayload("tx-1"))
+	r.Flush()
+
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, "tx-1", payloads[0].TransactionID)
+
+	sink.Reset()
+	assert.Empty(t, sink.Payloads())
+	require.NoError(t, r.Close())
+}
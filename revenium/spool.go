@@ -0,0 +1,258 @@
+package revenium
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SpoolFsyncPolicy controls when spooled metering events are flushed to stable storage
+type SpoolFsyncPolicy string
+
+const (
+	// SpoolFsyncAlways fsyncs every spooled event before it is queued for delivery
+	SpoolFsyncAlways SpoolFsyncPolicy = "always"
+	// SpoolFsyncNever leaves flushing to the operating system; faster, but events
+	// may be lost on power failure (process crashes are still covered)
+	SpoolFsyncNever SpoolFsyncPolicy = "never"
+)
+
+const (
+	defaultSpoolMaxBytes = 100 * 1024 * 1024
+	spoolFileExt         = ".json"
+	spoolTempExt         = ".tmp"
+	// spoolTempStaleAge is how old a temporary file must be before it is taken
+	// for the partial write of a crashed process rather than one in progress
+	spoolTempStaleAge = 10 * time.Minute
+)
+
+// meteringSpool is a write-ahead spool that keeps one file per metering event in
+// a directory until Revenium acknowledges it. Files left behind by a crash are
+// replayed the next time a client is created with the same directory, so the
+// directory should not be shared by concurrently running processes. Clients of
+// the same process may share it: every file is claimed by the client that
+// writes or replays it, replay skips the files other clients have claimed, and
+// the size of the directory counts against the maximum of each client.
+type meteringSpool struct {
+	dir      string
+	maxBytes int64
+	fsync    SpoolFsyncPolicy
+	usage    *spoolUsage
+
+	seq atomic.Uint64
+}
+
+// spoolUsage is the total size of the events in a spool directory
+type spoolUsage struct {
+	mu    sync.Mutex
+	bytes int64
+}
+
+var (
+	// spoolClaims holds the spool files queued or being delivered by the
+	// clients of this process, by absolute path
+	spoolClaims sync.Map
+	// spoolUsages holds the usage of each spool directory opened by the
+	// process, shared by the clients using it
+	spoolUsages sync.Map
+)
+
+// openMeteringSpool creates the spool directory if needed and removes the
+// partial writes of crashed processes
+func openMeteringSpool(dir string, maxBytes int64, fsync SpoolFsyncPolicy) (*meteringSpool, error) {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultSpoolMaxBytes
+	}
+	if fsync != SpoolFsyncNever {
+		fsync = SpoolFsyncAlways
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, NewConfigError("failed to create metering spool directory", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, NewConfigError("failed to read metering spool directory", err)
+	}
+	var bytes int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		switch {
+		case strings.HasSuffix(entry.Name(), spoolTempExt):
+			// Another client of the process may be writing it
+			_, claimed := spoolClaims.Load(strings.TrimSuffix(path, spoolTempExt))
+			if !claimed && time.Since(info.ModTime()) > spoolTempStaleAge {
+				os.Remove(path)
+			}
+		case strings.HasSuffix(entry.Name(), spoolFileExt):
+			bytes += info.Size()
+		}
+	}
+
+	usage, _ := spoolUsages.LoadOrStore(dir, &spoolUsage{bytes: bytes})
+	return &meteringSpool{dir: dir, maxBytes: maxBytes, fsync: fsync, usage: usage.(*spoolUsage)}, nil
+}
+
+// write persists a payload and returns its spool file. The write is atomic: the
+// payload is written to a temporary file which is renamed into place.
+func (s *meteringSpool) write(payload *MeteringPayload) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", NewMeteringError("failed to marshal spooled payload", err)
+	}
+
+	s.usage.mu.Lock()
+	if s.usage.bytes+int64(len(data)) > s.maxBytes {
+		s.usage.mu.Unlock()
+		return "", NewMeteringError(fmt.Sprintf("metering spool is full (%d bytes)", s.maxBytes), nil)
+	}
+	s.usage.bytes += int64(len(data))
+	s.usage.mu.Unlock()
+
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq.Add(1)%1000000, spoolFileExt)
+	path := filepath.Join(s.dir, name)
+	// Claim the file before it appears, so a replay running meanwhile skips it
+	s.claim(path)
+	if err := s.writeFile(path, data); err != nil {
+		s.unclaim(path)
+		s.release(int64(len(data)))
+		return "", NewMeteringError("failed to write spooled payload", err)
+	}
+	return path, nil
+}
+
+func (s *meteringSpool) writeFile(path string, data []byte) error {
+	tmp := path + spoolTempExt
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if s.fsync == SpoolFsyncAlways {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if s.fsync == SpoolFsyncAlways {
+		// The rename is only durable once the directory entry is flushed
+		return syncDir(s.dir)
+	}
+	return nil
+}
+
+// syncDir flushes a directory to stable storage. Windows cannot sync
+// directories, and renames there are durable once they return.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// remove deletes an acknowledged event from the spool
+func (s *meteringSpool) remove(path string) {
+	defer s.unclaim(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		Warn("Failed to remove spooled metering event %s: %v", path, err)
+		return
+	}
+	s.release(info.Size())
+}
+
+// claim marks a spool file as queued by this client. It returns false if
+// another client of the process has already claimed it.
+func (s *meteringSpool) claim(path string) bool {
+	_, claimed := spoolClaims.LoadOrStore(path, struct{}{})
+	return !claimed
+}
+
+// unclaim makes a spool file that stays in the spool available for replay
+func (s *meteringSpool) unclaim(path string) {
+	spoolClaims.Delete(path)
+}
+
+func (s *meteringSpool) release(n int64) {
+	s.usage.mu.Lock()
+	s.usage.bytes -= n
+	s.usage.mu.Unlock()
+}
+
+// pending claims and returns the events left in the spool, oldest first. Files
+// claimed by other clients of the process are in flight and are skipped.
+func (s *meteringSpool) pending() []meteringEvent {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		Warn("Failed to read metering spool directory: %v", err)
+		return nil
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), spoolFileExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	events := make([]meteringEvent, 0, len(names))
+	for _, name := range names {
+		path := filepath.Join(s.dir, name)
+		if !s.claim(path) {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				Warn("Failed to read spooled metering event %s: %v", path, err)
+			}
+			s.unclaim(path)
+			continue
+		}
+		var payload *MeteringPayload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			Warn("Discarding corrupt spooled metering event %s: %v", path, err)
+			s.remove(path)
+			continue
+		}
+		events = append(events, meteringEvent{payload: payload, spoolFile: path})
+	}
+	return events
+}
@@ -0,0 +1,209 @@
+package revenium
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeteringSpoolWriteAndRemove(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "partial.json.tmp")
+	require.NoError(t, os.WriteFile(stale, []byte("{"), 0o600))
+	old := time.Now().Add(-2 * spoolTempStaleAge)
+	require.NoError(t, os.Chtimes(stale, old, old))
+	fresh := filepath.Join(dir, "writing.json.tmp")
+	require.NoError(t, os.WriteFile(fresh, []byte("{"), 0o600))
+
+	spool, err := openMeteringSpool(dir, 0, SpoolFsyncAlways)
+	require.NoError(t, err)
+
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err), "partial writes of crashed processes are cleaned up on open")
+	_, err = os.Stat(fresh)
+	assert.NoError(t, err, "writes that may be in progress are kept")
+
+	first, err := spool.write(testPayload("tx-1"))
+	require.NoError(t, err)
+	second, err := spool.write(testPayload("tx-2"))
+	require.NoError(t, err)
+	assert.Empty(t, spool.pending(), "written events are claimed until settled")
+
+	spool.unclaim(first)
+	spool.unclaim(second)
+	events := spool.pending()
+	require.Len(t, events, 2)
+	assert.Equal(t, "tx-1", events[0].payload.TransactionID)
+	assert.Equal(t, "tx-2", events[1].payload.TransactionID)
+	assert.Empty(t, spool.pending(), "replayed events are claimed")
+
+	spool.remove(first)
+	spool.unclaim(second)
+	events = spool.pending()
+	require.Len(t, events, 1)
+	assert.Equal(t, "tx-2", events[0].payload.TransactionID)
+	spool.remove(second)
+}
+
+func TestMeteringSpoolSizeCap(t *testing.T) {
+	// Room for one payload but not two
+	data, err := json.Marshal(testPayload("tx-1"))
+	require.NoError(t, err)
+	spool, err := openMeteringSpool(t.TempDir(), int64(len(data)*3/2), SpoolFsyncNever)
+	require.NoError(t, err)
+
+	_, err = spool.write(testPayload("tx-1"))
+	require.NoError(t, err)
+	_, err = spool.write(testPayload("tx-2"))
+	assert.True(t, IsMeteringError(err))
+}
+
+func TestMeteringSpoolSizeCapIsSharedByClients(t *testing.T) {
+	data, err := json.Marshal(testPayload("tx-1"))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	first, err := openMeteringSpool(dir, int64(len(data)*3/2), SpoolFsyncNever)
+	require.NoError(t, err)
+	second, err := openMeteringSpool(dir, int64(len(data)*3/2), SpoolFsyncNever)
+	require.NoError(t, err)
+
+	path, err := first.write(testPayload("tx-1"))
+	require.NoError(t, err)
+	_, err = second.write(testPayload("tx-2"))
+	assert.True(t, IsMeteringError(err), "the other client's events count against the maximum")
+
+	second.remove(path)
+	_, err = first.write(testPayload("tx-3"))
+	assert.NoError(t, err, "events removed by either client free their space")
+}
+
+func TestSpooledEventsReplayOnNextClient(t *testing.T) {
+	dir := t.TempDir()
+
+	var failing atomic.Bool
+	failing.Store(true)
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received.Add(1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	cfg := &Config{ReveniumAPIKey: "hak_test", ReveniumBaseURL: server.URL, SpoolDir: dir}
+
+	first, err := NewReveniumOpenAI(cfg)
+	require.NoError(t, err)
+	first.enqueueMetering(context.Background(), testPayload("tx-1"))
+	require.NoError(t, first.Close())
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Len(t, files, 1, "undelivered event stays in the spool")
+
+	failing.Store(false)
+	second, err := NewReveniumOpenAI(cfg)
+	require.NoError(t, err)
+	require.NoError(t, second.Close())
+
+	assert.Equal(t, int32(1), received.Load())
+	files, _ = filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Empty(t, files, "delivered event is removed from the spool")
+}
+
+// gatedSink holds every Send until release is closed
+type gatedSink struct {
+	*MemorySink
+	release chan struct{}
+}
+
+func (s gatedSink) Send(ctx context.Context, payload *MeteringPayload) error {
+	<-s.release
+	return s.MemorySink.Send(ctx, payload)
+}
+
+func TestSpooledEventsInFlightAreNotReplayedByAnotherClient(t *testing.T) {
+	dir := t.TempDir()
+	firstSink := gatedSink{MemorySink: NewMemorySink(), release: make(chan struct{})}
+	first, err := NewReveniumOpenAI(&Config{Sink: firstSink, SpoolDir: dir})
+	require.NoError(t, err)
+	first.enqueueMetering(context.Background(), testPayload("tx-1"))
+
+	secondSink := NewMemorySink()
+	second, err := NewReveniumOpenAI(&Config{Sink: secondSink, SpoolDir: dir})
+	require.NoError(t, err)
+	require.NoError(t, second.Close())
+	assert.Empty(t, secondSink.Payloads(), "event in flight in another client is not replayed")
+
+	close(firstSink.release)
+	require.NoError(t, first.Close())
+	assert.Len(t, firstSink.Payloads(), 1)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Empty(t, files)
+}
+
+func TestSpooledEventsAbandonedAtShutdownAreReplayed(t *testing.T) {
+	dir := t.TempDir()
+	first, err := NewReveniumOpenAI(&Config{Sink: stalledSink{}, SpoolDir: dir, MeteringWorkers: 1})
+	require.NoError(t, err)
+	first.enqueueMetering(context.Background(), testPayload("tx-1"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.Error(t, first.Shutdown(ctx))
+
+	sink := NewMemorySink()
+	second, err := NewReveniumOpenAI(&Config{Sink: sink, SpoolDir: dir})
+	require.NoError(t, err)
+	require.NoError(t, second.Close())
+
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, "tx-1", payloads[0].TransactionID)
+}
+
+func TestSpooledEventsKeptWhenRateLimitedOrUnauthorized(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			dir := t.TempDir()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			client, err := NewReveniumOpenAI(&Config{ReveniumAPIKey: "hak_test", ReveniumBaseURL: server.URL, SpoolDir: dir})
+			require.NoError(t, err)
+			client.enqueueMetering(context.Background(), testPayload("tx-1"))
+			require.NoError(t, client.Close())
+
+			files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+			assert.Len(t, files, 1, "transiently failed event stays in the spool")
+		})
+	}
+}
+
+func TestSpooledEventRemovedWhenRejected(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}))
+	defer server.Close()
+
+	client, err := NewReveniumOpenAI(&Config{ReveniumAPIKey: "hak_test", ReveniumBaseURL: server.URL, SpoolDir: dir})
+	require.NoError(t, err)
+	client.enqueueMetering(context.Background(), testPayload("tx-1"))
+	require.NoError(t, client.Close())
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Empty(t, files, "permanently rejected event is discarded")
+}
@@ -1,6 +1,8 @@
 package revenium
 
 import (
+	"context"
+	"errors"
 	"strings"
 )
 
@@ -70,3 +72,98 @@ func MapOpenAIFinishReason(finishReason string, defaultReason ReveniumStopReason
 		return defaultReason
 	}
 }
+
+// MapResponseStatus maps an OpenAI Responses API status (and the optional
+// incomplete_details.reason) to a Revenium stopReason
+//
+// SPECIFICATION REFERENCES:
+//   - OpenAI Response object status and incomplete_details:
+//     https://platform.openai.com/docs/api-reference/responses/object
+//
+// MAPPING RATIONALE:
+// - completed → END
+// - incomplete + max_output_tokens → TOKEN_LIMIT
+// - incomplete + content_filter → ERROR
+// - incomplete with unknown reason → defaultReason
+// - failed → ERROR
+// - cancelled → CANCELLED
+// - Empty/in-progress/queued/unknown values → defaultReason
+func MapResponseStatus(status string, incompleteReason string, defaultReason ReveniumStopReason) ReveniumStopReason {
+	switch strings.ToLower(status) {
+	case "completed":
+		return StopReasonEnd
+
+	case "incomplete":
+		switch strings.ToLower(incompleteReason) {
+		case "max_output_tokens":
+			return StopReasonTokenLimit
+		case "content_filter":
+			return StopReasonError
+		default:
+			return defaultReason
+		}
+
+	case "failed":
+		return StopReasonError
+
+	case "cancelled":
+		return StopReasonCancelled
+
+	case "", "in_progress", "queued":
+		return defaultReason
+
+	default:
+		Warn("Unknown response status: %q. Using fallback: %q.", status, defaultReason)
+		return defaultReason
+	}
+}
+
+// MapRequestError maps the error of a failed or interrupted request to a
+// Revenium stopReason
+//
+// MAPPING RATIONALE:
+// - context.Canceled (caller cancelled the request or stream) → CANCELLED
+// - context.DeadlineExceeded (caller's deadline passed) → TIMEOUT
+// - Any other error → ERROR
+func MapRequestError(err error) ReveniumStopReason {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return StopReasonCancelled
+	case errors.Is(err, context.DeadlineExceeded):
+		return StopReasonTimeout
+	default:
+		return StopReasonError
+	}
+}
+
+// stopReasonPrecedence orders stop reasons from most to least significant
+var stopReasonPrecedence = []ReveniumStopReason{
+	StopReasonError,
+	StopReasonCancelled,
+	StopReasonTimeout,
+	StopReasonCostLimit,
+	StopReasonCompletionLimit,
+	StopReasonTokenLimit,
+	StopReasonEndSequence,
+	StopReasonEnd,
+}
+
+// AggregateStopReason derives the stop reason of a request from the stop
+// reasons of its choices (n > 1)
+//
+// PRECEDENCE (most significant wins):
+// ERROR > CANCELLED > TIMEOUT > COST_LIMIT > COMPLETION_LIMIT > TOKEN_LIMIT > END_SEQUENCE > END
+//
+// A request is reported as END only if every choice ended normally, so a
+// single filtered or truncated choice is not hidden by the others.
+// Returns defaultReason when there are no choices.
+func AggregateStopReason(reasons []ReveniumStopReason, defaultReason ReveniumStopReason) ReveniumStopReason {
+	for _, candidate := range stopReasonPrecedence {
+		for _, reason := range reasons {
+			if reason == candidate {
+				return candidate
+			}
+		}
+	}
+	return defaultReason
+}
@@ -1,6 +1,9 @@
 package revenium
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"testing"
 )
 
@@ -133,3 +136,126 @@ func TestMapOpenAIFinishReason(t *testing.T) {
 	}
 }
 
+func TestMapResponseStatus(t *testing.T) {
+	tests := []struct {
+		name             string
+		status           string
+		incompleteReason string
+		defaultReason    ReveniumStopReason
+		expectedReason   ReveniumStopReason
+	}{
+		{
+			name:           "completed maps to END",
+			status:         "completed",
+			defaultReason:  StopReasonEnd,
+			expectedReason: StopReasonEnd,
+		},
+		{
+			name:             "incomplete max_output_tokens maps to TOKEN_LIMIT",
+			status:           "incomplete",
+			incompleteReason: "max_output_tokens",
+			defaultReason:    StopReasonEnd,
+			expectedReason:   StopReasonTokenLimit,
+		},
+		{
+			name:             "incomplete content_filter maps to ERROR",
+			status:           "incomplete",
+			incompleteReason: "content_filter",
+			defaultReason:    StopReasonEnd,
+			expectedReason:   StopReasonError,
+		},
+		{
+			name:           "incomplete without reason uses default",
+			status:         "incomplete",
+			defaultReason:  StopReasonEnd,
+			expectedReason: StopReasonEnd,
+		},
+		{
+			name:           "failed maps to ERROR",
+			status:         "failed",
+			defaultReason:  StopReasonEnd,
+			expectedReason: StopReasonError,
+		},
+		{
+			name:           "cancelled maps to CANCELLED",
+			status:         "cancelled",
+			defaultReason:  StopReasonEnd,
+			expectedReason: StopReasonCancelled,
+		},
+		{
+			name:           "Empty status uses default",
+			status:         "",
+			defaultReason:  StopReasonEnd,
+			expectedReason: StopReasonEnd,
+		},
+		{
+			name:           "Unknown status uses custom default",
+			status:         "some_new_status",
+			defaultReason:  StopReasonError,
+			expectedReason: StopReasonError,
+		},
+		{
+			name:           "Uppercase COMPLETED maps to END",
+			status:         "COMPLETED",
+			defaultReason:  StopReasonError,
+			expectedReason: StopReasonEnd,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := MapResponseStatus(tt.status, tt.incompleteReason, tt.defaultReason)
+			if result != tt.expectedReason {
+				t.Errorf("MapResponseStatus(%q, %q, %q) = %q, want %q",
+					tt.status, tt.incompleteReason, tt.defaultReason, result, tt.expectedReason)
+			}
+		})
+	}
+}
+
+func TestMapRequestError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectedReason ReveniumStopReason
+	}{
+		{name: "context.Canceled maps to CANCELLED", err: context.Canceled, expectedReason: StopReasonCancelled},
+		{name: "Wrapped context.Canceled maps to CANCELLED", err: fmt.Errorf("Post \"https://api.openai.com\": %w", context.Canceled), expectedReason: StopReasonCancelled},
+		{name: "context.DeadlineExceeded maps to TIMEOUT", err: context.DeadlineExceeded, expectedReason: StopReasonTimeout},
+		{name: "Wrapped context.DeadlineExceeded maps to TIMEOUT", err: fmt.Errorf("read: %w", context.DeadlineExceeded), expectedReason: StopReasonTimeout},
+		{name: "Other errors map to ERROR", err: errors.New("bad request"), expectedReason: StopReasonError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := MapRequestError(tt.err)
+			if result != tt.expectedReason {
+				t.Errorf("MapRequestError(%v) = %q, want %q", tt.err, result, tt.expectedReason)
+			}
+		})
+	}
+}
+
+func TestAggregateStopReason(t *testing.T) {
+	tests := []struct {
+		name           string
+		reasons        []ReveniumStopReason
+		expectedReason ReveniumStopReason
+	}{
+		{name: "No choices uses default", reasons: nil, expectedReason: StopReasonEnd},
+		{name: "Single choice", reasons: []ReveniumStopReason{StopReasonTokenLimit}, expectedReason: StopReasonTokenLimit},
+		{name: "All choices ended", reasons: []ReveniumStopReason{StopReasonEnd, StopReasonEnd, StopReasonEnd}, expectedReason: StopReasonEnd},
+		{name: "TOKEN_LIMIT beats END", reasons: []ReveniumStopReason{StopReasonEnd, StopReasonTokenLimit, StopReasonEnd}, expectedReason: StopReasonTokenLimit},
+		{name: "ERROR beats TOKEN_LIMIT", reasons: []ReveniumStopReason{StopReasonTokenLimit, StopReasonError}, expectedReason: StopReasonError},
+		{name: "END_SEQUENCE beats END", reasons: []ReveniumStopReason{StopReasonEnd, StopReasonEndSequence}, expectedReason: StopReasonEndSequence},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := AggregateStopReason(tt.reasons, StopReasonEnd)
+			if result != tt.expectedReason {
+				t.Errorf("AggregateStopReason(%v) = %q, want %q", tt.reasons, result, tt.expectedReason)
+			}
+		})
+	}
+}
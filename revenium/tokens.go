@@ -0,0 +1,240 @@
+package revenium
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/tiktoken-go/tokenizer"
+)
+
+// TokenEncoding is a BPE encoding used to estimate token counts locally
+type TokenEncoding string
+
+const (
+	TokenEncodingCl100k TokenEncoding = "cl100k_base" // GPT-4, GPT-3.5 and embedding models
+	TokenEncodingO200k  TokenEncoding = "o200k_base"  // GPT-4o, GPT-4.1, GPT-5 and o-series models
+)
+
+// defaultTokenEncoding is used for models of unknown family, e.g. Azure
+// deployment names or OpenAI-compatible backends
+const defaultTokenEncoding = TokenEncodingCl100k
+
+// modelFamilyEncodings maps model name prefixes to their encoding
+var modelFamilyEncodings = map[string]TokenEncoding{
+	"gpt-5":      TokenEncodingO200k,
+	"gpt-4.1":    TokenEncodingO200k,
+	"gpt-4.5":    TokenEncodingO200k,
+	"gpt-4o":     TokenEncodingO200k,
+	"chatgpt-4o": TokenEncodingO200k,
+	"o1":         TokenEncodingO200k,
+	"o3":         TokenEncodingO200k,
+	"o4":         TokenEncodingO200k,
+	"gpt-4":      TokenEncodingCl100k,
+	"gpt-3.5":    TokenEncodingCl100k,
+	"gpt-35":     TokenEncodingCl100k,
+	"text-embed": TokenEncodingCl100k,
+	"ft:gpt-4o":  TokenEncodingO200k,
+	"ft:gpt-4":   TokenEncodingCl100k,
+	"ft:gpt-3.5": TokenEncodingCl100k,
+	"ft:gpt-4.1": TokenEncodingO200k,
+}
+
+// Per-message overhead of the chat format, as documented in the OpenAI cookbook
+const (
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	tokensPerReply   = 3
+)
+
+var (
+	codecsMu sync.Mutex
+	codecs   = map[TokenEncoding]tokenizer.Codec{}
+)
+
+// encodingForModel picks the encoding for a model: the longest matching prefix
+// in overrides wins, then the built-in model families, then the default
+func encodingForModel(model string, overrides map[string]TokenEncoding) TokenEncoding {
+	model = strings.ToLower(model)
+	if enc, ok := longestPrefixMatch(model, overrides); ok {
+		return enc
+	}
+	if enc, ok := longestPrefixMatch(model, modelFamilyEncodings); ok {
+		return enc
+	}
+	return defaultTokenEncoding
+}
+
+// longestPrefixMatch returns the value of the longest key of values that model starts with
+func longestPrefixMatch[V any](model string, values map[string]V) (V, bool) {
+	prefixes := make([]string, 0, len(values))
+	for prefix := range values {
+		if strings.HasPrefix(model, strings.ToLower(prefix)) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if len(prefixes) == 0 {
+		var zero V
+		return zero, false
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	return values[prefixes[0]], true
+}
+
+// codecFor returns a shared codec for the encoding; codecs are built lazily
+// because loading the BPE ranks is expensive
+func codecFor(enc TokenEncoding) tokenizer.Codec {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	if codec, ok := codecs[enc]; ok {
+		return codec
+	}
+	codec, err := tokenizer.Get(tokenizer.Encoding(enc))
+	if err != nil {
+		Warn("Unsupported token encoding %q, using %q", enc, defaultTokenEncoding)
+		codec, _ = tokenizer.Get(tokenizer.Encoding(defaultTokenEncoding))
+	}
+	codecs[enc] = codec
+	return codec
+}
+
+// countTokens counts the tokens of text in the given encoding
+func countTokens(enc TokenEncoding, text string) int64 {
+	if text == "" {
+		return 0
+	}
+	n, err := codecFor(enc).Count(text)
+	if err != nil {
+		Debug("Token estimation failed: %v", err)
+		return 0
+	}
+	return int64(n)
+}
+
+// estimatePromptTokens estimates the prompt tokens of a chat request: message
+// text plus the per-message overhead of the chat format
+func estimatePromptTokens(enc TokenEncoding, messages []openai.ChatCompletionMessageParamUnion) int64 {
+	if len(messages) == 0 {
+		return 0
+	}
+	total := int64(tokensPerReply)
+	for _, msg := range messages {
+		total += tokensPerMessage
+		total += countTokens(enc, messageRole(msg))
+		if name := msg.GetName(); name != nil && *name != "" {
+			total += countTokens(enc, *name) + tokensPerName
+		}
+		total += countTokens(enc, messageText(msg))
+	}
+	return total
+}
+
+// messageRole returns the role of a message; the role fields of the param
+// types are zero-valued constants that only get their value when marshaled
+func messageRole(msg openai.ChatCompletionMessageParamUnion) string {
+	switch {
+	case msg.OfDeveloper != nil:
+		return "developer"
+	case msg.OfSystem != nil:
+		return "system"
+	case msg.OfUser != nil:
+		return "user"
+	case msg.OfAssistant != nil:
+		return "assistant"
+	case msg.OfTool != nil:
+		return "tool"
+	case msg.OfFunction != nil:
+		return "function"
+	}
+	return ""
+}
+
+// messageText concatenates the text parts, refusals and tool call arguments of a message
+func messageText(msg openai.ChatCompletionMessageParamUnion) string {
+	var b strings.Builder
+	switch content := msg.GetContent().AsAny().(type) {
+	case *string:
+		b.WriteString(*content)
+	case *[]openai.ChatCompletionContentPartTextParam:
+		for _, part := range *content {
+			b.WriteString(part.Text)
+		}
+	case *[]openai.ChatCompletionContentPartUnionParam:
+		for _, part := range *content {
+			if part.OfText != nil {
+				b.WriteString(part.OfText.Text)
+			}
+		}
+	case *[]openai.ChatCompletionAssistantMessageParamContentArrayOfContentPartUnion:
+		for _, part := range *content {
+			if part.OfText != nil {
+				b.WriteString(part.OfText.Text)
+			} else if part.OfRefusal != nil {
+				b.WriteString(part.OfRefusal.Refusal)
+			}
+		}
+	}
+	if refusal := msg.GetRefusal(); refusal != nil {
+		b.WriteString(*refusal)
+	}
+	for _, call := range msg.GetToolCalls() {
+		if call.OfFunction != nil {
+			b.WriteString(call.OfFunction.Function.Name)
+			b.WriteString(call.OfFunction.Function.Arguments)
+		}
+	}
+	return b.String()
+}
+
+// completionText concatenates the generated text of every choice of a completion
+func completionText(resp *openai.ChatCompletion) string {
+	var b strings.Builder
+	for _, choice := range resp.Choices {
+		b.WriteString(choice.Message.Content)
+		b.WriteString(choice.Message.Refusal)
+		for _, call := range choice.Message.ToolCalls {
+			b.WriteString(call.Function.Name)
+			b.WriteString(call.Function.Arguments)
+		}
+	}
+	return b.String()
+}
+
+// tokenEstimate holds locally estimated token counts for a call the provider
+// returned no usage for
+type tokenEstimate struct {
+	prompt     int64
+	completion int64
+}
+
+// estimateTokens estimates prompt and completion tokens for a chat call, or
+// returns nil if estimation is disabled
+func estimateTokens(cfg *Config, model string, messages []openai.ChatCompletionMessageParamUnion, completion string) *tokenEstimate {
+	var overrides map[string]TokenEncoding
+	if cfg != nil {
+		if cfg.TokenEstimationDisabled {
+			return nil
+		}
+		overrides = cfg.TokenEncodings
+	}
+	enc := encodingForModel(model, overrides)
+	return &tokenEstimate{
+		prompt:     estimatePromptTokens(enc, messages),
+		completion: countTokens(enc, completion),
+	}
+}
+
+// apply overwrites the payload token counts with the estimate and marks it as estimated
+func (e *tokenEstimate) apply(payload *MeteringPayload) {
+	if e == nil {
+		return
+	}
+	payload.InputTokenCount = e.prompt
+	payload.OutputTokenCount = e.completion
+	payload.TotalTokenCount = e.prompt + e.completion
+	payload.ReasoningTokenCount = 0
+	payload.CacheReadTokenCount = 0
+	payload.TokensEstimated = true
+}
@@ -0,0 +1,68 @@
+package revenium
+
+import (
+	"testing"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodingForModel(t *testing.T) {
+	tests := []struct {
+		model     string
+		overrides map[string]TokenEncoding
+		expected  TokenEncoding
+	}{
+		{model: "gpt-4o-mini", expected: TokenEncodingO200k},
+		{model: "gpt-4.1-nano", expected: TokenEncodingO200k},
+		{model: "gpt-5", expected: TokenEncodingO200k},
+		{model: "o3-mini", expected: TokenEncodingO200k},
+		{model: "gpt-4-turbo", expected: TokenEncodingCl100k},
+		{model: "gpt-3.5-turbo", expected: TokenEncodingCl100k},
+		{model: "text-embedding-3-small", expected: TokenEncodingCl100k},
+		{model: "my-azure-deployment", expected: defaultTokenEncoding},
+		{model: "my-azure-deployment", overrides: map[string]TokenEncoding{"my-azure": TokenEncodingO200k}, expected: TokenEncodingO200k},
+		{model: "gpt-4o-mini", overrides: map[string]TokenEncoding{"gpt-4o-mini": TokenEncodingCl100k}, expected: TokenEncodingCl100k},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			assert.Equal(t, tt.expected, encodingForModel(tt.model, tt.overrides))
+		})
+	}
+}
+
+func TestCountTokens(t *testing.T) {
+	assert.Equal(t, int64(2), countTokens(TokenEncodingCl100k, "hello world"))
+	assert.Equal(t, int64(2), countTokens(TokenEncodingO200k, "hello world"))
+	assert.Zero(t, countTokens(TokenEncodingO200k, ""))
+}
+
+func TestEstimatePromptTokens(t *testing.T) {
+	messages := []openai.ChatCompletionMessageParamUnion{
+		openai.SystemMessage("You are helpful."),
+		openai.UserMessage("hello world"),
+	}
+	// 3 reply priming + per message (3 + role + content)
+	expected := int64(3) +
+		3 + countTokens(TokenEncodingO200k, "system") + countTokens(TokenEncodingO200k, "You are helpful.") +
+		3 + countTokens(TokenEncodingO200k, "user") + countTokens(TokenEncodingO200k, "hello world")
+	assert.Equal(t, expected, estimatePromptTokens(TokenEncodingO200k, messages))
+	assert.Zero(t, estimatePromptTokens(TokenEncodingO200k, nil))
+}
+
+func TestEstimateTokensApply(t *testing.T) {
+	estimate := estimateTokens(&Config{}, "gpt-4o", []openai.ChatCompletionMessageParamUnion{openai.UserMessage("hello world")}, "hello world")
+	require.NotNil(t, estimate)
+
+	payload := testPayload("tx-1")
+	estimate.apply(payload)
+	assert.True(t, payload.TokensEstimated)
+	assert.Equal(t, int64(2), payload.OutputTokenCount)
+	assert.Equal(t, payload.InputTokenCount+payload.OutputTokenCount, payload.TotalTokenCount)
+
+	assert.Nil(t, estimateTokens(&Config{TokenEstimationDisabled: true}, "gpt-4o", nil, "hello"))
+	var none *tokenEstimate
+	none.apply(payload) // nil estimate is a no-op
+}
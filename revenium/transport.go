@@ -0,0 +1,660 @@
+package revenium
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/option"
+	"github.com/openai/openai-go/v3/responses"
+)
+
+// transportRetryWait is how long a network-failed attempt is held for a retry:
+// the SDK's longest backoff after attempt retryCount, which doubles from half a
+// second up to eight, plus a margin for the retry to reach the middleware
+func transportRetryWait(retryCount int) time.Duration {
+	delay := 8 * time.Second
+	if retryCount < 4 {
+		delay = 500 * time.Millisecond << retryCount
+	}
+	return delay + 500*time.Millisecond
+}
+
+// heldAttempt is a network-failed attempt waiting to learn whether the SDK
+// retries it
+type heldAttempt struct {
+	ctx   context.Context
+	timer *time.Timer
+	meter func(ctx context.Context)
+}
+
+// heldAttempts tracks the held attempt of each MeteredResult. Whoever removes an
+// attempt from the map meters it, so it is metered exactly once.
+type heldAttempts struct {
+	mu       sync.Mutex
+	attempts map[*MeteredResult]*heldAttempt
+}
+
+func newHeldAttempts() *heldAttempts {
+	return &heldAttempts{attempts: make(map[*MeteredResult]*heldAttempt)}
+}
+
+// hold delays metering the attempt; if no retry for result starts within wait,
+// it is metered as the call's outcome
+func (h *heldAttempts) hold(ctx context.Context, result *MeteredResult, wait time.Duration, meter func(ctx context.Context)) {
+	a := &heldAttempt{ctx: ctx, meter: meter}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.attempts[result] = a
+	a.timer = time.AfterFunc(wait, func() {
+		if h.take(result, a) {
+			a.meter(a.ctx)
+		}
+	})
+}
+
+func (h *heldAttempts) take(result *MeteredResult, a *heldAttempt) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.attempts[result] != a {
+		return false
+	}
+	delete(h.attempts, result)
+	return true
+}
+
+// retried meters the attempt held for result, if any, without reporting to it,
+// since a later attempt of the same call has started
+func (h *heldAttempts) retried(result *MeteredResult) {
+	h.mu.Lock()
+	a := h.attempts[result]
+	delete(h.attempts, result)
+	h.mu.Unlock()
+	if a != nil {
+		a.timer.Stop()
+		a.meter(withoutMeteredResult(a.ctx))
+	}
+}
+
+// releaseAll meters every held attempt as its call's outcome
+func (h *heldAttempts) releaseAll() {
+	h.mu.Lock()
+	held := h.attempts
+	h.attempts = make(map[*MeteredResult]*heldAttempt)
+	h.mu.Unlock()
+	for _, a := range held {
+		a.timer.Stop()
+		a.meter(a.ctx)
+	}
+}
+
+// meteredEndpoint identifies which OpenAI API a transport-level request targets
+type meteredEndpoint int
+
+const (
+	endpointUnmetered meteredEndpoint = iota
+	endpointChatCompletions
+	endpointResponses
+	endpointEmbeddings
+)
+
+// MeteringMiddleware returns an openai-go request option that meters every chat
+// completion, Responses API and embeddings call made through a plain openai.Client
+// with this client, so pending events are covered by Flush and Shutdown:
+//
+//	client := openai.NewClient(r.MeteringMiddleware())
+//
+// Payloads match the ones produced by Chat(), Responses() and Embeddings():
+// chat completion request parameters and tool choice are decoded from the
+// request body, which is also used for local token estimation when the
+// response carries no usage.
+//
+// The middleware runs once per attempt of a request the SDK retries. An attempt
+// rejected with an HTTP error is metered only if the SDK returns it to the
+// caller, so a retried call is metered once, by its final attempt. Attempts
+// that fail before a response is received are metered each, with their
+// retryNumber, since the middleware cannot tell whether the SDK retries them.
+// When the call carries a MeteredResult, such an attempt is held until the SDK's
+// next retry would have started: it reports to the result only if none did.
+func (r *ReveniumOpenAI) MeteringMiddleware() option.RequestOption {
+	return option.WithMiddleware(r.meterHTTP)
+}
+
+// meterHTTP is the option.Middleware that inspects request and response bodies
+func (r *ReveniumOpenAI) meterHTTP(req *http.Request, next option.MiddlewareNext) (*http.Response, error) {
+	endpoint := classifyEndpoint(req)
+	if endpoint == endpointUnmetered {
+		return next(req)
+	}
+
+	reqInfo, err := peekRequestBody(req, endpoint)
+	if err != nil {
+		Debug("Unable to read request body for metering: %v", err)
+		return next(req)
+	}
+
+	provider := "OPENAI"
+	if IsAzureEndpoint(req.URL.Host) {
+		provider = "AZURE"
+	}
+
+	if result := GetMeteredResult(req.Context()); result != nil {
+		r.attempts.retried(result)
+	}
+
+	metadata := r.callMetadata(req.Context(), nil)
+	retryCount, _ := strconv.Atoi(req.Header.Get("X-Stainless-Retry-Count"))
+	if retryCount > 0 {
+		if _, ok := metadata["retryNumber"]; !ok {
+			metadata = MergeMetadata(metadata, map[string]interface{}{"retryNumber": strconv.Itoa(retryCount)})
+		}
+	}
+
+	requestTime := time.Now()
+	resp, err := next(req)
+	if err != nil {
+		// The SDK may retry an attempt that failed without a response, unless
+		// the context is done, so the attempt does not report to the caller's
+		// MeteredResult
+		ctx := req.Context()
+		duration := time.Since(requestTime)
+		meter := func(ctx context.Context) {
+			r.meterTransportError(ctx, endpoint, reqInfo, metadata, duration, provider, requestTime, requestError(req.Context(), err))
+		}
+		if result := GetMeteredResult(ctx); result != nil && ctx.Err() == nil {
+			// The SDK may still retry the attempt, so only the absence of a
+			// retry tells whether this was the call's outcome
+			r.attempts.hold(ctx, result, transportRetryWait(retryCount), meter)
+			return resp, err
+		}
+		meter(ctx)
+		return resp, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		duration := time.Since(requestTime)
+		statusErr := fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+		resp.Body = newFailedAttemptBody(body, func() {
+			r.meterTransportError(req.Context(), endpoint, reqInfo, metadata, duration, provider, requestTime, statusErr)
+		})
+		return resp, nil
+	}
+
+	if reqInfo.Stream {
+		t := &transportStream{
+			ctx:         req.Context(),
+			parent:      r,
+			endpoint:    endpoint,
+			request:     reqInfo,
+			metadata:    metadata,
+			provider:    provider,
+			requestTime: requestTime,
+		}
+		resp.Body = newSSEMeteringBody(resp.Body, t.onEvent, t.finish)
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		r.meterTransportError(req.Context(), endpoint, reqInfo, metadata, time.Since(requestTime), provider, requestTime, requestError(req.Context(), err))
+		return resp, nil
+	}
+
+	duration := time.Since(requestTime)
+	payload, err := r.buildTransportPayload(endpoint, reqInfo, body, metadata, duration, provider, requestTime)
+	if err != nil {
+		Debug("Unable to decode response body for metering: %v", err)
+		return resp, nil
+	}
+	r.dispatchTransportPayload(req.Context(), payload)
+
+	return resp, nil
+}
+
+// classifyEndpoint maps a request to the API it targets; only POSTs that create
+// completions, responses or embeddings are metered
+func classifyEndpoint(req *http.Request) meteredEndpoint {
+	if req.Method != http.MethodPost || req.URL == nil {
+		return endpointUnmetered
+	}
+
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	switch {
+	case strings.HasSuffix(path, "/chat/completions"):
+		return endpointChatCompletions
+	case strings.HasSuffix(path, "/responses"):
+		return endpointResponses
+	case strings.HasSuffix(path, "/embeddings"):
+		return endpointEmbeddings
+	default:
+		return endpointUnmetered
+	}
+}
+
+// transportRequestInfo holds the request fields needed for metering
+type transportRequestInfo struct {
+	Model  string `json:"model"`
+	Stream bool   `json:"stream"`
+
+	// chat is the decoded request of a chat completion, for its request
+	// parameters and local token estimation
+	chat *openai.ChatCompletionNewParams
+}
+
+// peekRequestBody decodes the request body and restores it for the next handler
+func peekRequestBody(req *http.Request, endpoint meteredEndpoint) (transportRequestInfo, error) {
+	var info transportRequestInfo
+	if req.Body == nil {
+		return info, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	if err != nil {
+		return info, err
+	}
+
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &info); err != nil {
+			return info, err
+		}
+	}
+	if endpoint == endpointChatCompletions && len(body) > 0 {
+		var params openai.ChatCompletionNewParams
+		if err := json.Unmarshal(body, &params); err != nil {
+			Debug("Unable to decode chat request parameters for metering: %v", err)
+		} else {
+			info.chat = &params
+		}
+	}
+	return info, nil
+}
+
+// buildTransportPayload decodes a non-streaming response body and builds its
+// metering payload; chat completions also get the request parameters and, if
+// the response has no usage, locally estimated tokens
+func (r *ReveniumOpenAI) buildTransportPayload(endpoint meteredEndpoint, info transportRequestInfo, body []byte, metadata map[string]interface{}, duration time.Duration, provider string, requestTime time.Time) (*MeteringPayload, error) {
+	switch endpoint {
+	case endpointChatCompletions:
+		var resp openai.ChatCompletion
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, err
+		}
+		payload := buildMeteringPayload(&resp, metadata, false, duration, provider, requestTime, nil, 0)
+		addRequestDetails(payload, info.chat)
+		if !resp.JSON.Usage.Valid() {
+			r.estimateTransportTokens(info, &resp).apply(payload)
+		}
+		return payload, nil
+	case endpointResponses:
+		var resp responses.Response
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, err
+		}
+		return buildResponsesMeteringPayload(&resp, metadata, false, duration, provider, requestTime, nil, 0), nil
+	case endpointEmbeddings:
+		var resp openai.CreateEmbeddingResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, err
+		}
+		return buildEmbeddingMeteringPayload(&resp, metadata, duration, provider, requestTime), nil
+	default:
+		return nil, fmt.Errorf("unsupported endpoint: %d", endpoint)
+	}
+}
+
+// estimateTransportTokens estimates the tokens of a chat completion from its
+// decoded request, or returns nil if the request could not be decoded
+func (r *ReveniumOpenAI) estimateTransportTokens(info transportRequestInfo, resp *openai.ChatCompletion) *tokenEstimate {
+	if info.chat == nil {
+		return nil
+	}
+	model := resp.Model
+	if model == "" {
+		model = info.Model
+	}
+	Debug("No usage in response for model %s, estimating tokens locally", model)
+	return estimateTokens(r.config, model, info.chat.Messages, completionText(resp))
+}
+
+// meterTransportError sends an error metering payload for a failed transport-level
+// request; the stop reason is derived from err with MapRequestError
+func (r *ReveniumOpenAI) meterTransportError(ctx context.Context, endpoint meteredEndpoint, info transportRequestInfo, metadata map[string]interface{}, duration time.Duration, provider string, requestTime time.Time, err error) {
+	payload := buildErrorMeteringPayload(info.Model, metadata, info.Stream, duration, provider, requestTime, err.Error())
+	addRequestDetails(payload, info.chat)
+	payload.StopReason = MapRequestError(err)
+	if endpoint == endpointEmbeddings {
+		payload.OperationType = OperationTypeEmbed
+	}
+	r.dispatchTransportPayload(ctx, payload)
+}
+
+// dispatchTransportPayload hands a payload to the client's metering queue
+func (r *ReveniumOpenAI) dispatchTransportPayload(ctx context.Context, payload *MeteringPayload) {
+	Debug("[METERING] Queueing transport metering data...")
+	r.enqueueMetering(ctx, payload)
+}
+
+// transportStream accumulates SSE events of a streamed response for metering.
+// The SDK may close the body from another goroutine while it is being read, so
+// onEvent and finish hold mu.
+type transportStream struct {
+	ctx            context.Context
+	parent         *ReveniumOpenAI
+	endpoint       meteredEndpoint
+	request        transportRequestInfo
+	metadata       map[string]interface{}
+	provider       string
+	requestTime    time.Time
+	mu             sync.Mutex
+	firstTokenTime *time.Time
+
+	// Chat completions state: the choice indexes seen and those with a finish
+	// reason, so that a stream of n > 1 choices closed after the first one
+	// finished is still metered as cancelled
+	acc             openai.ChatCompletionAccumulator
+	usage           openai.CompletionUsage
+	choicesSeen     map[int64]bool
+	choicesFinished map[int64]bool
+
+	// Responses API terminal response
+	final *responses.Response
+
+	// upstreamErr is the error event the provider ended the stream with, if any
+	upstreamErr error
+
+	// finished is set once a chat stream sent [DONE], its usage chunk or a
+	// finish reason for every choice, or the Responses API sent its terminal
+	// event
+	finished bool
+}
+
+func (t *transportStream) onEvent(data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch t.endpoint {
+	case endpointChatCompletions:
+		if bytes.Equal(data, sseDoneSentinel) {
+			t.finished = true
+			return
+		}
+		if err := sseErrorEvent(data); err != nil {
+			t.upstreamErr = err
+			return
+		}
+		var chunk openai.ChatCompletionChunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return
+		}
+		if t.firstTokenTime == nil && len(chunk.Choices) > 0 {
+			now := time.Now()
+			t.firstTokenTime = &now
+		}
+		t.acc.AddChunk(chunk)
+		if chunk.Usage.PromptTokens > 0 || chunk.Usage.CompletionTokens > 0 {
+			t.usage = chunk.Usage
+			t.finished = true
+		}
+		if t.choicesSeen == nil {
+			t.choicesSeen = make(map[int64]bool)
+			t.choicesFinished = make(map[int64]bool)
+		}
+		for _, choice := range chunk.Choices {
+			t.choicesSeen[choice.Index] = true
+			if choice.FinishReason != "" {
+				t.choicesFinished[choice.Index] = true
+			}
+		}
+		if len(t.choicesFinished) > 0 && len(t.choicesFinished) == len(t.choicesSeen) && len(t.choicesFinished) >= t.requestedChoices() {
+			t.finished = true
+		}
+	case endpointResponses:
+		var event responses.ResponseStreamEventUnion
+		if err := json.Unmarshal(data, &event); err != nil {
+			return
+		}
+		if t.firstTokenTime == nil && event.Delta != "" {
+			now := time.Now()
+			t.firstTokenTime = &now
+		}
+		switch event.Type {
+		case "response.completed", "response.incomplete", "response.failed":
+			resp := event.Response
+			t.final = &resp
+			t.finished = true
+		case "error":
+			t.upstreamErr = fmt.Errorf("received error while streaming: %s", event.Message)
+		default:
+			if err := sseErrorEvent(data); err != nil {
+				t.upstreamErr = err
+			}
+		}
+	}
+}
+
+// requestedChoices returns the number of choices n the chat request asked for
+func (t *transportStream) requestedChoices() int {
+	if t.request.chat != nil && t.request.chat.N.Valid() {
+		return int(t.request.chat.N.Value)
+	}
+	return 1
+}
+
+// finish meters the stream once its body ends. A body closed before EOF is
+// metered as CANCELLED with the usage received so far, unless the stream had
+// already finished, since the SDK stops reading at the terminal event. So is a
+// Responses API stream that ends without its terminal event. A stream the
+// provider ended with an error event is metered as ERROR.
+func (t *transportStream) finish(streamErr error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	duration := time.Since(t.requestTime)
+	if t.upstreamErr != nil {
+		streamErr = t.upstreamErr
+	}
+	if errors.Is(streamErr, errSSEClosedEarly) && t.finished {
+		streamErr = nil
+	}
+	if streamErr == nil && t.endpoint == endpointResponses && t.final == nil {
+		streamErr = errSSEEndedEarly
+	}
+	if streamErr != nil {
+		streamErr = requestError(t.ctx, streamErr)
+		if MapRequestError(streamErr) == StopReasonError {
+			t.parent.meterTransportError(t.ctx, t.endpoint, t.request, t.metadata, duration, t.provider, t.requestTime, streamErr)
+			return
+		}
+	}
+
+	timeToFirstToken := int64(0)
+	if t.firstTokenTime != nil {
+		timeToFirstToken = t.firstTokenTime.Sub(t.requestTime).Milliseconds()
+	}
+
+	var payload *MeteringPayload
+	switch t.endpoint {
+	case endpointChatCompletions:
+		resp := t.acc.ChatCompletion
+		resp.Usage = t.usage
+		if resp.Model == "" {
+			resp.Model = t.request.Model
+		}
+		payload = buildMeteringPayload(&resp, t.metadata, true, duration, t.provider, t.requestTime, t.firstTokenTime, timeToFirstToken)
+		addRequestDetails(payload, t.request.chat)
+
+		// Estimate tokens locally if the stream produced output but no usage
+		usageSeen := t.usage.PromptTokens > 0 || t.usage.CompletionTokens > 0
+		if !usageSeen && (streamErr == nil || t.firstTokenTime != nil) {
+			t.parent.estimateTransportTokens(t.request, &resp).apply(payload)
+		}
+	case endpointResponses:
+		resp := t.final
+		if resp == nil {
+			resp = &responses.Response{}
+		}
+		if resp.Model == "" {
+			resp.Model = t.request.Model
+		}
+		payload = buildResponsesMeteringPayload(resp, t.metadata, true, duration, t.provider, t.requestTime, t.firstTokenTime, timeToFirstToken)
+	default:
+		return
+	}
+	if streamErr != nil {
+		payload.StopReason = MapRequestError(streamErr)
+		payload.ErrorReason = streamErr.Error()
+	}
+
+	t.parent.dispatchTransportPayload(t.ctx, payload)
+}
+
+// sseErrorEvent returns the error carried by an SSE event whose payload has a
+// top-level "error" object, as sent by providers that fail mid-stream
+func sseErrorEvent(data []byte) error {
+	var event struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil || event.Error == nil {
+		return nil
+	}
+	return fmt.Errorf("received error while streaming: %s", event.Error.Message)
+}
+
+// errSSEClosedEarly ends a streamed body closed by the caller before EOF
+var errSSEClosedEarly = fmt.Errorf("stream closed before it ended: %w", context.Canceled)
+
+// errSSEEndedEarly ends a Responses API stream that reached EOF without its
+// terminal event
+var errSSEEndedEarly = fmt.Errorf("stream ended before its terminal event: %w", context.Canceled)
+
+// sseDoneSentinel is the data of the event that ends a chat completion stream
+var sseDoneSentinel = []byte("[DONE]")
+
+// failedAttemptBody holds the body of an attempt rejected with an HTTP error.
+// The SDK reads the body of the attempt it returns to the caller and closes
+// the body of an attempt it retries unread, so the attempt is metered on the
+// first Read only.
+type failedAttemptBody struct {
+	*bytes.Reader
+	once  sync.Once
+	meter func()
+}
+
+func newFailedAttemptBody(body []byte, meter func()) *failedAttemptBody {
+	return &failedAttemptBody{Reader: bytes.NewReader(body), meter: meter}
+}
+
+func (b *failedAttemptBody) Read(p []byte) (int, error) {
+	b.once.Do(b.meter)
+	return b.Reader.Read(p)
+}
+
+func (b *failedAttemptBody) Close() error {
+	b.once.Do(func() {
+		Debug("[METERING] Failed attempt closed unread, the SDK retries it; not metered")
+	})
+	return nil
+}
+
+// sseMeteringBody passes an SSE response body through unchanged while handing
+// each complete "data:" payload, including the [DONE] sentinel, to onEvent. onDone is invoked exactly once, when
+// the body reaches EOF, fails, or is closed; with errSSEClosedEarly if it is
+// closed before EOF.
+type sseMeteringBody struct {
+	body    io.ReadCloser
+	pending []byte
+	onEvent func(data []byte)
+	onDone  func(err error)
+	once    sync.Once
+}
+
+func newSSEMeteringBody(body io.ReadCloser, onEvent func(data []byte), onDone func(err error)) *sseMeteringBody {
+	return &sseMeteringBody{
+		body:    body,
+		onEvent: onEvent,
+		onDone:  onDone,
+	}
+}
+
+func (b *sseMeteringBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.consume(p[:n])
+	}
+	if err == io.EOF {
+		b.flushPending()
+		b.done(nil)
+	} else if err != nil {
+		b.done(err)
+	}
+	return n, err
+}
+
+func (b *sseMeteringBody) Close() error {
+	err := b.body.Close()
+	b.done(errSSEClosedEarly)
+	return err
+}
+
+// consume splits buffered bytes into lines and dispatches complete data lines
+func (b *sseMeteringBody) consume(data []byte) {
+	b.pending = append(b.pending, data...)
+	for {
+		idx := bytes.IndexByte(b.pending, '\n')
+		if idx < 0 {
+			return
+		}
+		b.handleLine(b.pending[:idx])
+		b.pending = b.pending[idx+1:]
+	}
+}
+
+func (b *sseMeteringBody) flushPending() {
+	if len(b.pending) == 0 {
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b.pending))
+	for scanner.Scan() {
+		b.handleLine(scanner.Bytes())
+	}
+	b.pending = nil
+}
+
+func (b *sseMeteringBody) handleLine(line []byte) {
+	line = bytes.TrimRight(line, "\r")
+	if !bytes.HasPrefix(line, []byte("data:")) {
+		return
+	}
+	data := bytes.TrimSpace(line[len("data:"):])
+	if len(data) == 0 {
+		return
+	}
+	b.onEvent(data)
+}
+
+func (b *sseMeteringBody) done(err error) {
+	b.once.Do(func() {
+		b.onDone(err)
+	})
+}
@@ -0,0 +1,420 @@
+package revenium
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/option"
+	"github.com/revenium/revenium-middleware-openai-go/revenium/openaitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyEndpoint(t *testing.T) {
+	tests := []struct {
+		method   string
+		url      string
+		expected meteredEndpoint
+	}{
+		{http.MethodPost, "https://api.openai.com/v1/chat/completions", endpointChatCompletions},
+		{http.MethodPost, "https://x.openai.azure.com/openai/deployments/gpt-4o/chat/completions?api-version=2024-10-21", endpointChatCompletions},
+		{http.MethodPost, "https://api.openai.com/v1/responses", endpointResponses},
+		{http.MethodPost, "https://api.openai.com/v1/embeddings", endpointEmbeddings},
+		{http.MethodGet, "https://api.openai.com/v1/responses", endpointUnmetered},
+		{http.MethodPost, "https://api.openai.com/v1/files", endpointUnmetered},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.url, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			assert.Equal(t, tt.expected, classifyEndpoint(req))
+		})
+	}
+}
+
+func TestSSEMeteringBody(t *testing.T) {
+	raw := "data: {\"a\":1}\n\nevent: ping\ndata: {\"a\":2}\r\n\ndata: [DONE]\n\ndata: {\"a\":3}"
+	var events []string
+	var doneErr error
+	doneCalls := 0
+
+	body := newSSEMeteringBody(io.NopCloser(strings.NewReader(raw)), func(data []byte) {
+		events = append(events, string(data))
+	}, func(err error) {
+		doneCalls++
+		doneErr = err
+	})
+
+	out, err := io.ReadAll(body)
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+
+	assert.Equal(t, raw, string(out))
+	assert.Equal(t, []string{`{"a":1}`, `{"a":2}`, `[DONE]`, `{"a":3}`}, events)
+	assert.Equal(t, 1, doneCalls)
+	assert.NoError(t, doneErr)
+}
+
+func TestMeteringMiddlewareChatCompletion(t *testing.T) {
+	var mu sync.Mutex
+	var payloads []map[string]interface{}
+	revenium := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		payloads = append(payloads, payload)
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer revenium.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","created":1,"model":"gpt-4o-mini",
+			"choices":[{"index":0,"finish_reason":"length","message":{"role":"assistant","content":"hi"}}],
+			"usage":{"prompt_tokens":12,"completion_tokens":3,"total_tokens":15}}`))
+	}))
+	defer upstream.Close()
+
+	r, err := NewReveniumOpenAI(&Config{ReveniumAPIKey: "hak_test", ReveniumBaseURL: revenium.URL})
+	require.NoError(t, err)
+
+	client := openai.NewClient(
+		option.WithBaseURL(upstream.URL),
+		option.WithAPIKey("sk-test"),
+		r.MeteringMiddleware(),
+	)
+
+	ctx := WithUsageMetadata(context.Background(), map[string]interface{}{"organizationId": "org-1"})
+	resp, err := client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+		Model:    "gpt-4o-mini",
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("hello")},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "hi", resp.Choices[0].Message.Content)
+
+	r.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, "TOKEN_LIMIT", payloads[0]["stopReason"])
+	assert.Equal(t, float64(12), payloads[0]["inputTokenCount"])
+	assert.Equal(t, float64(3), payloads[0]["outputTokenCount"])
+	assert.Equal(t, "gpt-4o-mini", payloads[0]["model"])
+	assert.Equal(t, "org-1", payloads[0]["organizationId"])
+}
+
+// newTransportTestClient returns a plain openai client metered by the
+// transport middleware into a memory sink
+func newTransportTestClient(t *testing.T, opts ...option.RequestOption) (openai.Client, *ReveniumOpenAI, *openaitest.Server, *MemorySink) {
+	t.Helper()
+	upstream := openaitest.NewServer()
+	t.Cleanup(upstream.Close)
+
+	sink := NewMemorySink()
+	r, err := NewReveniumOpenAI(&Config{Sink: sink})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = r.Close() })
+
+	opts = append([]option.RequestOption{option.WithBaseURL(upstream.URL), option.WithAPIKey("sk-test"), r.MeteringMiddleware()}, opts...)
+	return openai.NewClient(opts...), r, upstream, sink
+}
+
+func TestMeteringMiddlewareMetersOnlyFinalAttempt(t *testing.T) {
+	client, r, upstream, sink := newTransportTestClient(t)
+	upstream.Enqueue(
+		openaitest.Response{Status: http.StatusServiceUnavailable},
+		openaitest.Response{Content: "hi", PromptTokens: 4, CompletionTokens: 1},
+	)
+
+	_, err := client.Chat.Completions.New(context.Background(), openai.ChatCompletionNewParams{
+		Model:    "gpt-4o-mini",
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("hello")},
+	})
+	require.NoError(t, err)
+	require.Len(t, upstream.Requests(), 2)
+
+	r.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1, "the retried attempt is not metered")
+	assert.Equal(t, StopReasonEnd, payloads[0].StopReason)
+	require.NotNil(t, payloads[0].RetryNumber)
+	assert.Equal(t, int64(1), *payloads[0].RetryNumber)
+}
+
+func TestMeteringMiddlewareResultReportsFinalAttempt(t *testing.T) {
+	attempts := 0
+	failFirst := option.WithMiddleware(func(req *http.Request, next option.MiddlewareNext) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, errors.New("connection reset")
+		}
+		return next(req)
+	})
+	client, r, upstream, sink := newTransportTestClient(t, failFirst)
+	upstream.Enqueue(openaitest.Response{Content: "hi", PromptTokens: 4, CompletionTokens: 1})
+
+	ctx, result := WithMeteredResult(context.Background())
+	_, err := client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+		Model:    "gpt-4o-mini",
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("hello")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, attempts)
+
+	require.NoError(t, result.Wait(context.Background()))
+	r.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 2, "the attempt failed without a response is metered too")
+	var final *MeteringPayload
+	for _, p := range payloads {
+		if p.StopReason == StopReasonEnd {
+			final = p
+		}
+	}
+	require.NotNil(t, final)
+	assert.Equal(t, final.TransactionID, result.TransactionID())
+}
+
+func TestMeteringMiddlewareResultResolvesOnRefusedConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	refusedURL := "http://" + listener.Addr().String() + "/v1"
+	require.NoError(t, listener.Close())
+
+	client, r, _, sink := newTransportTestClient(t, option.WithBaseURL(refusedURL), option.WithMaxRetries(1))
+	ctx, result := WithMeteredResult(context.Background())
+	_, err = client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+		Model:    "gpt-4o-mini",
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("hello")},
+	})
+	require.Error(t, err)
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, result.Wait(waitCtx), "the final failed attempt resolves the result")
+
+	r.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 2, "both attempts are metered")
+	var final *MeteringPayload
+	for _, p := range payloads {
+		assert.Equal(t, StopReasonError, p.StopReason)
+		if p.TransactionID == result.TransactionID() {
+			final = p
+		}
+	}
+	require.NotNil(t, final)
+	require.NotNil(t, final.RetryNumber, "the result reports the last attempt")
+	assert.Equal(t, int64(1), *final.RetryNumber)
+}
+
+func TestMeteringMiddlewareMetersExhaustedRetriesOnce(t *testing.T) {
+	client, r, upstream, sink := newTransportTestClient(t, option.WithMaxRetries(1))
+	upstream.Enqueue(
+		openaitest.Response{Status: http.StatusInternalServerError},
+		openaitest.Response{Status: http.StatusInternalServerError},
+	)
+
+	_, err := client.Chat.Completions.New(context.Background(), openai.ChatCompletionNewParams{
+		Model:    "gpt-4o-mini",
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("hello")},
+	})
+	require.Error(t, err)
+
+	r.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, StopReasonError, payloads[0].StopReason)
+}
+
+func TestMeteringMiddlewareStreamClosedEarly(t *testing.T) {
+	client, r, upstream, sink := newTransportTestClient(t)
+	upstream.Enqueue(openaitest.Response{Content: "one two three four", PromptTokens: 4, CompletionTokens: 4, Delay: 20 * time.Millisecond})
+
+	stream := client.Chat.Completions.NewStreaming(context.Background(), openai.ChatCompletionNewParams{
+		Model:    "gpt-4o-mini",
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("hello")},
+	})
+	require.True(t, stream.Next())
+	require.NoError(t, stream.Close())
+
+	r.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, StopReasonCancelled, payloads[0].StopReason)
+	assert.True(t, payloads[0].IsStreamed)
+}
+
+func TestMeteringMiddlewareStreamReadToEnd(t *testing.T) {
+	client, r, upstream, sink := newTransportTestClient(t)
+	upstream.Enqueue(openaitest.Response{Content: "one two", PromptTokens: 4, CompletionTokens: 2})
+
+	stream := client.Chat.Completions.NewStreaming(context.Background(), openai.ChatCompletionNewParams{
+		Model:         "gpt-4o-mini",
+		Messages:      []openai.ChatCompletionMessageParamUnion{openai.UserMessage("hello")},
+		StreamOptions: openai.ChatCompletionStreamOptionsParam{IncludeUsage: openai.Bool(true)},
+	})
+	for stream.Next() {
+	}
+	require.NoError(t, stream.Err())
+	require.NoError(t, stream.Close())
+
+	r.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, StopReasonEnd, payloads[0].StopReason, "closing after the terminal chunk is not a cancellation")
+	assert.Equal(t, int64(2), payloads[0].OutputTokenCount)
+}
+
+func TestMeteringMiddlewareCapturesRequestDetails(t *testing.T) {
+	client, r, upstream, sink := newTransportTestClient(t)
+	upstream.Enqueue(openaitest.Response{Content: "hello there", OmitUsage: true})
+
+	_, err := client.Chat.Completions.New(context.Background(), openai.ChatCompletionNewParams{
+		Model:       "gpt-4o-mini",
+		Messages:    []openai.ChatCompletionMessageParamUnion{openai.UserMessage("hello")},
+		Temperature: openai.Float(0.2),
+		Seed:        openai.Int(7),
+		ToolChoice:  openai.ChatCompletionToolChoiceOptionUnionParam{OfAuto: openai.String("none")},
+	})
+	require.NoError(t, err)
+
+	r.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	require.NotNil(t, payloads[0].Temperature)
+	assert.Equal(t, 0.2, *payloads[0].Temperature)
+	require.NotNil(t, payloads[0].Seed)
+	assert.Equal(t, int64(7), *payloads[0].Seed)
+	assert.Equal(t, "none", payloads[0].ToolChoice)
+	assert.True(t, payloads[0].TokensEstimated, "tokens are estimated from the request body")
+	assert.Positive(t, payloads[0].InputTokenCount)
+	assert.Positive(t, payloads[0].OutputTokenCount)
+}
+
+func TestMeteringMiddlewareEstimatesStreamWithoutUsage(t *testing.T) {
+	client, r, upstream, sink := newTransportTestClient(t)
+	upstream.Enqueue(openaitest.Response{Content: "one two three", OmitUsage: true})
+
+	stream := client.Chat.Completions.NewStreaming(context.Background(), openai.ChatCompletionNewParams{
+		Model:    "gpt-4o-mini",
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("hello")},
+		TopP:     openai.Float(0.9),
+	})
+	for stream.Next() {
+	}
+	require.NoError(t, stream.Close())
+
+	r.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	assert.True(t, payloads[0].TokensEstimated)
+	assert.Positive(t, payloads[0].OutputTokenCount)
+	require.NotNil(t, payloads[0].TopP)
+	assert.Equal(t, 0.9, *payloads[0].TopP)
+}
+
+func TestMeteringMiddlewareStreamClosedAfterFirstChoice(t *testing.T) {
+	client, r, upstream, sink := newTransportTestClient(t)
+	upstream.Enqueue(openaitest.Response{
+		Choices: []openaitest.Choice{{Content: "one"}, {Content: "two"}},
+		Delay:   10 * time.Millisecond,
+	})
+
+	stream := client.Chat.Completions.NewStreaming(context.Background(), openai.ChatCompletionNewParams{
+		Model:    "gpt-4o-mini",
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("hello")},
+		N:        openai.Int(2),
+	})
+	for stream.Next() {
+		if chunk := stream.Current(); len(chunk.Choices) > 0 && chunk.Choices[0].FinishReason != "" {
+			break
+		}
+	}
+	require.NoError(t, stream.Close())
+
+	r.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, StopReasonCancelled, payloads[0].StopReason, "the second choice had not finished")
+}
+
+func TestTransportStreamResponsesWithoutTerminalEvent(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewReveniumOpenAI(&Config{Sink: sink})
+	require.NoError(t, err)
+	defer r.Close()
+
+	stream := &transportStream{
+		ctx:         context.Background(),
+		parent:      r,
+		endpoint:    endpointResponses,
+		request:     transportRequestInfo{Model: "gpt-4o", Stream: true},
+		requestTime: time.Now(),
+	}
+	stream.onEvent([]byte(`{"type":"response.output_text.delta","delta":"Hel"}`))
+	stream.finish(nil)
+
+	r.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, StopReasonCancelled, payloads[0].StopReason)
+	assert.Equal(t, "gpt-4o", payloads[0].Model)
+	assert.NotEmpty(t, payloads[0].ErrorReason)
+}
+
+func TestMeteringMiddlewareStreamErrorEvent(t *testing.T) {
+	client, r, upstream, sink := newTransportTestClient(t)
+	upstream.Enqueue(openaitest.Response{Content: "one two three", StreamError: "overloaded", StreamErrorAfter: 1})
+
+	stream := client.Chat.Completions.NewStreaming(context.Background(), openai.ChatCompletionNewParams{
+		Model:    "gpt-4o-mini",
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("hello")},
+	})
+	for stream.Next() {
+	}
+	require.Error(t, stream.Err())
+	require.NoError(t, stream.Close())
+
+	r.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, StopReasonError, payloads[0].StopReason)
+	assert.Contains(t, payloads[0].ErrorReason, "overloaded")
+}
+
+func TestTransportStreamResponsesErrorEvent(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewReveniumOpenAI(&Config{Sink: sink})
+	require.NoError(t, err)
+	defer r.Close()
+
+	stream := &transportStream{
+		ctx:         context.Background(),
+		parent:      r,
+		endpoint:    endpointResponses,
+		request:     transportRequestInfo{Model: "gpt-4o", Stream: true},
+		requestTime: time.Now(),
+	}
+	stream.onEvent([]byte(`{"type":"response.output_text.delta","delta":"Hel"}`))
+	stream.onEvent([]byte(`{"type":"error","code":"server_error","message":"The server had an error"}`))
+	stream.finish(nil)
+
+	r.Flush()
+	payloads := sink.Payloads()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, StopReasonError, payloads[0].StopReason)
+	assert.Contains(t, payloads[0].ErrorReason, "The server had an error")
+}